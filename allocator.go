@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Number of times an insert is retried after losing a slot to another writer
+const maxAllocationAttempts = 5
+
+var errParentNotFound = errors.New("parent department not found")
+
+// allocateDepartment inserts a new department under parentID (0 for a root)
+// and returns the ID it was given.
+//
+// Requests allocating under the same parent are serialized by the
+// repository's allocation lock, and the slot lookup and insert run in one
+// transaction. If the insert still collides with a writer that bypassed the
+// lock, the allocation is retried with a fresh view of the used slots.
+func allocateDepartment(ctx context.Context, name string, parentID int) (int, error) {
+	for attempt := 1; ; attempt++ {
+		allocationAttempts.Inc()
+		var newID int
+		err := repo.Allocate(ctx, parentID, func(tx store.Tx) error {
+			var err error
+			if newID, err = nextSlot(ctx, tx, parentID); err != nil {
+				return err
+			}
+			slog.DebugContext(ctx, "Allocating department", "name", name, "parent_id", parentID, "id", newID, "attempt", attempt)
+			d := store.Department{ID: newID, Name: name, ParentID: parentID}
+			if err := tx.InsertDepartment(d); err != nil {
+				return err
+			}
+			return tx.RecordEvent(store.AuditEvent{Action: store.AuditDepartmentCreate, DepartmentID: newID, After: store.Snapshot(d)})
+		})
+		if err == nil {
+			return newID, nil
+		}
+		if !errors.Is(err, store.ErrDuplicate) {
+			return 0, err
+		}
+		allocationConflicts.Inc()
+		if attempt == maxAllocationAttempts {
+			return 0, err
+		}
+		allocationRetries.Inc()
+		slog.WarnContext(ctx, "Department ID conflict, retrying", "parent_id", parentID, "attempt", attempt, "max_attempts", maxAllocationAttempts, "err", err)
+	}
+}
+
+// nextSlot returns the next free child slot of parentID, or the next root for 0
+func nextSlot(ctx context.Context, tx store.Tx, parentID int) (int, error) {
+	if parentID != 0 {
+		return nextChildID(ctx, tx, parentID)
+	}
+	return nextRootID(ctx, tx)
+}
+
+// nextChildID locks the parent row and its child slots and returns the first free slot
+func nextChildID(ctx context.Context, tx store.Tx, parentID int) (int, error) {
+	children, err := encoding.Children(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.LockDepartment(parentID); err != nil {
+		if errors.Is(err, store.ErrDepartmentNotFound) {
+			return 0, errParentNotFound
+		}
+		return 0, err
+	}
+	subtree, err := encoding.Descendants(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if err := purgeTombstones(ctx, tx, subtree); err != nil {
+		return 0, err
+	}
+	used, err := tx.ExistingIDs(children)
+	if err != nil {
+		return 0, err
+	}
+	slog.DebugContext(ctx, "Child slots in use", "parent_id", parentID, "used", used)
+	return encoding.NextChild(parentID, used)
+}
+
+// nextRootID returns the root slot after the current maximum ID
+func nextRootID(ctx context.Context, tx store.Tx) (int, error) {
+	if err := purgeTombstones(ctx, tx, idgen.Range{Min: 1, Max: encoding.Limit() - 1}); err != nil {
+		return 0, err
+	}
+	maxID, err := tx.MaxID()
+	if err != nil {
+		return 0, err
+	}
+	slog.DebugContext(ctx, "Allocating root after the highest ID", "max_id", maxID)
+	return encoding.NextRoot(maxID)
+}
+
+// purgeTombstones removes for good the departments in r deleted longer than
+// ids.tombstone_quarantine ago. Until then a deleted department keeps its
+// slot, so that it can be restored under the same ID.
+func purgeTombstones(ctx context.Context, tx store.Tx, r idgen.Range) error {
+	purged, err := tx.PurgeTombstones(r, time.Now().Add(-time.Duration(cfg.IDs.TombstoneQuarantine)))
+	if err != nil {
+		return err
+	}
+	for _, d := range purged {
+		slog.InfoContext(ctx, "Purged deleted department after its quarantine", "id", d.ID)
+		if err := tx.RecordEvent(store.AuditEvent{Action: store.AuditDepartmentPurge, DepartmentID: d.ID, Before: store.Snapshot(d)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
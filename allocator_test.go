@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// openTestDB points repo at the MySQL database named by TEST_DB_DSN, e.g.
+// root:rootpassword@tcp(localhost:3306)/mydatabase?parseTime=true
+//
+// Without it, repo is an in-memory store holding the seed departments.
+func openTestDB(t testing.TB) {
+	t.Helper()
+	encoding = idgen.Default
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		repo = newMemoryRepo(t, loadSeedDepartments(t)...)
+		return
+	}
+	s, err := store.Open("mysql", dsn, encoding)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("ping database: %v", err)
+	}
+	repo = s
+	t.Cleanup(func() { s.Close() })
+}
+
+// newMemoryRepo returns an in-memory store holding departments, parents first
+func newMemoryRepo(t testing.TB, departments ...store.Department) *store.Memory {
+	t.Helper()
+	m := store.NewMemory(encoding)
+	seedDepartments(t, m, departments)
+	return m
+}
+
+// newSQLiteRepo returns a SQLite store in a temporary file holding
+// departments, parents first
+func newSQLiteRepo(t testing.TB, departments ...store.Department) *store.SQLStore {
+	t.Helper()
+	s, err := store.Open("sqlite", filepath.Join(t.TempDir(), "departments.db"), encoding)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.CreateSchema(context.Background()); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	seedDepartments(t, s, departments)
+	return s
+}
+
+func seedDepartments(t testing.TB, r store.Repository, departments []store.Department) {
+	t.Helper()
+	err := r.Allocate(context.Background(), 0, func(tx store.Tx) error {
+		for _, d := range departments {
+			if err := tx.InsertDepartment(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("seed departments: %v", err)
+	}
+}
+
+// The SQLite run exercises the locking and duplicate-key retry of a real
+// backend without an external database
+func TestCreateDepartmentConcurrent(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		openTestDB(t)
+		testCreateDepartmentConcurrent(t)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		encoding = idgen.Default
+		repo = newSQLiteRepo(t)
+		testCreateDepartmentConcurrent(t)
+	})
+}
+
+func testCreateDepartmentConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	rootID, err := allocateDepartment(context.Background(), "Concurrency Test Root", 0)
+	if err != nil {
+		t.Skipf("no root slot available: %v", err)
+	}
+	// Deleting only leaves a tombstone, so purge it too: otherwise it would
+	// hold the slot in a shared TEST_DB_DSN database for later runs
+	t.Cleanup(func() {
+		ctx := context.Background()
+		if _, err := repo.DeleteDepartment(ctx, rootID); err != nil {
+			t.Errorf("cleanup root %d: %v", rootID, err)
+			return
+		}
+		subtree, _ := encoding.Descendants(rootID)
+		err := repo.Allocate(ctx, 0, func(tx store.Tx) error {
+			_, err := tx.PurgeTombstones(subtree, time.Now().Add(time.Minute))
+			return err
+		})
+		if err != nil {
+			t.Errorf("purge root %d: %v", rootID, err)
+		}
+		parents, _ := repo.DepartmentParents(ctx)
+		if _, ok := parents[rootID]; ok {
+			t.Errorf("root %d is still stored after the purge", rootID)
+		}
+	})
+
+	r := gin.New()
+	r.POST("/api/departments", createDepartment)
+
+	n := encoding.Slots(1)
+	ids := make([]int, n)
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name":"Concurrent Team %d","parent_id":%d}`, i, rootID)
+			req := httptest.NewRequest(http.MethodPost, "/api/departments", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			codes[i] = w.Code
+			var resp struct {
+				ID int `json:"id"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			ids[i] = resp.ID
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i := range ids {
+		if codes[i] != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, codes[i])
+		}
+		if seen[ids[i]] {
+			t.Fatalf("id %d allocated twice", ids[i])
+		}
+		seen[ids[i]] = true
+		if parent, err := encoding.Parent(ids[i]); err != nil || parent != rootID {
+			t.Errorf("id %d: parent %d (%v), want %d", ids[i], parent, err, rootID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/store"
+)
+
+// ParentMismatch reports a department whose parent_id disagrees with its ID
+type ParentMismatch struct {
+	ID               int `json:"id"`
+	ParentID         int `json:"parent_id"`
+	ExpectedParentID int `json:"expected_parent_id"`
+}
+
+// Get the path from the root down to a department.
+// The ancestor IDs are derived from the ID itself and loaded with one query;
+// with ?verify=true each parent_id on the path is checked against the encoding.
+// Only the part of the path the caller may view is returned.
+func getDepartmentAncestors(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	ancestors, err := encoding.Ancestors(id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorize(c, auth.RoleViewer, id) {
+		return
+	}
+	path := append(ancestors, id)
+
+	rows, err := repo.GetDepartments(c.Request.Context(), path)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error querying ancestors", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query ancestors: %v", err)})
+		return
+	}
+	found := make(map[int]store.Department, len(rows))
+	for _, d := range rows {
+		found[d.ID] = d
+	}
+	if _, ok := found[id]; !ok {
+		c.JSON(404, gin.H{"error": "Department not found"})
+		return
+	}
+
+	departments := []gin.H{}
+	missing := []int{}
+	mismatches := []ParentMismatch{}
+	for i, deptID := range path {
+		// Ancestors above the caller's grants are left out of the path
+		if !can(c.Request.Context(), auth.RoleViewer, deptID) {
+			continue
+		}
+		d, ok := found[deptID]
+		if !ok {
+			missing = append(missing, deptID)
+			continue
+		}
+		departments = append(departments, gin.H{
+			"id":        deptID,
+			"parent_id": d.ParentID,
+			"name":      d.Name,
+			"level":     i,
+		})
+		expected := 0
+		if i > 0 {
+			expected = path[i-1]
+		}
+		if d.ParentID != expected {
+			mismatches = append(mismatches, ParentMismatch{ID: deptID, ParentID: d.ParentID, ExpectedParentID: expected})
+		}
+	}
+
+	response := gin.H{
+		"id":      id,
+		"path":    departments,
+		"missing": missing,
+	}
+	if c.Query("verify") == "true" {
+		response["consistent"] = len(missing) == 0 && len(mismatches) == 0
+		response["mismatches"] = mismatches
+	}
+	c.JSON(200, response)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Actor recorded for changes made while authentication is disabled
+const anonymousActor = "anonymous"
+
+// Actor recorded for changes made by the command line tools
+var cliActor = store.Actor{Subject: "cli"}
+
+// Page size used when pageSize is omitted, and the largest one accepted
+const defaultAuditPageSize = 100
+const maxAuditPageSize = 1000
+
+// actorMiddleware tells the repository who makes the changes of the request,
+// for the audit log. It runs after authMiddleware.
+func actorMiddleware(c *gin.Context) {
+	ctx := c.Request.Context()
+	actor := store.Actor{Subject: anonymousActor, RequestID: requestIDFrom(ctx)}
+	if principal := auth.FromContext(ctx); principal != nil {
+		actor.Subject = principal.Subject
+	}
+	c.Request = c.Request.WithContext(store.WithActor(ctx, actor))
+	c.Next()
+}
+
+// List audit events, newest first.
+//
+// Query parameters:
+//   - department: only events of this department and its subtree
+//   - actor: only events of this caller
+//   - from, to: RFC 3339 times; from is inclusive, to exclusive
+//   - pageSize, cursor: keyset pagination, returns events older than the cursor id
+//
+// Events of departments the caller cannot view are left out.
+func getAuditEvents(c *gin.Context) {
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(defaultAuditPageSize)))
+	if err != nil || pageSize < 1 {
+		c.JSON(400, gin.H{"error": "pageSize must be a positive integer"})
+		return
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+	query := store.AuditQuery{Actor: c.Query("actor"), Limit: pageSize}
+
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("%s must be a time like 2006-01-02T15:04:05Z", bound.param)})
+			return
+		}
+		*bound.value = t
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if query.Before, err = strconv.ParseInt(cursor, 10, 64); err != nil || query.Before < 1 {
+			c.JSON(400, gin.H{"error": "Invalid cursor " + cursor})
+			return
+		}
+	}
+
+	if department := c.Query("department"); department != "" {
+		id, err := strconv.Atoi(department)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid department " + department})
+			return
+		}
+		subtree, err := encoding.Descendants(id)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !authorize(c, auth.RoleViewer, id) {
+			return
+		}
+		query.Within = []idgen.Range{subtree}
+	} else {
+		query.Within = visibleRanges(c.Request.Context())
+	}
+
+	events, err := repo.ListAuditEvents(c.Request.Context(), query)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error querying audit events", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query audit events: %v", err)})
+		return
+	}
+
+	// The cursor is the last id of a full page
+	var nextCursor *int64
+	if len(events) == pageSize {
+		nextCursor = &events[len(events)-1].ID
+	}
+	c.JSON(200, gin.H{
+		"events":      events,
+		"page_size":   pageSize,
+		"next_cursor": nextCursor,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/store"
+)
+
+type auditPage struct {
+	Events     []store.AuditEvent `json:"events"`
+	NextCursor *int64             `json:"next_cursor"`
+}
+
+func auditActions(events []store.AuditEvent) []string {
+	actions := []string{}
+	for _, e := range events {
+		actions = append(actions, fmt.Sprintf("%s %d", e.Action, e.DepartmentID))
+	}
+	return actions
+}
+
+func TestAuditLog(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var created Employee
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Kim","department_id":889,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1"}`), 200, &created)
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Busan","parent_id":890}`), 200, nil)
+	expect(t, serve(r, http.MethodPut, "/api/departments/800", `{"name":"Compliance"}`), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/890/move", `{"new_parent_id":2000}`), 200, nil)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/1000", ""), 200, nil)
+
+	var page auditPage
+	expect(t, serve(r, http.MethodGet, "/api/audit", ""), 200, &page)
+	want := "department.delete 1000,department.move 890,department.rename 800,department.create 888,employee.create 889"
+	if got := strings.Join(auditActions(page.Events), ","); got != want {
+		t.Fatalf("events = %s, want %s", got, want)
+	}
+	if page.NextCursor != nil {
+		t.Errorf("next_cursor = %d on the last page", *page.NextCursor)
+	}
+	for _, e := range page.Events {
+		if e.Actor != anonymousActor || e.RequestID == "" {
+			t.Errorf("event %d: actor %q, request_id %q", e.ID, e.Actor, e.RequestID)
+		}
+	}
+
+	// Deleting 1000 took 900 and 800 along; 890 had moved out from under it
+	var deleted store.DeletedSubtree
+	if err := json.Unmarshal(page.Events[0].Before, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted.Departments) != 3 || deleted.Departments[0].Name != "Compliance" {
+		t.Errorf("deleted = %+v", deleted)
+	}
+	var moved struct {
+		ID       int `json:"id"`
+		ParentID int `json:"parent_id"`
+	}
+	json.Unmarshal(page.Events[1].After, &moved)
+	if moved.ParentID != 2000 || moved.ID < 1000 || moved.ID >= 2000 {
+		t.Errorf("moved to %+v", moved)
+	}
+
+	// Filters
+	expect(t, serve(r, http.MethodGet, "/api/audit?department=800", ""), 200, &page)
+	if got := strings.Join(auditActions(page.Events), ","); got != "department.rename 800" {
+		t.Errorf("events under 800 = %s", got)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/audit?pageSize=2", ""), 200, &page)
+	if len(page.Events) != 2 || page.NextCursor == nil {
+		t.Fatalf("first page = %+v", page)
+	}
+	expect(t, serve(r, http.MethodGet, fmt.Sprintf("/api/audit?pageSize=2&cursor=%d", *page.NextCursor), ""), 200, &page)
+	if got := strings.Join(auditActions(page.Events), ","); got != "department.rename 800,department.create 888" {
+		t.Errorf("second page = %s", got)
+	}
+	later := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	expect(t, serve(r, http.MethodGet, "/api/audit?from="+later, ""), 200, &page)
+	if len(page.Events) != 0 {
+		t.Errorf("events from an hour on = %+v", page.Events)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/audit?to="+later+"&actor=anonymous", ""), 200, &page)
+	if len(page.Events) != 5 {
+		t.Errorf("events of anonymous = %d, want 5", len(page.Events))
+	}
+	expect(t, serve(r, http.MethodGet, "/api/audit?actor=alice", ""), 200, &page)
+	if len(page.Events) != 0 {
+		t.Errorf("events of alice = %+v", page.Events)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/audit?from=yesterday", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/audit?department=x", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/audit?cursor=0", ""), 400, nil)
+}
+
+func TestAuditLogActors(t *testing.T) {
+	r := newGrantTestServer(t, map[string][]string{
+		"sales": {"editor:900"},
+		"root":  {"admin:0"},
+	})
+	as := func(name, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(auth.APIKeyHeader, name+"-key")
+		req.Header.Set(requestIDHeader, "req-"+name)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expect(t, as("sales", http.MethodPut, "/api/departments/890", `{"name":"Home"}`), 200, nil)
+	expect(t, as("root", http.MethodPut, "/api/departments/800", `{"name":"Compliance"}`), 200, nil)
+	// A rejected change leaves no event
+	expect(t, as("sales", http.MethodDelete, "/api/departments/890", ""), 403, nil)
+
+	var page auditPage
+	expect(t, as("root", http.MethodGet, "/api/audit", ""), 200, &page)
+	if len(page.Events) != 2 || page.Events[0].Actor != "root" || page.Events[1].Actor != "sales" || page.Events[1].RequestID != "req-sales" {
+		t.Errorf("events = %+v", page.Events)
+	}
+
+	// Callers only see the events of departments they may view
+	expect(t, as("sales", http.MethodGet, "/api/audit", ""), 200, &page)
+	if got := strings.Join(auditActions(page.Events), ","); got != "department.rename 890" {
+		t.Errorf("events visible to sales = %s", got)
+	}
+	expect(t, as("sales", http.MethodGet, "/api/audit?department=800", ""), 403, nil)
+}
@@ -0,0 +1,188 @@
+// Package auth authenticates API callers by static API key or by JWT bearer
+// token, and carries the authenticated caller in the request context.
+// Scopes limit what a credential may do at all; grants limit which
+// subtrees of the department tree it may do it on.
+//
+// API keys are configured as SHA-256 hashes, so the configuration never
+// holds a usable key. Tokens are HS256 or RS256 JWTs verified against the
+// keys of a local JWKS file.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes granted to callers
+const (
+	ScopeRead  = "read"  // query departments and employees
+	ScopeWrite = "write" // create, change and delete them
+)
+
+// Scopes lists every scope a caller can be granted
+var Scopes = []string{ScopeRead, ScopeWrite}
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers credentials are read from
+const (
+	APIKeyHeader        = "X-API-Key"
+	AuthorizationHeader = "Authorization"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries neither an API key nor a token.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned for an unknown API key or a token that does not verify.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// How a Principal authenticated
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// Principal is an authenticated caller
+type Principal struct {
+	// Subject is the name of the API key or the sub claim of the token
+	Subject string
+	Method  string
+	Scopes  []string
+	// Grants are the subtrees the caller may act on, and in which role
+	Grants []Grant
+	// Claims are the claims of the token, nil for an API key
+	Claims map[string]interface{}
+}
+
+// HasScope reports whether the caller was granted scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the caller stored in ctx, or nil for none
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// APIKey is a static key a caller presents in the X-API-Key header
+type APIKey struct {
+	Name string
+	// Hash is the key as returned by HashKey
+	Hash   string
+	Scopes []string
+	Grants []Grant
+}
+
+// Prefix of the hashes returned by HashKey
+const hashPrefix = "sha256:"
+
+// HashKey returns the form an API key is configured in
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// ParseHash checks that hash has the form returned by HashKey and returns its digest
+func ParseHash(hash string) ([]byte, error) {
+	digest, err := hex.DecodeString(strings.TrimPrefix(hash, hashPrefix))
+	if !strings.HasPrefix(hash, hashPrefix) || err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("hash must be %q followed by 64 hex digits", hashPrefix)
+	}
+	return digest, nil
+}
+
+// NewKey returns a random API key
+func NewKey() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+type apiKey struct {
+	APIKey
+	digest []byte
+}
+
+// Authenticator checks the credentials of a request
+type Authenticator struct {
+	keys   []apiKey
+	tokens *TokenVerifier // nil when bearer tokens are not accepted
+}
+
+// New returns an Authenticator accepting keys and, unless tokens is nil,
+// the bearer tokens tokens verifies
+func New(keys []APIKey, tokens *TokenVerifier) (*Authenticator, error) {
+	a := &Authenticator{tokens: tokens}
+	for _, k := range keys {
+		digest, err := ParseHash(k.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("auth: API key %q: %w", k.Name, err)
+		}
+		a.keys = append(a.keys, apiKey{APIKey: k, digest: digest})
+	}
+	return a, nil
+}
+
+// Authenticate returns the caller of r. An API key is tried before a
+// bearer token; a request carrying an invalid one is rejected even if the
+// other would verify.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.authenticateKey(key)
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get(AuthorizationHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	if a.tokens == nil {
+		return nil, fmt.Errorf("%w: bearer tokens are not accepted", ErrInvalidCredentials)
+	}
+	return a.tokens.Verify(strings.TrimSpace(token))
+}
+
+func (a *Authenticator) authenticateKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	// Compare against every key so the time taken does not reveal which one matched
+	var found *apiKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare(sum[:], a.keys[i].digest) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	return &Principal{Subject: found.Name, Method: MethodAPIKey, Scopes: found.Scopes, Grants: found.Grants}, nil
+}
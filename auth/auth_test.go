@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+	testNow    = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// testKeys returns an RSA key and a JWKS document holding its public half
+// as "rsa-1" and hmacSecret as "hmac-1"
+func testKeys(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())},
+		{"kty": "oct", "kid": "hmac-1", "alg": "HS256", "k": b64(hmacSecret)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, doc
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAPIKeys(t *testing.T) {
+	a, err := New([]APIKey{
+		{Name: "reporting", Hash: HashKey("read-key"), Scopes: []string{ScopeRead}},
+		{Name: "deploy", Hash: HashKey("write-key"), Scopes: []string{ScopeRead, ScopeWrite}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(APIKeyHeader, "write-key")
+	p, err := a.Authenticate(req)
+	if err != nil || p.Subject != "deploy" || p.Method != MethodAPIKey || !p.HasScope(ScopeWrite) {
+		t.Errorf("Authenticate = %+v, %v", p, err)
+	}
+
+	req.Header.Set(APIKeyHeader, "read-key")
+	if p, err := a.Authenticate(req); err != nil || p.HasScope(ScopeWrite) {
+		t.Errorf("read key = %+v, %v", p, err)
+	}
+
+	req.Header.Set(APIKeyHeader, HashKey("read-key"))
+	if _, err := a.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("the hash itself was accepted as a key: %v", err)
+	}
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no credentials = %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(AuthorizationHeader, "Bearer abc")
+	if _, err := a.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("token without a JWKS = %v", err)
+	}
+
+	for _, hash := range []string{"read-key", "sha256:abc", "md5:" + strings.Repeat("0", 64)} {
+		if _, err := New([]APIKey{{Name: "bad", Hash: hash}}, nil); err == nil {
+			t.Errorf("hash %q accepted", hash)
+		}
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	a, _ := NewKey()
+	b, err := NewKey()
+	if err != nil || a == b || len(a) < 40 {
+		t.Errorf("NewKey = %q, %q, %v", a, b, err)
+	}
+	if _, err := ParseHash(HashKey(a)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return testNow }
+
+	rsaKey, doc := testKeys(t)
+	keys, err := ParseJWKS(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewTokenVerifier(keys, "https://issuer.test", "departments-api", 30*time.Second)
+
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{"sub": "alice", "iss": "https://issuer.test", "aud": "departments-api", "exp": testNow.Add(time.Hour).Unix()}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []struct {
+		name   string
+		token  string
+		scopes []string
+	}{
+		{"RS256", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"scope": "read write"})), []string{"read", "write"}},
+		{"HS256", sign(t, jwt.SigningMethodHS256, "hmac-1", hmacSecret, claims(jwt.MapClaims{"scp": []string{"read"}})), []string{"read"}},
+		{"no kid", sign(t, jwt.SigningMethodHS256, "", hmacSecret, claims(nil)), nil},
+		{"expired within leeway", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"exp": testNow.Add(-10 * time.Second).Unix()})), nil},
+	}
+	for _, tt := range valid {
+		p, err := v.Verify(tt.token)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.Subject != "alice" || p.Method != MethodJWT || !reflect.DeepEqual(p.Scopes, tt.scopes) {
+			t.Errorf("%s: principal = %+v", tt.name, p)
+		}
+	}
+
+	invalid := []struct {
+		name  string
+		token string
+	}{
+		{"expired", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"exp": testNow.Add(-time.Minute).Unix()}))},
+		{"no exp", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"exp": nil}))},
+		{"not yet valid", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"nbf": testNow.Add(time.Hour).Unix()}))},
+		{"wrong issuer", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.test"}))},
+		{"wrong audience", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"aud": "other"}))},
+		{"no subject", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"sub": nil}))},
+		{"unknown signer", sign(t, jwt.SigningMethodRS256, "rsa-1", otherKey, claims(nil))},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, claims(nil))},
+		{"kid of another alg", sign(t, jwt.SigningMethodHS256, "rsa-1", hmacSecret, claims(nil))},
+		{"unsupported alg", sign(t, jwt.SigningMethodHS512, "hmac-1", hmacSecret, claims(nil))},
+		{"none", sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil))},
+		{"bad grant", sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"grants": []string{"owner:900"}}))},
+		{"garbage", "not.a.token"},
+	}
+	for _, tt := range invalid {
+		if p, err := v.Verify(tt.token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: Verify = %+v, %v", tt.name, p, err)
+		}
+	}
+
+	granted := sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"grants": []string{"editor:900", "viewer:0"}}))
+	if p, err := v.Verify(granted); err != nil || !reflect.DeepEqual(p.Grants, []Grant{{RoleEditor, 900}, {RoleViewer, 0}}) {
+		t.Errorf("grants = %+v, %v", p, err)
+	}
+
+	// The Authenticator reads the token from the Authorization header
+	a, err := New(nil, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(AuthorizationHeader, "bearer "+valid[0].token)
+	if p, err := a.Authenticate(req); err != nil || p.Subject != "alice" {
+		t.Errorf("Authenticate = %+v, %v", p, err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	_, doc := testKeys(t)
+	if _, err := ParseJWKS(doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{
+		`{}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256"}]}`,
+		`{"keys": [{"kty": "oct", "k": "c2hvcnQ"}]}`,
+		`{"keys": [{"kty": "oct", "alg": "HS512", "k": "` + b64(hmacSecret) + `"}]}`,
+		`{"keys": [{"kty": "oct", "use": "enc", "k": "` + b64(hmacSecret) + `"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "` + b64(big.NewInt(3233).Bytes()) + `", "e": "AQAB"}]}`,
+	} {
+		if _, err := ParseJWKS([]byte(doc)); err == nil {
+			t.Errorf("accepted %s", doc)
+		}
+	}
+}
+
+func TestPrincipalContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("principal in an empty context")
+	}
+	p := &Principal{Subject: "alice"}
+	if FromContext(WithPrincipal(context.Background(), p)) != p {
+		t.Error("principal not returned")
+	}
+}
+
+func TestParseGrant(t *testing.T) {
+	g, err := ParseGrant(" editor:900")
+	if err != nil || g != (Grant{Role: RoleEditor, DepartmentID: 900}) || g.String() != "editor:900" {
+		t.Errorf("ParseGrant = %+v, %v", g, err)
+	}
+	if RoleAdmin < RoleEditor || RoleEditor < RoleViewer {
+		t.Error("roles are not ordered")
+	}
+	for _, s := range []string{"", "editor", "owner:900", "viewer:-1", "viewer:sales"} {
+		if _, err := ParseGrant(s); err == nil {
+			t.Errorf("ParseGrant(%q) accepted", s)
+		}
+	}
+	if _, err := ParseGrants([]string{"viewer:0", "boss:1"}); err == nil {
+		t.Error("ParseGrants accepted an unknown role")
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Role is what a grant allows on a subtree. Each role includes the ones
+// before it.
+type Role int
+
+const (
+	RoleViewer Role = iota + 1 // read departments and employees
+	RoleEditor                 // also create and rename departments, and manage employees
+	RoleAdmin                  // also delete, move, compact and import departments
+)
+
+var roleNames = map[Role]string{
+	RoleViewer: "viewer",
+	RoleEditor: "editor",
+	RoleAdmin:  "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses "viewer", "editor" or "admin"
+func ParseRole(s string) (Role, error) {
+	for role, name := range roleNames {
+		if name == s {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q, expected viewer, editor or admin", s)
+}
+
+// Grant gives a role on a department and every department in its encoded
+// subtree. DepartmentID 0 grants the role on the whole tree, which is also
+// what creating, importing and compacting at the root level need.
+type Grant struct {
+	Role         Role
+	DepartmentID int
+}
+
+// ParseGrant parses a grant written as "role:department", e.g. "editor:900"
+// or "admin:0"
+func ParseGrant(s string) (Grant, error) {
+	name, id, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Grant{}, fmt.Errorf("grant %q is not role:department, e.g. editor:900", s)
+	}
+	role, err := ParseRole(name)
+	if err != nil {
+		return Grant{}, fmt.Errorf("grant %q: %w", s, err)
+	}
+	departmentID, err := strconv.Atoi(id)
+	if err != nil || departmentID < 0 {
+		return Grant{}, fmt.Errorf("grant %q: invalid department ID %q", s, id)
+	}
+	return Grant{Role: role, DepartmentID: departmentID}, nil
+}
+
+// ParseGrants parses every grant of list
+func ParseGrants(list []string) ([]Grant, error) {
+	grants := make([]Grant, 0, len(list))
+	for _, s := range list {
+		g, err := ParseGrant(s)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+func (g Grant) String() string {
+	return g.Role.String() + ":" + strconv.Itoa(g.DepartmentID)
+}
+
+// MarshalText writes the grant as ParseGrant reads it
+func (g Grant) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Minimum key sizes accepted from a JWKS file
+const (
+	minRSABits   = 2048
+	minHMACBytes = 32
+)
+
+// Clock tokens are checked against; replaced in tests
+var now = time.Now
+
+// jwk is one key of a JWKS document (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"` // RSA modulus
+	E   string `json:"e"` // RSA exponent
+	K   string `json:"k"` // symmetric key
+}
+
+// verificationKey is a key tokens can be verified with
+type verificationKey struct {
+	kid string
+	alg string      // HS256 or RS256
+	key interface{} // []byte or *rsa.PublicKey
+}
+
+// KeySet holds the keys of a JWKS file
+type KeySet struct {
+	keys []verificationKey
+}
+
+// LoadJWKS reads a JWKS file holding RSA keys for RS256 and symmetric
+// ("oct") keys for HS256
+func LoadJWKS(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	set, err := ParseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %s: %w", path, err)
+	}
+	return set, nil
+}
+
+// ParseJWKS decodes a JWKS document
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	set := &KeySet{}
+	for i, k := range doc.Keys {
+		key, err := k.verificationKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (kid %q): %w", i, k.Kid, err)
+		}
+		set.keys = append(set.keys, key)
+	}
+	return set, nil
+}
+
+func (k jwk) verificationKey() (verificationKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return verificationKey{}, fmt.Errorf("use %q is not sig", k.Use)
+	}
+	switch k.Kty {
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return verificationKey{}, fmt.Errorf("alg %s is not supported for RSA keys, only RS256", k.Alg)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return verificationKey{}, errors.New("e is not a valid exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSABits {
+			return verificationKey{}, fmt.Errorf("RSA key has %d bits, at least %d are required", pub.N.BitLen(), minRSABits)
+		}
+		return verificationKey{kid: k.Kid, alg: "RS256", key: pub}, nil
+	case "oct":
+		if k.Alg != "" && k.Alg != "HS256" {
+			return verificationKey{}, fmt.Errorf("alg %s is not supported for symmetric keys, only HS256", k.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("k: %w", err)
+		}
+		if len(secret) < minHMACBytes {
+			return verificationKey{}, fmt.Errorf("symmetric key has %d bytes, at least %d are required", len(secret), minHMACBytes)
+		}
+		return verificationKey{kid: k.Kid, alg: "HS256", key: secret}, nil
+	}
+	return verificationKey{}, fmt.Errorf("kty %q is not supported, expected RSA or oct", k.Kty)
+}
+
+// lookup returns the key a token signed with alg and kid is verified with.
+// A token without a kid is accepted only when a single key fits its alg.
+func (s *KeySet) lookup(alg, kid string) (interface{}, error) {
+	var found []verificationKey
+	for _, k := range s.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			found = append(found, k)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("no %s key with kid %q", alg, kid)
+	case len(found) > 1:
+		return nil, fmt.Errorf("token has no kid and %d %s keys match", len(found), alg)
+	}
+	return found[0].key, nil
+}
+
+// TokenVerifier verifies JWT bearer tokens
+type TokenVerifier struct {
+	keys   *KeySet
+	parser *jwt.Parser
+}
+
+// NewTokenVerifier returns a verifier for tokens signed by keys. Tokens must
+// carry an exp claim; issuer and audience, when not empty, must match the
+// iss and aud claims. leeway is the clock skew tolerated on exp and nbf.
+func NewTokenVerifier(keys *KeySet, issuer, audience string, leeway time.Duration) *TokenVerifier {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+		jwt.WithTimeFunc(func() time.Time { return now() }),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+	return &TokenVerifier{keys: keys, parser: jwt.NewParser(opts...)}
+}
+
+// Verify checks the signature and claims of token and returns its caller.
+// Scopes come from the space-separated scope claim or the scp array, grants
+// from the grants claim, a list like ["editor:900"].
+func (v *TokenVerifier) Verify(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.lookup(t.Method.Alg(), kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, fmt.Errorf("%w: token has no sub claim", ErrInvalidCredentials)
+	}
+	grants, err := tokenGrants(claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return &Principal{Subject: subject, Method: MethodJWT, Scopes: tokenScopes(claims), Grants: grants, Claims: claims}, nil
+}
+
+// tokenGrants parses the grants claim; a grant that does not parse rejects
+// the token rather than being dropped
+func tokenGrants(claims jwt.MapClaims) ([]Grant, error) {
+	raw, ok := claims["grants"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("grants claim is not a list")
+	}
+	var grants []Grant
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("grants claim holds a non-string")
+		}
+		g, err := ParseGrant(s)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+func tokenScopes(claims jwt.MapClaims) []string {
+	var scopes []string
+	if scope, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+)
+
+// authenticator checks the credentials of API requests; nil while
+// authentication is disabled and every caller is let through
+var authenticator *auth.Authenticator
+
+func initAuth() {
+	a, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		fatal("Invalid authentication configuration", "err", err)
+	}
+	if a == nil {
+		slog.Warn("Authentication is disabled; anyone reaching the API can change and delete departments")
+	} else if _, anyOrigin := allowedOrigin(""); anyOrigin {
+		slog.Warn(`Authentication is enabled but server.cors_origins allows "*"; any web page can call the API with a caller's credentials`)
+	}
+	authenticator = a
+}
+
+// newAuthenticator builds the authenticator c describes, or nil when c is disabled
+func newAuthenticator(c config.Auth) (*auth.Authenticator, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	var tokens *auth.TokenVerifier
+	if c.JWT.JWKSFile != "" {
+		keys, err := auth.LoadJWKS(c.JWT.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = auth.NewTokenVerifier(keys, c.JWT.Issuer, c.JWT.Audience, time.Duration(c.JWT.Leeway))
+	}
+	keys := make([]auth.APIKey, len(c.APIKeys))
+	for i, k := range c.APIKeys {
+		grants, err := auth.ParseGrants(k.Grants)
+		if err != nil {
+			return nil, fmt.Errorf("auth: API key %q: %w", k.Name, err)
+		}
+		keys[i] = auth.APIKey{Name: k.Name, Hash: k.Hash, Scopes: k.Scopes, Grants: grants}
+	}
+	return auth.New(keys, tokens)
+}
+
+// authMiddleware rejects requests without valid credentials and stores the
+// caller in the request context, where auth.FromContext finds it
+func authMiddleware(c *gin.Context) {
+	if authenticator == nil {
+		c.Next()
+		return
+	}
+	principal, err := authenticator.Authenticate(c.Request)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoCredentials) {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		slog.WarnContext(c.Request.Context(), "Authentication failed", "err", err, "client_ip", c.ClientIP())
+		c.Header("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	c.Request = c.Request.WithContext(auth.WithPrincipal(c.Request.Context(), principal))
+	c.Next()
+}
+
+// requireScope rejects callers that were not granted scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticator == nil {
+			c.Next()
+			return
+		}
+		if principal := auth.FromContext(c.Request.Context()); principal == nil || !principal.HasScope(scope) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope=%q`, scope))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This request needs the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// getCaller returns who the request was authenticated as
+func getCaller(c *gin.Context) {
+	principal := auth.FromContext(c.Request.Context())
+	if principal == nil {
+		c.JSON(200, gin.H{"authenticated": false})
+		return
+	}
+	scopes := principal.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	grants := []string{}
+	for _, g := range principal.Grants {
+		grants = append(grants, g.String())
+	}
+	c.JSON(200, gin.H{
+		"authenticated": true,
+		"subject":       principal.Subject,
+		"method":        principal.Method,
+		"scopes":        scopes,
+		"grants":        grants,
+	})
+}
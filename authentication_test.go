@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+)
+
+// serveAs sends a request with the given credential header
+func serveAs(r *gin.Engine, header, value, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// newAuthTestServer enables authentication with a read-only key "reader"
+// viewing the whole tree, a read-write key "writer" administering it, and
+// HS256 tokens signed with secret
+func newAuthTestServer(t *testing.T, secret []byte) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t, testTree...)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	doc := `{"keys": [{"kty": "oct", "kid": "test", "alg": "HS256", "k": "` + base64.RawURLEncoding.EncodeToString(secret) + `"}]}`
+	if err := os.WriteFile(jwks, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthenticator(config.Auth{
+		Enabled: true,
+		APIKeys: []config.APIKey{
+			{Name: "reader", Hash: auth.HashKey("reader-key"), Scopes: []string{auth.ScopeRead}, Grants: []string{"viewer:0"}},
+			{Name: "writer", Hash: auth.HashKey("writer-key"), Scopes: []string{auth.ScopeRead, auth.ScopeWrite}, Grants: []string{"admin:0"}},
+		},
+		JWT: config.JWT{JWKSFile: jwks, Issuer: "https://issuer.test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator = a
+	t.Cleanup(func() { authenticator = nil })
+	return r
+}
+
+func TestAuthentication(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	r := newAuthTestServer(t, secret)
+
+	// The health probe stays open; metrics need the read scope on the whole tree
+	expect(t, serve(r, http.MethodGet, "/health", ""), 200, nil)
+	expect(t, serve(r, http.MethodGet, "/metrics", ""), 401, nil)
+	expect(t, serveAs(r, auth.APIKeyHeader, "reader-key", http.MethodGet, "/metrics", ""), 200, nil)
+
+	w := serve(r, http.MethodGet, "/api/departments", "")
+	expect(t, w, 401, nil)
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "guess", http.MethodGet, "/api/departments", ""), 401, nil)
+	expect(t, serveAs(r, auth.APIKeyHeader, auth.HashKey("reader-key"), http.MethodGet, "/api/departments", ""), 401, nil)
+
+	// The read scope covers queries, including the POST listing employees
+	expect(t, serveAs(r, auth.APIKeyHeader, "reader-key", http.MethodGet, "/api/departments/900", ""), 200, nil)
+	expect(t, serveAs(r, auth.APIKeyHeader, "reader-key", http.MethodPost, "/api/employees/by-departments", `[900]`), 200, nil)
+	w = serveAs(r, auth.APIKeyHeader, "reader-key", http.MethodDelete, "/api/departments/900", "")
+	expect(t, w, 403, nil)
+	if !strings.Contains(w.Header().Get("WWW-Authenticate"), `scope="write"`) {
+		t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "reader-key", http.MethodPost, "/api/departments", `{"name":"Marketing"}`), 403, nil)
+	if ids := departmentIDs(t); len(ids) != len(testTree) {
+		t.Errorf("a read-only caller changed the departments: %v", ids)
+	}
+
+	expect(t, serveAs(r, auth.APIKeyHeader, "writer-key", http.MethodDelete, "/api/departments/800", ""), 200, nil)
+
+	var caller struct {
+		Authenticated bool     `json:"authenticated"`
+		Subject       string   `json:"subject"`
+		Method        string   `json:"method"`
+		Scopes        []string `json:"scopes"`
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "writer-key", http.MethodGet, "/api/me", ""), 200, &caller)
+	if !caller.Authenticated || caller.Subject != "writer" || caller.Method != auth.MethodAPIKey || len(caller.Scopes) != 2 {
+		t.Errorf("caller = %+v", caller)
+	}
+
+	// Bearer tokens carry their scopes in the scope claim
+	token := func(claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		tok.Header["kid"] = "test"
+		signed, err := tok.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	reader := token(jwt.MapClaims{"sub": "alice", "iss": "https://issuer.test", "exp": exp, "scope": "read", "grants": []string{"viewer:0"}})
+	expect(t, serveAs(r, auth.AuthorizationHeader, reader, http.MethodGet, "/api/departments/900", ""), 200, nil)
+	expect(t, serveAs(r, auth.AuthorizationHeader, reader, http.MethodPut, "/api/departments/900", `{"name":"Sales"}`), 403, nil)
+	expect(t, serveAs(r, auth.AuthorizationHeader, reader, http.MethodGet, "/api/me", ""), 200, &caller)
+	if caller.Subject != "alice" || caller.Method != auth.MethodJWT {
+		t.Errorf("caller = %+v", caller)
+	}
+
+	expired := token(jwt.MapClaims{"sub": "alice", "iss": "https://issuer.test", "exp": time.Now().Add(-time.Hour).Unix(), "scope": "read"})
+	w = serveAs(r, auth.AuthorizationHeader, expired, http.MethodGet, "/api/departments/900", "")
+	expect(t, w, 401, nil)
+	if !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+	}
+	otherIssuer := token(jwt.MapClaims{"sub": "alice", "iss": "https://evil.test", "exp": exp, "scope": "read write"})
+	expect(t, serveAs(r, auth.AuthorizationHeader, otherIssuer, http.MethodGet, "/api/departments/900", ""), 401, nil)
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	a, err := newAuthenticator(config.Default().Auth)
+	if err != nil || a != nil {
+		t.Fatalf("default authenticator = %v, %v", a, err)
+	}
+	expect(t, serve(r, http.MethodDelete, "/api/departments/800", ""), 200, nil)
+	var caller map[string]interface{}
+	expect(t, serve(r, http.MethodGet, "/api/me", ""), 200, &caller)
+	if caller["authenticated"] != false {
+		t.Errorf("caller = %v", caller)
+	}
+
+	if _, err := newAuthenticator(config.Auth{Enabled: true, JWT: config.JWT{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}}); err == nil {
+		t.Error("missing JWKS file accepted")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+)
+
+// can reports whether the caller of ctx holds at least role on department
+// id. The ID 0 asks for the role on the whole tree, which only a grant on 0
+// gives. Everything is allowed while authentication is disabled.
+//
+// A grant covers its encoded subtree, so this is a range check on the ID and
+// never needs to read the tree.
+func can(ctx context.Context, role auth.Role, id int) bool {
+	if authenticator == nil {
+		return true
+	}
+	principal := auth.FromContext(ctx)
+	if principal == nil {
+		return false
+	}
+	for _, g := range principal.Grants {
+		if g.Role < role {
+			continue
+		}
+		if g.DepartmentID == 0 || (id != 0 && encoding.IsDescendant(g.DepartmentID, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize answers 403 and returns false unless the caller holds role on
+// department id (0 for the whole tree)
+func authorize(c *gin.Context, role auth.Role, id int) bool {
+	if can(c.Request.Context(), role, id) {
+		return true
+	}
+	target := fmt.Sprintf("department %d", id)
+	if id == 0 {
+		target = "the whole tree"
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("This request needs the %s role on %s", role, target)})
+	return false
+}
+
+// visibleRanges returns the ID ranges of the departments the caller of ctx
+// may view, or nil when it may view every department
+func visibleRanges(ctx context.Context) []idgen.Range {
+	if can(ctx, auth.RoleViewer, 0) {
+		return nil
+	}
+	ranges := []idgen.Range{}
+	if principal := auth.FromContext(ctx); principal != nil {
+		for _, g := range principal.Grants {
+			if r, err := encoding.Descendants(g.DepartmentID); err == nil {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	return ranges
+}
+
+// visibleIDs keeps the department IDs the caller of ctx may view
+func visibleIDs(ctx context.Context, ids []int) []int {
+	visible := []int{}
+	for _, id := range ids {
+		if can(ctx, auth.RoleViewer, id) {
+			visible = append(visible, id)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/store"
+)
+
+// newGrantTestServer enables authentication with one read-write API key per
+// entry of grants, the key being the name followed by "-key"
+func newGrantTestServer(t *testing.T, grants map[string][]string) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t, testTree...)
+	var keys []config.APIKey
+	for name, g := range grants {
+		keys = append(keys, config.APIKey{
+			Name:   name,
+			Hash:   auth.HashKey(name + "-key"),
+			Scopes: []string{auth.ScopeRead, auth.ScopeWrite},
+			Grants: g,
+		})
+	}
+	a, err := newAuthenticator(config.Auth{Enabled: true, APIKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator = a
+	t.Cleanup(func() { authenticator = nil })
+	return r
+}
+
+func TestAuthorization(t *testing.T) {
+	r := newGrantTestServer(t, map[string][]string{
+		"sales":    {"editor:900"},
+		"domestic": {"viewer:890"},
+		"nobody":   nil,
+		"root":     {"admin:0"},
+	})
+	as := func(name, method, path, body string) (int, string) {
+		w := serveAs(r, auth.APIKeyHeader, name+"-key", method, path, body)
+		return w.Code, w.Body.String()
+	}
+	check := func(name, method, path, body string, want int) {
+		t.Helper()
+		if got, resp := as(name, method, path, body); got != want {
+			t.Errorf("%s %s %s: status %d, want %d: %s", name, method, path, got, want, resp)
+		}
+	}
+
+	// A grant covers its department and everything below it, nothing above
+	check("sales", http.MethodGet, "/api/departments/889", "", 200)
+	check("sales", http.MethodGet, "/api/departments/1000", "", 403)
+	check("sales", http.MethodGet, "/api/departments/800", "", 403)
+	check("domestic", http.MethodGet, "/api/departments/900", "", 403)
+	check("nobody", http.MethodGet, "/api/departments/900", "", 403)
+
+	// Metrics describe the whole tree, so a subtree grant cannot scrape them
+	check("sales", http.MethodGet, "/metrics", "", 403)
+	check("root", http.MethodGet, "/metrics", "", 200)
+
+	// Editors create and rename below their grant, but move and delete need admin
+	check("sales", http.MethodPost, "/api/departments", `{"name":"Export","parent_id":900}`, 200)
+	check("sales", http.MethodPost, "/api/departments", `{"name":"Export","parent_id":800}`, 403)
+	check("sales", http.MethodPost, "/api/departments", `{"name":"Export"}`, 403)
+	check("sales", http.MethodPut, "/api/departments/890", `{"name":"Home"}`, 200)
+	check("domestic", http.MethodPut, "/api/departments/890", `{"name":"Home"}`, 403)
+	check("sales", http.MethodDelete, "/api/departments/889", "", 403)
+	check("sales", http.MethodPost, "/api/departments/889/move", `{"new_parent_id":900}`, 403)
+	check("sales", http.MethodGet, "/api/admin/integrity", "", 403)
+	check("root", http.MethodGet, "/api/admin/integrity", "", 200)
+
+	// Listings are narrowed to the grants instead of refused
+	var list []map[string]interface{}
+	expect(t, serveAs(r, auth.APIKeyHeader, "domestic-key", http.MethodGet, "/api/departments", ""), 200, &list)
+	if len(list) != 2 {
+		t.Errorf("departments visible to domestic = %v", list)
+	}
+	var ancestors struct {
+		Path []map[string]interface{} `json:"path"`
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "domestic-key", http.MethodGet, "/api/departments/889/ancestors", ""), 200, &ancestors)
+	if len(ancestors.Path) != 2 || ancestors.Path[0]["id"] != float64(890) {
+		t.Errorf("path visible to domestic = %v", ancestors.Path)
+	}
+
+	// Employees follow the department they belong to
+	var created Employee
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodPost, "/api/employees",
+		`{"name":"Kim","department_id":889,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1"}`), 200, &created)
+	check("sales", http.MethodPost, "/api/employees",
+		`{"name":"Lee","department_id":800,"position":"Staff","hire_date":"2021-03-01","employee_number":"E2"}`, 403)
+	check("root", http.MethodPost, "/api/employees",
+		`{"name":"Lee","department_id":800,"position":"Staff","hire_date":"2021-03-01","employee_number":"E2"}`, 200)
+	path := fmt.Sprintf("/api/employees/%d", created.ID)
+	check("domestic", http.MethodGet, path, "", 200)
+	check("domestic", http.MethodDelete, path, "", 403)
+	check("sales", http.MethodPut, path,
+		`{"name":"Kim","department_id":800,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1"}`, 403)
+
+	// An employee outside the caller's grants looks the same as a missing one
+	missing := fmt.Sprintf("/api/employees/%d", created.ID+1000)
+	for _, p := range []string{path, missing} {
+		check("nobody", http.MethodGet, p, "", 404)
+		check("nobody", http.MethodDelete, p, "", 404)
+		check("nobody", http.MethodPut, p,
+			`{"name":"Kim","department_id":889,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1"}`, 404)
+	}
+	check("root", http.MethodGet, path, "", 200)
+
+	var page struct {
+		Employees []Employee `json:"employees"`
+		Total     int        `json:"total"`
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodGet, "/api/employees", ""), 200, &page)
+	if page.Total != 1 || len(page.Employees) != 1 || page.Employees[0].Name != "Kim" {
+		t.Errorf("employees visible to sales = %+v", page)
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "nobody-key", http.MethodGet, "/api/employees", ""), 200, &page)
+	if page.Total != 0 {
+		t.Errorf("employees visible without grants = %+v", page)
+	}
+
+	// Departments the caller cannot see are quietly dropped
+	var employees []Employee
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodPost, "/api/employees/by-departments", `[889, 800]`), 200, &employees)
+	if len(employees) != 1 || employees[0].Name != "Kim" {
+		t.Errorf("employees of 889 and 800 visible to sales = %+v", employees)
+	}
+
+	var caller struct {
+		Grants []string `json:"grants"`
+	}
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodGet, "/api/me", ""), 200, &caller)
+	if len(caller.Grants) != 1 || caller.Grants[0] != "editor:900" {
+		t.Errorf("grants = %v", caller.Grants)
+	}
+
+	check("sales", http.MethodDelete, path, "", 200)
+}
+
+// A parent_id that disagrees with the encoding must not lead a subtree
+// grant to departments and employees outside its range
+func TestAuthorizationInconsistentParent(t *testing.T) {
+	r := newGrantTestServer(t, map[string][]string{"sales": {"viewer:900"}})
+	ctx := context.Background()
+	// 700 belongs under 1000 but claims 890 as its parent
+	if err := repo.Allocate(ctx, 0, func(tx store.Tx) error {
+		return tx.InsertDepartment(store.Department{ID: 700, Name: "Marketing", ParentID: 890})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, emp := range []Employee{
+		{Name: "Kim", DepartmentID: 889, Position: "Manager", HireDate: "2021-03-01", EmployeeNumber: "E1"},
+		{Name: "Lee", DepartmentID: 700, Position: "Staff", HireDate: "2021-03-01", EmployeeNumber: "E2"},
+	} {
+		if _, err := repo.CreateEmployee(ctx, emp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tree []map[string]interface{}
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodGet, "/api/departments/tree-recursive?parentId=900", ""), 200, &tree)
+	for _, node := range tree {
+		if node["id"] == float64(700) {
+			t.Errorf("tree visible to sales includes 700: %v", tree)
+		}
+	}
+	if len(tree) != 3 {
+		t.Errorf("tree visible to sales = %v, want 900, 890 and 889", tree)
+	}
+
+	var employees []Employee
+	expect(t, serveAs(r, auth.APIKeyHeader, "sales-key", http.MethodGet, "/api/departments/900/employees", ""), 200, &employees)
+	if len(employees) != 1 || employees[0].Name != "Kim" {
+		t.Errorf("employees visible to sales = %+v", employees)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/store"
+)
+
+// Bounds of GET /api/bench/tree so a single call cannot run for hours
+const defaultBenchIterations = 10
+const maxBenchIterations = 1000
+const maxBenchPayload = 200000
+
+// treeStrategy names a way of loading a subtree from the repository
+type treeStrategy struct {
+	Name     string
+	Strategy store.TreeStrategy
+}
+
+var treeStrategies = []treeStrategy{
+	{Name: "recursive_cte", Strategy: store.ByParentID},
+	{Name: "id_range", Strategy: store.ByIDRange},
+}
+
+// Latency summarizes the duration of the samples in milliseconds
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// BenchResult is the outcome of one strategy. Rows and Bytes are totals of
+// a single iteration over every root; Bytes counts the text of the id,
+// name, parent_id and payload values.
+type BenchResult struct {
+	Strategy  string  `json:"strategy"`
+	Samples   int     `json:"samples"`
+	Rows      int     `json:"rows"`
+	Bytes     int64   `json:"bytes"`
+	LatencyMs Latency `json:"latency_ms"`
+}
+
+// Compare the tree strategies over the same roots.
+//
+// Query parameters:
+//   - roots: comma separated department IDs (default every root department)
+//   - iterations: number of passes over the roots per strategy
+//   - payload: repetitions of the synthetic payload column (default 0, none)
+func benchTree(c *gin.Context) {
+	iterations, err := strconv.Atoi(c.DefaultQuery("iterations", strconv.Itoa(defaultBenchIterations)))
+	if err != nil || iterations < 1 || iterations > maxBenchIterations {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("iterations must be between 1 and %d", maxBenchIterations)})
+		return
+	}
+	payload, err := strconv.Atoi(c.DefaultQuery("payload", "0"))
+	if err != nil || payload < 0 || payload > maxBenchPayload {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("payload must be between 0 and %d", maxBenchPayload)})
+		return
+	}
+
+	var roots []int
+	if value := c.Query("roots"); value != "" {
+		for _, part := range strings.Split(value, ",") {
+			root, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid root " + part})
+				return
+			}
+			if !authorize(c, auth.RoleViewer, root) {
+				return
+			}
+			roots = append(roots, root)
+		}
+	} else if !authorize(c, auth.RoleViewer, 0) {
+		return
+	} else if roots, err = repo.RootDepartmentIDs(c.Request.Context()); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error querying root departments", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query root departments: %v", err)})
+		return
+	}
+
+	results, mismatched, err := runTreeBench(c.Request.Context(), roots, iterations, payload)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error running tree benchmark", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to run tree benchmark: %v", err)})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"roots":            roots,
+		"iterations":       iterations,
+		"payload":          payload,
+		"results":          results,
+		"mismatched_roots": mismatched,
+	})
+}
+
+// runTreeBench runs every strategy iterations times over roots. It also
+// returns the roots for which the strategies disagree on the set of IDs.
+func runTreeBench(ctx context.Context, roots []int, iterations, payload int) ([]BenchResult, []int, error) {
+	results := make([]BenchResult, len(treeStrategies))
+	idsByStrategy := make([]map[int][]int, len(treeStrategies))
+	for i, strategy := range treeStrategies {
+		result := BenchResult{Strategy: strategy.Name}
+		idsByStrategy[i] = make(map[int][]int, len(roots))
+		var samples []time.Duration
+		for iteration := 0; iteration < iterations; iteration++ {
+			for _, root := range roots {
+				start := time.Now()
+				ids, bytes, err := runTreeQuery(ctx, strategy.Strategy, root, payload)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s for root %d: %w", strategy.Name, root, err)
+				}
+				samples = append(samples, time.Since(start))
+				if iteration == 0 {
+					result.Rows += len(ids)
+					result.Bytes += bytes
+					idsByStrategy[i][root] = ids
+				}
+			}
+		}
+		result.Samples = len(samples)
+		result.LatencyMs = summarizeLatency(samples)
+		results[i] = result
+	}
+
+	mismatched := []int{}
+	for _, root := range roots {
+		for i := 1; i < len(idsByStrategy); i++ {
+			if !sameIDs(idsByStrategy[0][root], idsByStrategy[i][root]) {
+				mismatched = append(mismatched, root)
+				break
+			}
+		}
+	}
+	return results, mismatched, nil
+}
+
+// runTreeQuery loads the subtree of root and returns the IDs it found,
+// sorted, and the number of bytes in the returned values.
+func runTreeQuery(ctx context.Context, strategy store.TreeStrategy, root, payload int) ([]int, int64, error) {
+	nodes, err := repo.LoadTree(ctx, root, strategy, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ids := make([]int, len(nodes))
+	var bytes int64
+	for i, node := range nodes {
+		ids[i] = node.ID
+		bytes += int64(len(strconv.Itoa(node.ID)) + len(node.Name) + len(node.Payload))
+		if node.ParentID != 0 {
+			bytes += int64(len(strconv.Itoa(node.ParentID)))
+		}
+	}
+	sort.Ints(ids)
+	return ids, bytes, nil
+}
+
+// summarizeLatency computes nearest-rank percentiles of the samples
+func summarizeLatency(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	ms := make([]float64, len(samples))
+	var sum float64
+	for i, d := range samples {
+		ms[i] = float64(d) / float64(time.Millisecond)
+		sum += ms[i]
+	}
+	sort.Float64s(ms)
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p / 100 * float64(len(ms))))
+		if rank < 1 {
+			rank = 1
+		}
+		return ms[rank-1]
+	}
+	return Latency{
+		Min:  ms[0],
+		Mean: sum / float64(len(ms)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+		Max:  ms[len(ms)-1],
+	}
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// benchRoot returns the subtree root to benchmark, TEST_BENCH_ROOT or 1000
+func benchRoot() int {
+	root, err := strconv.Atoi(os.Getenv("TEST_BENCH_ROOT"))
+	if err != nil {
+		return 1000
+	}
+	return root
+}
+
+func BenchmarkTreeStrategies(b *testing.B) {
+	openTestDB(b)
+	root := benchRoot()
+	for _, strategy := range treeStrategies {
+		for _, payload := range []int{0, 1000} {
+			b.Run(strategy.Name+"/payload="+strconv.Itoa(payload), func(b *testing.B) {
+				var rows int
+				var bytes int64
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ids, n, err := runTreeQuery(context.Background(), strategy.Strategy, root, payload)
+					if err != nil {
+						b.Fatal(err)
+					}
+					rows, bytes = len(ids), n
+				}
+				b.ReportMetric(float64(rows), "rows/op")
+				b.SetBytes(bytes)
+			})
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+)
+
+// Utilization at or above which a node is reported as close to exhaustion
+const defaultCapacityThreshold = 0.8
+
+// LevelUsage sums the child slots of every node on one level of a subtree
+type LevelUsage struct {
+	Level    int           `json:"level"`
+	Parents  int           `json:"parents"`
+	Capacity int           `json:"capacity"`
+	Used     int           `json:"used"`
+	Free     int           `json:"free"`
+	Nodes    []idgen.Usage `json:"nodes"`
+}
+
+// Report slot usage of a department and of every level below it
+func getDepartmentCapacity(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	subtree, err := encoding.Descendants(id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorize(c, auth.RoleViewer, id) {
+		return
+	}
+
+	ids, held, err := loadHeldIDs(c.Request.Context(), subtree)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error querying departments", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query departments: %v", err)})
+		return
+	}
+	if !idSet(ids)[id] {
+		c.JSON(404, gin.H{"error": "Department not found"})
+		return
+	}
+
+	usages, err := slotUsages(ids, held)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error computing slot usage", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to compute slot usage: %v", err)})
+		return
+	}
+	if len(usages) == 0 {
+		// Leaves have no child slots to report
+		level, _ := encoding.Level(id)
+		c.JSON(200, gin.H{"id": id, "level": level, "slots": nil, "levels": []LevelUsage{}})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"id":     id,
+		"level":  usages[0].Level - 1,
+		"slots":  usages[0],
+		"levels": groupByLevel(usages),
+	})
+}
+
+// Report slot usage of the whole tree and list the nodes close to running out
+func getTreeCapacity(c *gin.Context) {
+	threshold := defaultCapacityThreshold
+	if value := c.Query("threshold"); value != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil || threshold < 0 || threshold > 1 {
+			c.JSON(400, gin.H{"error": "threshold must be a number between 0 and 1"})
+			return
+		}
+	}
+	if !authorize(c, auth.RoleViewer, 0) {
+		return
+	}
+
+	usages, err := treeSlotUsages(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error computing slot usage", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to compute slot usage: %v", err)})
+		return
+	}
+
+	nearExhaustion := []idgen.Usage{}
+	for _, u := range usages {
+		if u.Ratio() >= threshold {
+			nearExhaustion = append(nearExhaustion, u)
+		}
+	}
+	sort.SliceStable(nearExhaustion, func(i, j int) bool {
+		return nearExhaustion[i].Ratio() > nearExhaustion[j].Ratio()
+	})
+
+	levels := groupByLevel(usages)
+	for i := range levels {
+		levels[i].Nodes = nil
+	}
+	c.JSON(200, gin.H{
+		"threshold":       threshold,
+		"levels":          levels,
+		"near_exhaustion": nearExhaustion,
+	})
+}
+
+// treeSlotUsages returns the usage of the root slots followed by that of
+// every department that can have children, ordered by level
+func treeSlotUsages(ctx context.Context) ([]idgen.Usage, error) {
+	ids, held, err := loadHeldIDs(ctx, idgen.Range{Min: 1, Max: encoding.Limit() - 1})
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := encoding.SlotUsage(0, held)
+	if err != nil {
+		return nil, err
+	}
+	usages, err := slotUsages(ids, held)
+	if err != nil {
+		return nil, err
+	}
+	return append([]idgen.Usage{roots}, usages...), nil
+}
+
+// slotUsages returns the usage of every department in ids that can have
+// children, counting the slots in held as used, ordered by level and then by ID.
+func slotUsages(ids []int, held map[int]bool) ([]idgen.Usage, error) {
+	var usages []idgen.Usage
+	for _, id := range ids {
+		u, err := encoding.SlotUsage(id, held)
+		if errors.Is(err, idgen.ErrLeaf) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, u)
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		if usages[i].Level != usages[j].Level {
+			return usages[i].Level < usages[j].Level
+		}
+		return usages[i].ID < usages[j].ID
+	})
+	return usages, nil
+}
+
+// groupByLevel sums usages that share a level; usages must be sorted by level
+func groupByLevel(usages []idgen.Usage) []LevelUsage {
+	levels := []LevelUsage{}
+	for _, u := range usages {
+		if len(levels) == 0 || levels[len(levels)-1].Level != u.Level {
+			levels = append(levels, LevelUsage{Level: u.Level})
+		}
+		l := &levels[len(levels)-1]
+		l.Parents++
+		l.Capacity += u.Capacity
+		l.Used += u.Used
+		l.Free += u.Free
+		l.Nodes = append(l.Nodes, u)
+	}
+	return levels
+}
+
+// loadHeldIDs returns the IDs of the departments in r, in ascending order,
+// and the IDs in r the allocator would not hand out: those departments and
+// the ones deleted within ids.tombstone_quarantine.
+func loadHeldIDs(ctx context.Context, r idgen.Range) ([]int, map[int]bool, error) {
+	departments, err := repo.DepartmentRange(ctx, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	deleted, err := repo.DeletedDepartmentIDs(ctx, r, time.Now().Add(-time.Duration(cfg.IDs.TombstoneQuarantine)))
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]int, len(departments))
+	for i, d := range departments {
+		ids[i] = d.ID
+	}
+	held := idSet(deleted)
+	for _, id := range ids {
+		held[id] = true
+	}
+	return ids, held, nil
+}
+
+func idSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/store"
+)
+
+// Commands that can be run instead of the API server, e.g. `./main compact --dry-run 1000`
+var commands = map[string]func(args []string) int{
+	"auth":      authCommand,
+	"compact":   compactCommand,
+	"config":    configCommand,
+	"import":    importCommand,
+	"integrity": integrityCommand,
+}
+
+// runCommand runs the named subcommand and returns the process exit code
+func runCommand(args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: main [%s] [flags]\n", strings.Join(names, "|"))
+		return 2
+	}
+	return command(args[1:])
+}
+
+func compactCommand(args []string) int {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the mapping without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: main compact [--dry-run] <department id>")
+		fmt.Fprintln(flags.Output(), "Packs the child slots under a department; 0 compacts the whole tree.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid department id %q\n", flags.Arg(0))
+		return 2
+	}
+
+	initConfig()
+	initDB()
+	defer repo.Close()
+
+	mappings, err := compactSubtree(store.WithActor(context.Background(), cliActor), id, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compact failed: %v\n", err)
+		return 1
+	}
+	return printJSON(map[string]interface{}{"dry_run": *dryRun, "mapping": mappings})
+}
+
+func integrityCommand(args []string) int {
+	flags := flag.NewFlagSet("integrity", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "renumber the departments that can be repaired")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: main integrity [--fix]")
+		fmt.Fprintln(flags.Output(), "Reports departments whose ID disagrees with parent_id; exits 1 if issues remain.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	initConfig()
+	initDB()
+	defer repo.Close()
+
+	report, err := checkIntegrity(store.WithActor(context.Background(), cliActor), *fix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integrity check failed: %v\n", err)
+		return 1
+	}
+	if code := printJSON(report); code != 0 {
+		return code
+	}
+	if len(report.Issues) > 0 && (!report.Fixed || len(report.Unfixable) > 0) {
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "json or csv (default from the file extension, json for stdin)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: main import [--format json|csv] <file | ->")
+		fmt.Fprintln(flags.Output(), "Imports rows of (external_key, parent_external_key, name) and assigns encoded IDs.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	input := os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open %s: %v\n", path, err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+		if *format == "" && strings.HasSuffix(strings.ToLower(path), ".csv") {
+			*format = "csv"
+		}
+	}
+	if *format == "" {
+		*format = "json"
+	}
+	rows, err := parseImportRows(*format, input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+
+	initConfig()
+	initDB()
+	defer repo.Close()
+
+	imported, err := importDepartmentRows(store.WithActor(context.Background(), cliActor), rows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+	return printJSON(map[string]interface{}{"mapping": imported})
+}
+
+func configCommand(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	format := flags.String("format", "yaml", "yaml or toml")
+	file := flags.String("file", os.Getenv("CONFIG_FILE"), "configuration file (default $CONFIG_FILE)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: main config print [--format yaml|toml] [--file path]")
+		fmt.Fprintln(flags.Output(), "Prints the effective configuration after the file and environment are applied; the password is masked.")
+		fmt.Fprintf(flags.Output(), "Environment variables: CONFIG_FILE, %s\n", strings.Join(config.EnvVars(), ", "))
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "print" {
+		flags.Usage()
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	loaded, err := config.LoadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := loaded.Redacted().Marshal(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+func authCommand(args []string) int {
+	flags := flag.NewFlagSet("auth", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the caller the key is for")
+	scopes := flags.String("scopes", auth.ScopeRead, "comma separated scopes: "+strings.Join(auth.Scopes, ", "))
+	grantList := flags.String("grants", "viewer:0", "comma separated role:department grants, e.g. editor:900; department 0 is the whole tree")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: main auth new-key --name <caller> [--scopes read,write] [--grants editor:900]")
+		fmt.Fprintln(flags.Output(), "Generates an API key and prints it with the auth.api_keys entry to configure.")
+		fmt.Fprintln(flags.Output(), "Only the hash is stored; the key cannot be shown again.")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "new-key" {
+		flags.Usage()
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || *name == "" {
+		flags.Usage()
+		return 2
+	}
+	var granted []string
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if !auth.ValidScope(scope) {
+			fmt.Fprintf(os.Stderr, "unknown scope %q\n", scope)
+			return 2
+		}
+		granted = append(granted, scope)
+	}
+	grants, err := auth.ParseGrants(strings.Split(*grantList, ","))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var grantNames []string
+	for _, g := range grants {
+		grantNames = append(grantNames, g.String())
+	}
+
+	key, err := auth.NewKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generating key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("API key for %s (shown only once): %s\n\n", *name, key)
+	fmt.Printf("auth:\n  api_keys:\n    - name: %s\n      hash: %s\n      scopes: [%s]\n      grants: [%s]\n",
+		*name, auth.HashKey(key), strings.Join(granted, ", "), strings.Join(grantNames, ", "))
+	return 0
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
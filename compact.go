@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Pack the child slots of a subtree. The ID 0 compacts the whole tree, roots included.
+// With ?dry_run=true the mapping is computed but nothing is written.
+func compactDepartment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	if !authorize(c, auth.RoleAdmin, id) {
+		return
+	}
+
+	mappings, err := compactSubtree(c.Request.Context(), id, dryRun)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error compacting department", "id", id, "err", err)
+		switch {
+		case errors.Is(err, store.ErrDepartmentNotFound):
+			c.JSON(404, gin.H{"error": "Department not found"})
+		case errors.Is(err, idgen.ErrInvalidID):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, store.ErrLockTimeout):
+			c.JSON(503, gin.H{"error": "Department allocation is busy, try again"})
+		default:
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to compact department: %v", err)})
+		}
+		return
+	}
+
+	message := "Department compacted successfully"
+	if dryRun {
+		message = "Dry run, nothing was changed"
+	}
+	c.JSON(200, gin.H{
+		"message": message,
+		"dry_run": dryRun,
+		"mapping": mappings,
+	})
+}
+
+// compactSubtree renumbers the descendants of id so that every node's
+// children occupy its first slots, and returns the IDs that change.
+// The department itself keeps its ID; 0 compacts the whole tree.
+// Departments deleted within the quarantine and their ancestors keep theirs.
+func compactSubtree(ctx context.Context, id int, dryRun bool) ([]idgen.Mapping, error) {
+	subtree := idgen.Range{Min: 1, Max: encoding.Limit() - 1}
+	if id != 0 {
+		var err error
+		if subtree, err = encoding.Descendants(id); err != nil {
+			return nil, err
+		}
+	}
+
+	changed := []idgen.Mapping{}
+	err := repo.Allocate(ctx, id, func(tx store.Tx) error {
+		if err := purgeTombstones(ctx, tx, subtree); err != nil {
+			return err
+		}
+		ids, err := lockDepartmentRange(tx, subtree)
+		if err != nil {
+			return err
+		}
+		if id != 0 && (len(ids) == 0 || ids[0] != id) {
+			return store.ErrDepartmentNotFound
+		}
+		// A deleted department still holds its slots
+		if id != 0 {
+			if err := tx.LockDepartment(id); err != nil {
+				return err
+			}
+		}
+
+		// Deleted departments keep their IDs through the quarantine, so they
+		// and their ancestors stay where they are and the rest packs around them
+		deleted, err := tx.DeletedIDs(subtree)
+		if err != nil {
+			return err
+		}
+		mappings, err := encoding.CompactAround(ids, id, deleted)
+		if err != nil {
+			return err
+		}
+		for _, m := range mappings {
+			if m.OldID != m.NewID {
+				changed = append(changed, m)
+			}
+		}
+		if dryRun || len(changed) == 0 {
+			return nil
+		}
+		if err := tx.Renumber(changed); err != nil {
+			return err
+		}
+		return tx.RecordEvent(store.AuditEvent{
+			Action: store.AuditDepartmentCompact, DepartmentID: id, After: store.Snapshot(map[string]interface{}{"mapping": changed}),
+		})
+	})
+	return changed, err
+}
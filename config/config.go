@@ -0,0 +1,618 @@
+// Package config loads the settings of the API server and its commands.
+//
+// Values start from Default, are replaced by the YAML or TOML file named by
+// CONFIG_FILE (if any) and then by environment variables, so the variables
+// the docker-compose setup already passes keep working. Load validates the
+// result as a whole and reports every problem at once.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+)
+
+// Config is the complete configuration
+type Config struct {
+	Server   Server   `yaml:"server" toml:"server"`
+	Database Database `yaml:"database" toml:"database"`
+	IDs      IDs      `yaml:"ids" toml:"ids"`
+	Log      Log      `yaml:"log" toml:"log"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+}
+
+// Server configures the HTTP listener
+type Server struct {
+	// Listen is the address to listen on, e.g. ":8080" or "127.0.0.1:8080"
+	Listen string `yaml:"listen" toml:"listen"`
+	// CORSOrigins are the origins allowed to call the API; "*" allows any
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+	// ShutdownTimeout is how long in-flight requests may run after SIGINT or SIGTERM
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// QueryTimeout is the deadline of a request's database work; 0 disables it
+	QueryTimeout Duration `yaml:"query_timeout" toml:"query_timeout"`
+	// RouteTimeouts replace QueryTimeout for single routes, keyed by method
+	// and route pattern, e.g. "GET /api/departments/tree-recursive"
+	RouteTimeouts map[string]Duration `yaml:"route_timeouts" toml:"route_timeouts"`
+}
+
+// Database configures the connection and its pool
+type Database struct {
+	Driver   string `yaml:"driver" toml:"driver"` // mysql, postgres or sqlite
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"` // 0 picks the driver's default port
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	Name     string `yaml:"name" toml:"name"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode"` // postgres only
+	Path     string `yaml:"path" toml:"path"`       // sqlite only
+
+	// Pool limits; 0 leaves the database/sql default
+	MaxOpenConns    int      `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+
+	// How often and how many times the first connection is attempted
+	RetryInterval Duration `yaml:"retry_interval" toml:"retry_interval"`
+	MaxRetries    int      `yaml:"max_retries" toml:"max_retries"`
+}
+
+// IDs configures the department ID scheme. Changing it on a populated
+// database would misread every allocated ID.
+type IDs struct {
+	Radix int `yaml:"radix" toml:"radix"`
+	// LevelDigits is either one value for every level or one value per level, root first
+	LevelDigits []int `yaml:"level_digits" toml:"level_digits"`
+	// MaxDepth is the number of levels; 0 takes it from LevelDigits, or 4 for a single value
+	MaxDepth int    `yaml:"max_depth" toml:"max_depth"`
+	Layout   string `yaml:"layout" toml:"layout"`
+	// Width, when set, must equal the total number of digits
+	Width int `yaml:"width" toml:"width"`
+	// TombstoneQuarantine is how long the ID of a deleted department stays
+	// reserved before its slot can be allocated again; 0 frees it at the next
+	// allocation. The department can be restored until then.
+	TombstoneQuarantine Duration `yaml:"tombstone_quarantine" toml:"tombstone_quarantine"`
+}
+
+// Log configures the server log
+type Log struct {
+	Level  string `yaml:"level" toml:"level"`   // debug, info, warn or error
+	Format string `yaml:"format" toml:"format"` // json or text
+}
+
+// Auth configures how API callers authenticate
+type Auth struct {
+	// Enabled requires credentials on every /api route and /metrics; /health
+	// stays open
+	Enabled bool     `yaml:"enabled" toml:"enabled"`
+	APIKeys []APIKey `yaml:"api_keys,omitempty" toml:"api_keys,omitempty"`
+	JWT     JWT      `yaml:"jwt" toml:"jwt"`
+}
+
+// APIKey is a static key, sent in the X-API-Key header
+type APIKey struct {
+	Name string `yaml:"name" toml:"name"` // identifies the caller in logs
+	// Hash is "sha256:" followed by the hex SHA-256 of the key;
+	// `main auth new-key` generates a key and prints both
+	Hash   string   `yaml:"hash" toml:"hash"`
+	Scopes []string `yaml:"scopes" toml:"scopes"` // read, write
+	// Grants give roles on subtrees, as "role:department" like "editor:900";
+	// department 0 is the whole tree
+	Grants []string `yaml:"grants" toml:"grants"`
+}
+
+// JWT configures bearer tokens
+type JWT struct {
+	// JWKSFile holds the HS256 and RS256 verification keys; empty disables tokens
+	JWKSFile string `yaml:"jwks_file" toml:"jwks_file"`
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string `yaml:"issuer" toml:"issuer"`
+	Audience string `yaml:"audience" toml:"audience"`
+	// Leeway is the clock skew tolerated on exp and nbf
+	Leeway Duration `yaml:"leeway" toml:"leeway"`
+}
+
+// Duration is a time.Duration written as "10s" or "1m30s".
+// A plain number is read as seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if seconds, err := strconv.Atoi(s); err == nil {
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected e.g. 10s or 1m", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the settings used when nothing is configured
+func Default() Config {
+	return Config{
+		Server: Server{
+			Listen:          ":8080",
+			CORSOrigins:     []string{"*"},
+			ShutdownTimeout: Duration(30 * time.Second),
+			QueryTimeout:    Duration(10 * time.Second),
+			RouteTimeouts: map[string]Duration{
+				"GET /api/bench/tree":            Duration(time.Minute),
+				"POST /api/departments/import":   Duration(time.Minute),
+				"POST /api/admin/integrity/fix":  Duration(time.Minute),
+				"POST /api/departments/:id/move": Duration(30 * time.Second),
+			},
+		},
+		Database: Database{
+			Driver:        "mysql",
+			Host:          "localhost",
+			User:          "root",
+			Password:      "rootpassword",
+			Name:          "mydatabase",
+			SSLMode:       "disable",
+			Path:          "departments.db",
+			RetryInterval: Duration(10 * time.Second),
+			MaxRetries:    30,
+		},
+		IDs: IDs{
+			Radix:               10,
+			LevelDigits:         []int{1},
+			Layout:              "descending",
+			TombstoneQuarantine: Duration(30 * 24 * time.Hour),
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Auth: Auth{
+			JWT: JWT{Leeway: Duration(30 * time.Second)},
+		},
+	}
+}
+
+// Load reads the file named by CONFIG_FILE, applies the environment and
+// validates the result. The returned Config has every default filled in.
+func Load() (Config, error) {
+	return load(os.Getenv("CONFIG_FILE"), os.LookupEnv)
+}
+
+// LoadFile is Load with an explicit file; an empty path reads no file
+func LoadFile(path string) (Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	// A variable that does not parse keeps its previous value, so the rest can still be validated
+	envErr := cfg.applyEnv(lookupEnv)
+	cfg.normalize()
+	if err := cfg.Validate(); envErr != nil || err != nil {
+		return cfg, errors.Join(envErr, err)
+	}
+	return cfg, nil
+}
+
+// readFile decodes a YAML or TOML file over cfg; unknown keys are an error
+func (cfg *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// An empty file decodes to io.EOF and leaves the defaults alone
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			var strict *toml.StrictMissingError
+			if errors.As(err, &strict) {
+				return fmt.Errorf("config: %s: %s", path, strict.String())
+			}
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config: %s: unknown file type, expected .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// envVars maps each environment variable to the setting it overrides
+var envVars = []struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}{
+	{"LISTEN_ADDR", func(cfg *Config, v string) error { cfg.Server.Listen = v; return nil }},
+	{"CORS_ORIGINS", func(cfg *Config, v string) error { cfg.Server.CORSOrigins = splitList(v); return nil }},
+	{"SHUTDOWN_TIMEOUT", func(cfg *Config, v string) error { return cfg.Server.ShutdownTimeout.UnmarshalText([]byte(v)) }},
+	{"QUERY_TIMEOUT", func(cfg *Config, v string) error { return cfg.Server.QueryTimeout.UnmarshalText([]byte(v)) }},
+	{"DB_DRIVER", func(cfg *Config, v string) error { cfg.Database.Driver = v; return nil }},
+	{"DB_HOST", func(cfg *Config, v string) error { cfg.Database.Host = v; return nil }},
+	{"DB_PORT", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.Port) }},
+	{"DB_USER", func(cfg *Config, v string) error { cfg.Database.User = v; return nil }},
+	{"DB_PASSWORD", func(cfg *Config, v string) error { cfg.Database.Password = v; return nil }},
+	{"DB_NAME", func(cfg *Config, v string) error { cfg.Database.Name = v; return nil }},
+	{"DB_SSLMODE", func(cfg *Config, v string) error { cfg.Database.SSLMode = v; return nil }},
+	{"DB_PATH", func(cfg *Config, v string) error { cfg.Database.Path = v; return nil }},
+	{"DB_MAX_OPEN_CONNS", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.MaxOpenConns) }},
+	{"DB_MAX_IDLE_CONNS", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.MaxIdleConns) }},
+	{"DB_CONN_MAX_LIFETIME", func(cfg *Config, v string) error { return cfg.Database.ConnMaxLifetime.UnmarshalText([]byte(v)) }},
+	{"DB_RETRY_INTERVAL", func(cfg *Config, v string) error { return cfg.Database.RetryInterval.UnmarshalText([]byte(v)) }},
+	{"DB_MAX_RETRIES", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.MaxRetries) }},
+	{"ID_RADIX", func(cfg *Config, v string) error { return parseInt(v, &cfg.IDs.Radix) }},
+	{"ID_LEVEL_DIGITS", func(cfg *Config, v string) error {
+		var digits []int
+		for _, part := range splitList(v) {
+			var d int
+			if err := parseInt(part, &d); err != nil {
+				return err
+			}
+			digits = append(digits, d)
+		}
+		cfg.IDs.LevelDigits = digits
+		return nil
+	}},
+	{"ID_MAX_DEPTH", func(cfg *Config, v string) error { return parseInt(v, &cfg.IDs.MaxDepth) }},
+	{"ID_LAYOUT", func(cfg *Config, v string) error { cfg.IDs.Layout = v; return nil }},
+	{"ID_WIDTH", func(cfg *Config, v string) error { return parseInt(v, &cfg.IDs.Width) }},
+	{"ID_TOMBSTONE_QUARANTINE", func(cfg *Config, v string) error { return cfg.IDs.TombstoneQuarantine.UnmarshalText([]byte(v)) }},
+	{"LOG_LEVEL", func(cfg *Config, v string) error { cfg.Log.Level = v; return nil }},
+	{"LOG_FORMAT", func(cfg *Config, v string) error { cfg.Log.Format = v; return nil }},
+	{"AUTH_ENABLED", func(cfg *Config, v string) error { return parseBool(v, &cfg.Auth.Enabled) }},
+	{"AUTH_JWKS_FILE", func(cfg *Config, v string) error { cfg.Auth.JWT.JWKSFile = v; return nil }},
+	{"AUTH_JWT_ISSUER", func(cfg *Config, v string) error { cfg.Auth.JWT.Issuer = v; return nil }},
+	{"AUTH_JWT_AUDIENCE", func(cfg *Config, v string) error { cfg.Auth.JWT.Audience = v; return nil }},
+}
+
+// EnvVars returns the names of the environment variables Load reads, besides CONFIG_FILE
+func EnvVars() []string {
+	names := make([]string, len(envVars))
+	for i, v := range envVars {
+		names[i] = v.name
+	}
+	return names
+}
+
+// applyEnv overrides cfg with the variables that are set and not empty
+func (cfg *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	for _, v := range envVars {
+		value, ok := lookupEnv(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := v.apply(cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config: invalid environment:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// normalize fills in the values derived from others
+func (cfg *Config) normalize() {
+	if cfg.Database.Port == 0 {
+		switch cfg.Database.Driver {
+		case "mysql":
+			cfg.Database.Port = 3306
+		case "postgres":
+			cfg.Database.Port = 5432
+		}
+	}
+	ids := &cfg.IDs
+	if len(ids.LevelDigits) == 1 {
+		if ids.MaxDepth == 0 {
+			ids.MaxDepth = 4
+		}
+		for len(ids.LevelDigits) < ids.MaxDepth {
+			ids.LevelDigits = append(ids.LevelDigits, ids.LevelDigits[0])
+		}
+	} else if ids.MaxDepth == 0 {
+		ids.MaxDepth = len(ids.LevelDigits)
+	}
+}
+
+// Validate reports every invalid setting, one per line
+func (cfg Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.Server.Listen == "" {
+		invalid("server.listen is required")
+	} else if _, port, err := net.SplitHostPort(cfg.Server.Listen); err != nil {
+		invalid("server.listen %q: %v", cfg.Server.Listen, err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		invalid("server.listen %q: invalid port", cfg.Server.Listen)
+	}
+	if len(cfg.Server.CORSOrigins) == 0 {
+		invalid(`server.cors_origins must list at least one origin, or "*"`)
+	}
+	for _, origin := range cfg.Server.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			invalid("server.cors_origins: %q is not an origin like https://example.com", origin)
+		}
+	}
+	if cfg.Server.ShutdownTimeout < 0 {
+		invalid("server.shutdown_timeout must not be negative")
+	}
+	if cfg.Server.QueryTimeout < 0 {
+		invalid("server.query_timeout must not be negative")
+	}
+	for route, timeout := range cfg.Server.RouteTimeouts {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || method == "" || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+			invalid("server.route_timeouts: %q is not a route like \"GET /api/departments\"", route)
+		}
+		if timeout < 0 {
+			invalid("server.route_timeouts: %s must not be negative", route)
+		}
+	}
+
+	db := cfg.Database
+	switch db.Driver {
+	case "mysql", "postgres":
+		if db.Host == "" {
+			invalid("database.host is required for %s", db.Driver)
+		}
+		if db.Name == "" {
+			invalid("database.name is required for %s", db.Driver)
+		}
+		if db.Port < 1 || db.Port > 65535 {
+			invalid("database.port must be between 1 and 65535, got %d", db.Port)
+		}
+		if db.Driver == "postgres" {
+			switch db.SSLMode {
+			case "disable", "require", "verify-ca", "verify-full":
+			default:
+				invalid("database.sslmode must be disable, require, verify-ca or verify-full, got %q", db.SSLMode)
+			}
+		}
+	case "sqlite":
+		if db.Path == "" {
+			invalid("database.path is required for sqlite")
+		}
+	default:
+		invalid("database.driver must be mysql, postgres or sqlite, got %q", db.Driver)
+	}
+	if db.MaxOpenConns < 0 {
+		invalid("database.max_open_conns must not be negative, got %d", db.MaxOpenConns)
+	}
+	if db.MaxIdleConns < 0 {
+		invalid("database.max_idle_conns must not be negative, got %d", db.MaxIdleConns)
+	}
+	if db.MaxOpenConns > 0 && db.MaxIdleConns > db.MaxOpenConns {
+		invalid("database.max_idle_conns (%d) must not exceed max_open_conns (%d)", db.MaxIdleConns, db.MaxOpenConns)
+	}
+	if db.ConnMaxLifetime < 0 {
+		invalid("database.conn_max_lifetime must not be negative")
+	}
+	if db.RetryInterval < 0 {
+		invalid("database.retry_interval must not be negative")
+	}
+	if db.MaxRetries < 1 {
+		invalid("database.max_retries must be at least 1, got %d", db.MaxRetries)
+	}
+
+	if _, err := cfg.IDs.Encoding(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.IDs.TombstoneQuarantine < 0 {
+		invalid("ids.tombstone_quarantine must not be negative")
+	}
+
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		invalid("log.level must be debug, info, warn or error, got %q", cfg.Log.Level)
+	}
+	switch cfg.Log.Format {
+	case "json", "text":
+	default:
+		invalid("log.format must be json or text, got %q", cfg.Log.Format)
+	}
+
+	if cfg.Auth.Enabled && len(cfg.Auth.APIKeys) == 0 && cfg.Auth.JWT.JWKSFile == "" {
+		invalid("auth.enabled needs auth.api_keys or auth.jwt.jwks_file, or no caller could authenticate")
+	}
+	names := map[string]bool{}
+	for i, key := range cfg.Auth.APIKeys {
+		if key.Name == "" {
+			invalid("auth.api_keys[%d].name is required", i)
+		} else if names[key.Name] {
+			invalid("auth.api_keys: duplicate name %q", key.Name)
+		}
+		names[key.Name] = true
+		if _, err := auth.ParseHash(key.Hash); err != nil {
+			invalid("auth.api_keys[%d].hash: %v", i, err)
+		}
+		if len(key.Scopes) == 0 {
+			invalid("auth.api_keys[%d].scopes must not be empty", i)
+		}
+		for _, scope := range key.Scopes {
+			if !auth.ValidScope(scope) {
+				invalid("auth.api_keys[%d].scopes: unknown scope %q, expected one of %s", i, scope, strings.Join(auth.Scopes, ", "))
+			}
+		}
+		if len(key.Grants) == 0 {
+			invalid("auth.api_keys[%d].grants must not be empty, or the key could not see any department", i)
+		}
+		if _, err := auth.ParseGrants(key.Grants); err != nil {
+			invalid("auth.api_keys[%d].grants: %v", i, err)
+		}
+	}
+	if cfg.Auth.JWT.Leeway < 0 {
+		invalid("auth.jwt.leeway must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config: invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Encoding builds the ID scheme
+func (ids IDs) Encoding() (idgen.Encoding, error) {
+	layout, err := idgen.ParseLayout(ids.Layout)
+	if err != nil {
+		return idgen.Encoding{}, fmt.Errorf("ids.layout: %v", err)
+	}
+	if ids.MaxDepth != 0 && len(ids.LevelDigits) != ids.MaxDepth {
+		return idgen.Encoding{}, fmt.Errorf("ids.level_digits has %d levels but ids.max_depth is %d", len(ids.LevelDigits), ids.MaxDepth)
+	}
+	enc, err := idgen.New(ids.Radix, ids.LevelDigits, layout)
+	if err != nil {
+		return idgen.Encoding{}, fmt.Errorf("ids: %v", err)
+	}
+	if ids.Width != 0 && ids.Width != enc.Width() {
+		return idgen.Encoding{}, fmt.Errorf("ids.width is %d but ids.level_digits adds up to %d digits", ids.Width, enc.Width())
+	}
+	// departments.id is a signed 32-bit INT
+	if enc.Limit()-1 > math.MaxInt32 {
+		return idgen.Encoding{}, fmt.Errorf("ids: the scheme allows IDs up to %d, which does not fit departments.id", enc.Limit()-1)
+	}
+	return enc, nil
+}
+
+// RouteTimeout returns the query deadline of the route registered as
+// pattern for method, or 0 for none
+func (s Server) RouteTimeout(method, pattern string) time.Duration {
+	if timeout, ok := s.RouteTimeouts[method+" "+pattern]; ok {
+		return time.Duration(timeout)
+	}
+	return time.Duration(s.QueryTimeout)
+}
+
+// DSN returns the data source name store.Open expects for the driver
+func (db Database) DSN() string {
+	switch db.Driver {
+	case "mysql":
+		c := mysql.NewConfig()
+		c.User = db.User
+		c.Passwd = db.Password
+		c.Net = "tcp"
+		c.Addr = net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+		c.DBName = db.Name
+		c.ParseTime = true
+		return c.FormatDSN()
+	case "postgres":
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(db.User, db.Password),
+			Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+			Path:     "/" + db.Name,
+			RawQuery: "sslmode=" + url.QueryEscape(db.SSLMode),
+		}
+		return u.String()
+	case "sqlite":
+		return db.Path
+	}
+	return ""
+}
+
+// Redacted returns a copy that is safe to print
+func (cfg Config) Redacted() Config {
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = "********"
+	}
+	cfg.Server.CORSOrigins = append([]string(nil), cfg.Server.CORSOrigins...)
+	routeTimeouts := make(map[string]Duration, len(cfg.Server.RouteTimeouts))
+	for route, timeout := range cfg.Server.RouteTimeouts {
+		routeTimeouts[route] = timeout
+	}
+	cfg.Server.RouteTimeouts = routeTimeouts
+	var apiKeys []APIKey
+	for _, key := range cfg.Auth.APIKeys {
+		key.Scopes = append([]string(nil), key.Scopes...)
+		key.Grants = append([]string(nil), key.Grants...)
+		apiKeys = append(apiKeys, key)
+	}
+	cfg.Auth.APIKeys = apiKeys
+	cfg.IDs.LevelDigits = append([]int(nil), cfg.IDs.LevelDigits...)
+	return cfg
+}
+
+// Marshal encodes cfg as "yaml" or "toml"
+func (cfg Config) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "yaml":
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(cfg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), encoder.Close()
+	case "toml":
+		return toml.Marshal(cfg)
+	}
+	return nil, fmt.Errorf("unknown format %q, expected yaml or toml", format)
+}
+
+func parseInt(value string, target *int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	*target = n
+	return nil
+}
+
+func parseBool(value string, target *bool) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", value)
+	}
+	*target = b
+	return nil
+}
+
+// splitList splits a comma separated value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/store"
+)
+
+// Maximum length of employees.employee_number
+const maxEmployeeNumberLength = 10
+
+// Create employee
+func createEmployee(c *gin.Context) {
+	var emp Employee
+	if err := c.ShouldBindJSON(&emp); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateEmployee(&emp); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorize(c, auth.RoleEditor, emp.DepartmentID) {
+		return
+	}
+
+	created, err := repo.CreateEmployee(c.Request.Context(), emp)
+	if err != nil {
+		respondEmployeeError(c, err)
+		return
+	}
+
+	c.JSON(200, created)
+}
+
+// Update employee. large_text is only replaced when a non-empty value is sent.
+func updateEmployee(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid employee ID"})
+		return
+	}
+	var emp Employee
+	if err := c.ShouldBindJSON(&emp); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	emp.ID = id
+	if err := validateEmployee(&emp); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	// Both the current and the new department must be the caller's to edit
+	current, ok := findVisibleEmployee(c, id)
+	if !ok {
+		return
+	}
+	if !authorize(c, auth.RoleEditor, current.DepartmentID) || !authorize(c, auth.RoleEditor, emp.DepartmentID) {
+		return
+	}
+
+	updated, err := repo.UpdateEmployee(c.Request.Context(), emp)
+	if err != nil {
+		respondEmployeeError(c, err)
+		return
+	}
+
+	c.JSON(200, updated)
+}
+
+// Delete employee
+func deleteEmployee(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid employee ID"})
+		return
+	}
+	current, ok := findVisibleEmployee(c, id)
+	if !ok {
+		return
+	}
+	if !authorize(c, auth.RoleEditor, current.DepartmentID) {
+		return
+	}
+	if err := repo.DeleteEmployee(c.Request.Context(), id); err != nil {
+		if errors.Is(err, store.ErrEmployeeNotFound) {
+			c.JSON(404, gin.H{"error": "Employee not found"})
+			return
+		}
+		slog.ErrorContext(c.Request.Context(), "Error deleting employee", "err", err)
+		c.JSON(500, gin.H{"error": "Failed to delete employee"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Employee deleted successfully",
+		"id":      id,
+	})
+}
+
+// findVisibleEmployee loads employee id, answering 404 both when it does not
+// exist and when its department is outside the caller's grants, so a 403 never
+// confirms that an ID the caller cannot see is taken
+func findVisibleEmployee(c *gin.Context, id int) (Employee, bool) {
+	emp, err := repo.GetEmployee(c.Request.Context(), id)
+	if err != nil && !errors.Is(err, store.ErrEmployeeNotFound) {
+		slog.ErrorContext(c.Request.Context(), "Error querying employee", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query employee: %v", err)})
+		return Employee{}, false
+	}
+	if err != nil || !can(c.Request.Context(), auth.RoleViewer, emp.DepartmentID) {
+		c.JSON(404, gin.H{"error": "Employee not found"})
+		return Employee{}, false
+	}
+	return emp, true
+}
+
+// validateEmployee checks the required fields and normalizes hire_date to 2006-01-02.
+// Both plain dates and the RFC 3339 timestamps returned by the GET endpoints are accepted.
+func validateEmployee(emp *Employee) error {
+	emp.Name = strings.TrimSpace(emp.Name)
+	emp.Position = strings.TrimSpace(emp.Position)
+	emp.EmployeeNumber = strings.TrimSpace(emp.EmployeeNumber)
+	switch {
+	case emp.Name == "":
+		return errors.New("name is required")
+	case emp.Position == "":
+		return errors.New("position is required")
+	case emp.EmployeeNumber == "":
+		return errors.New("employee_number is required")
+	case len(emp.EmployeeNumber) > maxEmployeeNumberLength:
+		return fmt.Errorf("employee_number must be at most %d characters", maxEmployeeNumberLength)
+	case emp.DepartmentID == 0:
+		return errors.New("department_id is required")
+	}
+	hireDate, err := time.Parse("2006-01-02", emp.HireDate)
+	if err != nil {
+		if hireDate, err = time.Parse(time.RFC3339, emp.HireDate); err != nil {
+			return fmt.Errorf("hire_date must be a date like 2006-01-02: %q", emp.HireDate)
+		}
+	}
+	emp.HireDate = hireDate.Format("2006-01-02")
+	return nil
+}
+
+// respondEmployeeError maps an error from the employee handlers to a response
+func respondEmployeeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrEmployeeNotFound):
+		c.JSON(404, gin.H{"error": "Employee not found"})
+	case errors.Is(err, store.ErrDepartmentNotFound):
+		c.JSON(400, gin.H{"error": "Department not found"})
+	case errors.Is(err, store.ErrEmployeeNumberTaken):
+		c.JSON(409, gin.H{"error": store.ErrEmployeeNumberTaken.Error()})
+	default:
+		slog.ErrorContext(c.Request.Context(), "Error writing employee", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to write employee: %v", err)})
+	}
+}
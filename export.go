@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+)
+
+// ExportNode is a department with its children, as exported in nested JSON
+type ExportNode struct {
+	ID       int           `json:"id"`
+	Name     string        `json:"name"`
+	ParentID *int          `json:"parent_id"`
+	Children []*ExportNode `json:"children"`
+}
+
+// Export the department tree, or the subtree under ?root=, as
+// ?format=json (nested, default), csv, dot or mermaid.
+func exportDepartments(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	r := idgen.Range{Min: 1, Max: encoding.Limit() - 1}
+	rootID := 0
+	if value := c.Query("root"); value != "" {
+		var err error
+		if rootID, err = strconv.Atoi(value); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid root " + value})
+			return
+		}
+		if r, err = encoding.Descendants(rootID); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if !authorize(c, auth.RoleViewer, rootID) {
+		return
+	}
+
+	forest, err := loadExportForest(c.Request.Context(), r)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error querying departments", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query departments: %v", err)})
+		return
+	}
+	if rootID != 0 {
+		forest = subtreeRoot(forest, rootID)
+		if len(forest) == 0 {
+			c.JSON(404, gin.H{"error": "Department not found"})
+			return
+		}
+	}
+
+	switch format {
+	case "json":
+		c.JSON(200, forest)
+	case "csv":
+		body, err := exportCSV(forest)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Error writing CSV export", "err", err)
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to write CSV: %v", err)})
+			return
+		}
+		c.Data(200, "text/csv; charset=utf-8", body)
+	case "dot":
+		c.Data(200, "text/vnd.graphviz; charset=utf-8", exportDOT(forest))
+	case "mermaid":
+		c.Data(200, "text/plain; charset=utf-8", exportMermaid(forest))
+	default:
+		c.JSON(400, gin.H{"error": "Unknown format " + format + ", expected json, csv, dot or mermaid"})
+	}
+}
+
+// loadExportForest loads the departments in r and links them through
+// parent_id. Departments whose parent is outside r become top-level nodes.
+func loadExportForest(ctx context.Context, r idgen.Range) ([]*ExportNode, error) {
+	departments, err := repo.DepartmentRange(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*ExportNode, len(departments))
+	byID := make(map[int]*ExportNode, len(departments))
+	for i, d := range departments {
+		node := &ExportNode{ID: d.ID, Name: d.Name, Children: []*ExportNode{}}
+		if d.ParentID != 0 {
+			parent := d.ParentID
+			node.ParentID = &parent
+		}
+		nodes[i] = node
+		byID[d.ID] = node
+	}
+
+	forest := []*ExportNode{}
+	for _, node := range nodes {
+		if node.ParentID != nil {
+			if parent, ok := byID[*node.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		forest = append(forest, node)
+	}
+	return forest, nil
+}
+
+// subtreeRoot keeps only the export root; rows of its range that do not
+// hang below it through parent_id are left to the integrity check
+func subtreeRoot(forest []*ExportNode, rootID int) []*ExportNode {
+	for _, node := range forest {
+		if node.ID == rootID {
+			return []*ExportNode{node}
+		}
+	}
+	return nil
+}
+
+// walkExport visits every node depth first with its ID path
+func walkExport(forest []*ExportNode, visit func(node *ExportNode, path []int)) {
+	var walk func(node *ExportNode, path []int)
+	walk = func(node *ExportNode, path []int) {
+		path = append(path, node.ID)
+		visit(node, path)
+		for _, child := range node.Children {
+			walk(child, path)
+		}
+	}
+	for _, node := range forest {
+		walk(node, nil)
+	}
+}
+
+// exportCSV writes one row per department. level is decoded from the ID, as
+// in tree-comparison, so it does not depend on the export root; path is
+// relative to the export's top nodes.
+func exportCSV(forest []*ExportNode) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "parent_id", "name", "level", "path"})
+	walkExport(forest, func(node *ExportNode, path []int) {
+		parentID := ""
+		if node.ParentID != nil {
+			parentID = strconv.Itoa(*node.ParentID)
+		}
+		level := ""
+		if l, err := encoding.Level(node.ID); err == nil {
+			level = strconv.Itoa(l)
+		}
+		ids := make([]string, len(path))
+		for i, id := range path {
+			ids[i] = strconv.Itoa(id)
+		}
+		w.Write([]string{strconv.Itoa(node.ID), parentID, node.Name, level, strings.Join(ids, "/")})
+	})
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// exportDOT writes a Graphviz digraph
+func exportDOT(forest []*ExportNode) []byte {
+	var buf bytes.Buffer
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	buf.WriteString("digraph departments {\n\tnode [shape=box];\n")
+	walkExport(forest, func(node *ExportNode, path []int) {
+		fmt.Fprintf(&buf, "\t%d [label=\"%s\\n%d\"];\n", node.ID, escape.Replace(node.Name), node.ID)
+		if len(path) > 1 {
+			fmt.Fprintf(&buf, "\t%d -> %d;\n", path[len(path)-2], node.ID)
+		}
+	})
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// exportMermaid writes a Mermaid flowchart
+func exportMermaid(forest []*ExportNode) []byte {
+	var buf bytes.Buffer
+	escape := strings.NewReplacer(`"`, "#quot;")
+	buf.WriteString("flowchart TD\n")
+	walkExport(forest, func(node *ExportNode, path []int) {
+		fmt.Fprintf(&buf, "    d%d[\"%s<br/>%d\"]\n", node.ID, escape.Replace(node.Name), node.ID)
+		if len(path) > 1 {
+			fmt.Fprintf(&buf, "    d%d --> d%d\n", path[len(path)-2], node.ID)
+		}
+	})
+	return buf.Bytes()
+}
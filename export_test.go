@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func exportTestForest() []*ExportNode {
+	root, mid := 1000, 900
+	leaf := &ExportNode{ID: 890, Name: `R&D "Lab"`, ParentID: &mid, Children: []*ExportNode{}}
+	child := &ExportNode{ID: 900, Name: "Sales", ParentID: &root, Children: []*ExportNode{leaf}}
+	return []*ExportNode{{ID: 1000, Name: "Head Office", Children: []*ExportNode{child}}}
+}
+
+func TestExportFormats(t *testing.T) {
+	forest := exportTestForest()
+
+	csvBody, err := exportCSV(forest)
+	if err != nil {
+		t.Fatalf("exportCSV: %v", err)
+	}
+	wantCSV := "id,parent_id,name,level,path\n" +
+		"1000,,Head Office,0,1000\n" +
+		"900,1000,Sales,1,1000/900\n" +
+		"890,900,\"R&D \"\"Lab\"\"\",2,1000/900/890\n"
+	if string(csvBody) != wantCSV {
+		t.Errorf("CSV =\n%s\nwant\n%s", csvBody, wantCSV)
+	}
+	// The level of a subtree export is the one the ID encodes
+	csvBody, _ = exportCSV(forest[0].Children)
+	wantCSV = "id,parent_id,name,level,path\n" +
+		"900,1000,Sales,1,900\n" +
+		"890,900,\"R&D \"\"Lab\"\"\",2,900/890\n"
+	if string(csvBody) != wantCSV {
+		t.Errorf("CSV of 900 =\n%s\nwant\n%s", csvBody, wantCSV)
+	}
+
+	dot := string(exportDOT(forest))
+	for _, want := range []string{"digraph departments {", "1000 -> 900;", "900 -> 890;", `label="R&D \"Lab\"\n890"`} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT is missing %q:\n%s", want, dot)
+		}
+	}
+
+	mermaid := string(exportMermaid(forest))
+	for _, want := range []string{"flowchart TD", "d1000 --> d900", "d900 --> d890", "R&D #quot;Lab#quot;"} {
+		if !strings.Contains(mermaid, want) {
+			t.Errorf("Mermaid is missing %q:\n%s", want, mermaid)
+		}
+	}
+}
+
+func TestSubtreeRoot(t *testing.T) {
+	stray := &ExportNode{ID: 880, Name: "Stray", Children: []*ExportNode{}}
+	forest := append([]*ExportNode{stray}, exportTestForest()[0].Children...)
+	if got := subtreeRoot(forest, 900); len(got) != 1 || got[0].ID != 900 {
+		t.Errorf("subtreeRoot(900) = %v, want the 900 node", got)
+	}
+	if got := subtreeRoot(forest, 800); got != nil {
+		t.Errorf("subtreeRoot(800) = %v, want nil", got)
+	}
+}
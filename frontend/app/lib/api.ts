@@ -1,4 +1,4 @@
-import { Department, Employee } from '../types';
+import { Department, Employee, EmployeePage } from '../types';
 
 const API_BASE_URL = 'http://localhost:8080/api';
 
@@ -73,7 +73,7 @@ export async function deleteDepartment(id: number): Promise<void> {
 }
 
 // Employee related APIs
-export async function getEmployees(page: number = 1, pageSize: number = 100): Promise<Employee[]> {
+export async function getEmployees(page: number = 1, pageSize: number = 100): Promise<EmployeePage> {
   const response = await fetch(`${API_BASE_URL}/employees?page=${page}&pageSize=${pageSize}`);
   if (!response.ok) {
     throw new Error('Failed to fetch employees');
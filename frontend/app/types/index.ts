@@ -11,4 +11,12 @@ export interface Employee {
   position: string;
   hire_date: string;
   employee_number: string;
-} 
\ No newline at end of file
+} 
+
+export interface EmployeePage {
+  employees: Employee[];
+  total: number;
+  page: number;
+  page_size: number;
+  next_cursor: number | null;
+}
@@ -0,0 +1,512 @@
+// Package idgen implements the hierarchical department ID scheme.
+//
+// Every level of the tree owns a fixed group of digits of the ID, so the
+// position of a department can be derived from the number alone. With the
+// default encoding (4 levels of one decimal digit) the seed data looks like
+// this:
+//
+//	1000               level 0, subtree 0001 ~ 1000
+//	 900               level 1, subtree 0801 ~ 0900
+//	  890              level 2, subtree 0881 ~ 0890
+//	   889             level 3 (leaf)
+//
+// The package has no dependency on the HTTP server or the database, so it
+// can be imported by any service that needs to reason about these IDs.
+package idgen
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidID is returned when an ID cannot be decoded by the encoding.
+var ErrInvalidID = errors.New("idgen: invalid id")
+
+// ErrNoFreeSlot is returned when every child slot of a parent is taken.
+var ErrNoFreeSlot = errors.New("idgen: no free slot")
+
+// ErrLeaf is returned when children are requested for a node on the last level.
+var ErrLeaf = errors.New("idgen: leaf level has no child slots")
+
+// ErrDoesNotFit is returned when a subtree cannot be placed at a new position.
+var ErrDoesNotFit = errors.New("idgen: subtree does not fit")
+
+// Layout decides where children are placed relative to their parent.
+type Layout int
+
+const (
+	// Descending places children below the parent: 1000 -> 900, 800, ...
+	// A node owns the range (id - step, id].
+	Descending Layout = iota
+	// Ascending places children above the parent: 1000 -> 1100, 1200, ...
+	// A node owns the range [id, id + step).
+	Ascending
+)
+
+// ParseLayout parses the name returned by Layout.String.
+func ParseLayout(s string) (Layout, error) {
+	switch strings.ToLower(s) {
+	case "descending":
+		return Descending, nil
+	case "ascending":
+		return Ascending, nil
+	}
+	return 0, fmt.Errorf("idgen: unknown layout %q", s)
+}
+
+func (l Layout) String() string {
+	switch l {
+	case Descending:
+		return "descending"
+	case Ascending:
+		return "ascending"
+	}
+	return fmt.Sprintf("Layout(%d)", int(l))
+}
+
+// Range is an inclusive range of IDs.
+type Range struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Contains reports whether id falls within the range.
+func (r Range) Contains(id int) bool {
+	return id >= r.Min && id <= r.Max
+}
+
+// Mapping records the old and new ID of a renumbered node.
+type Mapping struct {
+	OldID int `json:"old_id"`
+	NewID int `json:"new_id"`
+}
+
+// Usage describes how many child slots of a node are taken.
+type Usage struct {
+	ID       int `json:"id"`       // parent, 0 for the root slots
+	Level    int `json:"level"`    // level of the child slots
+	Capacity int `json:"capacity"` // number of child slots
+	Used     int `json:"used"`
+	Free     int `json:"free"`
+	Next     int `json:"next"` // slot the next allocation gets, 0 when full
+}
+
+// Ratio returns the fraction of slots in use.
+func (u Usage) Ratio() float64 {
+	if u.Capacity == 0 {
+		return 1
+	}
+	return float64(u.Used) / float64(u.Capacity)
+}
+
+// Encoding describes how a tree position maps to an ID.
+//
+// Digits holds the number of digits owned by each level, root first, so
+// len(Digits) is the maximum depth of the tree and their sum is the width
+// of an ID. Build encodings with New so the parameters are validated.
+type Encoding struct {
+	Radix  int    // base the digits are written in
+	Digits []int  // digits per level, root first
+	Layout Layout // direction children are numbered in
+}
+
+// Default is the encoding used by the seed data: 4 levels of one decimal digit.
+var Default = Encoding{Radix: 10, Digits: []int{1, 1, 1, 1}, Layout: Descending}
+
+// New returns a validated encoding.
+func New(radix int, digits []int, layout Layout) (Encoding, error) {
+	if radix < 2 {
+		return Encoding{}, fmt.Errorf("idgen: radix must be at least 2, got %d", radix)
+	}
+	if len(digits) == 0 {
+		return Encoding{}, errors.New("idgen: at least one level is required")
+	}
+	if layout != Descending && layout != Ascending {
+		return Encoding{}, fmt.Errorf("idgen: unknown layout %v", layout)
+	}
+	limit := 1
+	for level, d := range digits {
+		if d < 1 {
+			return Encoding{}, fmt.Errorf("idgen: level %d must own at least one digit, got %d", level, d)
+		}
+		for i := 0; i < d; i++ {
+			if limit > math.MaxInt/radix {
+				return Encoding{}, fmt.Errorf("idgen: %d digits of base %d overflow int", sumDigits(digits), radix)
+			}
+			limit *= radix
+		}
+	}
+	return Encoding{Radix: radix, Digits: append([]int(nil), digits...), Layout: layout}, nil
+}
+
+func sumDigits(digits []int) int {
+	width := 0
+	for _, d := range digits {
+		width += d
+	}
+	return width
+}
+
+// Depth returns the number of levels, root included.
+func (e Encoding) Depth() int {
+	return len(e.Digits)
+}
+
+// Width returns the number of digits of an ID.
+func (e Encoding) Width() int {
+	return sumDigits(e.Digits)
+}
+
+// Slots returns the number of nodes a single parent can hold on the given level.
+// Level 0 counts the roots.
+func (e Encoding) Slots(level int) int {
+	return e.span(level) - 1
+}
+
+// Limit returns the exclusive upper bound of every ID in the encoding.
+func (e Encoding) Limit() int {
+	return e.Step(0) * e.span(0)
+}
+
+// Step returns the distance between two siblings on the given level.
+func (e Encoding) Step(level int) int {
+	step := 1
+	for i := level + 1; i < e.Depth(); i++ {
+		step *= e.span(i)
+	}
+	return step
+}
+
+// span returns the number of distinct values of the digits owned by level.
+func (e Encoding) span(level int) int {
+	n := 1
+	for i := 0; i < e.Digits[level]; i++ {
+		n *= e.Radix
+	}
+	return n
+}
+
+// Level returns the depth of id, 0 being a root.
+func (e Encoding) Level(id int) (int, error) {
+	if id <= 0 || id >= e.Limit() {
+		return 0, fmt.Errorf("%w: %d out of range (0, %d)", ErrInvalidID, id, e.Limit())
+	}
+	for level := 0; level < e.Depth(); level++ {
+		if id%e.Step(level) == 0 {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %d", ErrInvalidID, id)
+}
+
+// Parent returns the parent of id, or 0 when id is a root.
+func (e Encoding) Parent(id int) (int, error) {
+	level, err := e.Level(id)
+	if err != nil {
+		return 0, err
+	}
+	if level == 0 {
+		return 0, nil
+	}
+	step := e.Step(level - 1)
+	if e.Layout == Ascending {
+		return id / step * step, nil
+	}
+	return (id + step - 1) / step * step, nil
+}
+
+// Ancestors returns the ancestors of id from the root down, excluding id itself.
+func (e Encoding) Ancestors(id int) ([]int, error) {
+	level, err := e.Level(id)
+	if err != nil {
+		return nil, err
+	}
+	ancestors := make([]int, level)
+	for i := level - 1; i >= 0; i-- {
+		if id, err = e.Parent(id); err != nil {
+			return nil, err
+		}
+		ancestors[i] = id
+	}
+	return ancestors, nil
+}
+
+// Children returns every child slot of id in allocation order.
+// Passing 0 returns the root slots.
+func (e Encoding) Children(id int) ([]int, error) {
+	if id == 0 {
+		step := e.Step(0)
+		roots := make([]int, e.Slots(0))
+		for i := range roots {
+			roots[i] = (i + 1) * step
+		}
+		return roots, nil
+	}
+	level, err := e.Level(id)
+	if err != nil {
+		return nil, err
+	}
+	if level == e.Depth()-1 {
+		return nil, fmt.Errorf("%w: %d", ErrLeaf, id)
+	}
+	step := e.Step(level + 1)
+	if e.Layout == Descending {
+		step = -step
+	}
+	children := make([]int, e.Slots(level+1))
+	for i := range children {
+		children[i] = id + (i+1)*step
+	}
+	return children, nil
+}
+
+// SlotIndex returns the 1-based position of id among the child slots of its parent.
+func (e Encoding) SlotIndex(id int) (int, error) {
+	level, err := e.Level(id)
+	if err != nil {
+		return 0, err
+	}
+	parent, err := e.Parent(id)
+	if err != nil {
+		return 0, err
+	}
+	offset := id - parent
+	if offset < 0 {
+		offset = -offset
+	}
+	return offset / e.Step(level), nil
+}
+
+// ChildAt returns the child slot of parent at the 1-based index.
+// Passing 0 as parent returns a root slot.
+func (e Encoding) ChildAt(parent, index int) (int, error) {
+	children, err := e.Children(parent)
+	if err != nil {
+		return 0, err
+	}
+	if index < 1 || index > len(children) {
+		return 0, fmt.Errorf("%w: slot %d under %d", ErrInvalidID, index, parent)
+	}
+	return children[index-1], nil
+}
+
+// Rebase maps every id of the subtree rooted at from onto the subtree rooted
+// at to, keeping the slot index of each node relative to its parent.
+// The mappings are returned in the order of ids.
+func (e Encoding) Rebase(ids []int, from, to int) ([]Mapping, error) {
+	mappings := make([]Mapping, len(ids))
+	for i, id := range ids {
+		if !e.IsDescendant(from, id) {
+			return nil, fmt.Errorf("%w: %d is not under %d", ErrInvalidID, id, from)
+		}
+		ancestors, err := e.Ancestors(id)
+		if err != nil {
+			return nil, err
+		}
+		path := append(ancestors, id)
+		for len(path) > 0 && path[0] != from {
+			path = path[1:]
+		}
+
+		newID := to
+		for _, node := range path[1:] {
+			index, err := e.SlotIndex(node)
+			if err != nil {
+				return nil, err
+			}
+			if newID, err = e.ChildAt(newID, index); err != nil {
+				return nil, fmt.Errorf("%w: %d under %d: %v", ErrDoesNotFit, id, to, err)
+			}
+		}
+		mappings[i] = Mapping{OldID: id, NewID: newID}
+	}
+	return mappings, nil
+}
+
+// Compact packs the children of every node in the subtree rooted at root
+// into the lowest slots, keeping their relative order, and returns a
+// mapping for each of ids. Passing 0 as root packs the roots as well.
+// Every id must be root or have its parent in ids.
+func (e Encoding) Compact(ids []int, root int) ([]Mapping, error) {
+	return e.CompactAround(ids, root, nil)
+}
+
+// CompactAround is Compact keeping every id of pinned, and every ancestor of
+// one, at its current ID. The other children of a node are packed into the
+// lowest slots the pinned ones leave free. Every pinned id must be in ids.
+func (e Encoding) CompactAround(ids []int, root int, pinned []int) ([]Mapping, error) {
+	present := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+	kept := make(map[int]bool, len(pinned))
+	for _, id := range pinned {
+		if !present[id] || id == root {
+			return nil, fmt.Errorf("%w: pinned %d is not below %d", ErrInvalidID, id, root)
+		}
+		for id != root && !kept[id] {
+			kept[id] = true
+			var err error
+			if id, err = e.Parent(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	children := make(map[int][]int)
+	for _, id := range ids {
+		if id == root {
+			continue
+		}
+		if root != 0 && !e.IsDescendant(root, id) {
+			return nil, fmt.Errorf("%w: %d is not under %d", ErrInvalidID, id, root)
+		}
+		parent, err := e.Parent(id)
+		if err != nil {
+			return nil, err
+		}
+		if parent != root && !present[parent] {
+			return nil, fmt.Errorf("%w: parent %d of %d is missing", ErrInvalidID, parent, id)
+		}
+		children[parent] = append(children[parent], id)
+	}
+
+	newIDs := map[int]int{root: root}
+	queue := []int{root}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		kids := children[parent]
+		indexes := make(map[int]int, len(kids))
+		for _, id := range kids {
+			index, err := e.SlotIndex(id)
+			if err != nil {
+				return nil, err
+			}
+			indexes[id] = index
+		}
+		sort.Slice(kids, func(i, j int) bool { return indexes[kids[i]] < indexes[kids[j]] })
+		taken := make(map[int]bool)
+		for _, id := range kids {
+			if kept[id] {
+				taken[indexes[id]] = true
+			}
+		}
+		slot := 1
+		for _, id := range kids {
+			queue = append(queue, id)
+			if kept[id] {
+				newIDs[id] = id
+				continue
+			}
+			for taken[slot] {
+				slot++
+			}
+			newID, err := e.ChildAt(newIDs[parent], slot)
+			if err != nil {
+				return nil, err
+			}
+			newIDs[id] = newID
+			slot++
+		}
+	}
+
+	mappings := make([]Mapping, len(ids))
+	for i, id := range ids {
+		mappings[i] = Mapping{OldID: id, NewID: newIDs[id]}
+	}
+	return mappings, nil
+}
+
+// NextChild returns the first child slot of parent that is not in used.
+// Passing 0 as parent allocates a root.
+func (e Encoding) NextChild(parent int, used []int) (int, error) {
+	children, err := e.Children(parent)
+	if err != nil {
+		return 0, err
+	}
+	taken := make(map[int]bool, len(used))
+	for _, id := range used {
+		taken[id] = true
+	}
+	for _, id := range children {
+		if !taken[id] {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("%w under %d", ErrNoFreeSlot, parent)
+}
+
+// SlotUsage counts the child slots of parent that are in present.
+// Passing 0 as parent reports the root slots, with Next following NextRoot.
+func (e Encoding) SlotUsage(parent int, present map[int]bool) (Usage, error) {
+	children, err := e.Children(parent)
+	if err != nil {
+		return Usage{}, err
+	}
+	level := 0
+	if parent != 0 {
+		if level, err = e.Level(parent); err != nil {
+			return Usage{}, err
+		}
+		level++
+	}
+	u := Usage{ID: parent, Level: level, Capacity: len(children)}
+	for _, id := range children {
+		if present[id] {
+			u.Used++
+		} else if u.Next == 0 {
+			u.Next = id
+		}
+	}
+	u.Free = u.Capacity - u.Used
+	if parent == 0 {
+		// Roots are allocated after the highest ID rather than in the first gap
+		maxID := 0
+		for id := range present {
+			if id > maxID {
+				maxID = id
+			}
+		}
+		if u.Next, err = e.NextRoot(maxID); err != nil {
+			u.Next = 0
+		}
+	}
+	return u, nil
+}
+
+// NextRoot returns the root slot following the root that owns maxID.
+// Passing 0 returns the first root.
+func (e Encoding) NextRoot(maxID int) (int, error) {
+	step := e.Step(0)
+	next := maxID/step*step + step
+	if next >= e.Limit() {
+		return 0, fmt.Errorf("%w for roots", ErrNoFreeSlot)
+	}
+	return next, nil
+}
+
+// Descendants returns the range of IDs owned by id, id itself included.
+func (e Encoding) Descendants(id int) (Range, error) {
+	level, err := e.Level(id)
+	if err != nil {
+		return Range{}, err
+	}
+	step := e.Step(level)
+	if e.Layout == Ascending {
+		return Range{Min: id, Max: id + step - 1}, nil
+	}
+	return Range{Min: id - step + 1, Max: id}, nil
+}
+
+// IsDescendant reports whether id lies in the subtree of ancestor.
+// A node counts as its own descendant.
+func (e Encoding) IsDescendant(ancestor, id int) bool {
+	r, err := e.Descendants(ancestor)
+	if err != nil {
+		return false
+	}
+	return r.Contains(id)
+}
@@ -0,0 +1,425 @@
+package idgen
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var (
+	ascending = Encoding{Radix: 10, Digits: []int{1, 1, 1, 1}, Layout: Ascending}
+	// Roots 100 ~ 900 with up to 99 children each, numbered down from the root
+	wideLeaves = mustNew(10, []int{1, 2}, Descending)
+	// Roots 10 ~ 990 with up to 9 children each, numbered up from the root
+	wideRoots = mustNew(10, []int{2, 1}, Ascending)
+	hex       = mustNew(16, []int{1, 1}, Descending)
+)
+
+func mustNew(radix int, digits []int, layout Layout) Encoding {
+	e, err := New(radix, digits, layout)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func TestNew(t *testing.T) {
+	e, err := New(10, []int{1, 1, 1, 1}, Descending)
+	if err != nil || !reflect.DeepEqual(e, Default) {
+		t.Errorf("New = %+v, %v; want Default", e, err)
+	}
+	if wideLeaves.Width() != 3 || wideLeaves.Depth() != 2 || wideLeaves.Limit() != 1000 || wideLeaves.Slots(1) != 99 || wideLeaves.Step(0) != 100 {
+		t.Errorf("wideLeaves = width %d, depth %d, limit %d, slots %d, step %d",
+			wideLeaves.Width(), wideLeaves.Depth(), wideLeaves.Limit(), wideLeaves.Slots(1), wideLeaves.Step(0))
+	}
+	if hex.Limit() != 256 || hex.Slots(0) != 15 {
+		t.Errorf("hex = limit %d, slots %d", hex.Limit(), hex.Slots(0))
+	}
+
+	invalid := []struct {
+		name   string
+		radix  int
+		digits []int
+		layout Layout
+	}{
+		{"radix 1", 1, []int{1}, Descending},
+		{"no levels", 10, nil, Descending},
+		{"empty level", 10, []int{1, 0}, Descending},
+		{"unknown layout", 10, []int{1}, Layout(5)},
+		{"overflow", 10, []int{30}, Descending},
+	}
+	for _, tt := range invalid {
+		if e, err := New(tt.radix, tt.digits, tt.layout); err == nil {
+			t.Errorf("%s: New = %+v", tt.name, e)
+		}
+	}
+
+	// The digits are copied
+	digits := []int{1, 1}
+	e, _ = New(10, digits, Ascending)
+	digits[0] = 3
+	if e.Digits[0] != 1 {
+		t.Error("New kept a reference to digits")
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, l := range []Layout{Descending, Ascending} {
+		if parsed, err := ParseLayout(l.String()); err != nil || parsed != l {
+			t.Errorf("ParseLayout(%q) = %v, %v", l, parsed, err)
+		}
+	}
+	if l, err := ParseLayout("Ascending"); err != nil || l != Ascending {
+		t.Errorf("ParseLayout is case sensitive: %v, %v", l, err)
+	}
+	if _, err := ParseLayout("sideways"); err == nil {
+		t.Error("ParseLayout accepted sideways")
+	}
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		enc   Encoding
+		id    int
+		level int
+		err   error
+	}{
+		{"root", Default, 1000, 0, nil},
+		{"level 1", Default, 900, 1, nil},
+		{"level 2", Default, 890, 2, nil},
+		{"leaf", Default, 889, 3, nil},
+		{"highest", Default, 9999, 3, nil},
+		{"lowest", Default, 1, 3, nil},
+		{"zero", Default, 0, 0, ErrInvalidID},
+		{"negative", Default, -900, 0, ErrInvalidID},
+		{"limit", Default, 10000, 0, ErrInvalidID},
+		{"ascending level 1", ascending, 1100, 1, nil},
+		{"ascending leaf", ascending, 1111, 3, nil},
+		{"wide leaves root", wideLeaves, 100, 0, nil},
+		{"wide leaves child", wideLeaves, 57, 1, nil},
+		{"wide leaves limit", wideLeaves, 1000, 0, ErrInvalidID},
+		{"wide roots root", wideRoots, 990, 0, nil},
+		{"wide roots child", wideRoots, 25, 1, nil},
+		{"hex child", hex, 0x1f, 1, nil},
+	}
+	for _, tt := range tests {
+		level, err := tt.enc.Level(tt.id)
+		if !errors.Is(err, tt.err) || (tt.err == nil && level != tt.level) {
+			t.Errorf("%s: Level(%d) = %d, %v; want %d, %v", tt.name, tt.id, level, err, tt.level, tt.err)
+		}
+	}
+}
+
+func TestParentAndAncestors(t *testing.T) {
+	tests := []struct {
+		name      string
+		enc       Encoding
+		id        int
+		ancestors []int // root first; the last one is the parent
+	}{
+		{"root", Default, 1000, []int{}},
+		{"leaf", Default, 889, []int{1000, 900, 890}},
+		{"lowest leaf", Default, 1, []int{1000, 100, 10}},
+		{"second root", Default, 1900, []int{2000}},
+		{"ascending leaf", ascending, 1111, []int{1000, 1100, 1110}},
+		{"ascending last child", ascending, 1900, []int{1000}},
+		{"wide leaves", wideLeaves, 57, []int{100}},
+		{"wide roots", wideRoots, 25, []int{20}},
+		{"hex", hex, 0x2f, []int{0x30}},
+	}
+	for _, tt := range tests {
+		parent, err := tt.enc.Parent(tt.id)
+		wantParent := 0
+		if len(tt.ancestors) > 0 {
+			wantParent = tt.ancestors[len(tt.ancestors)-1]
+		}
+		if err != nil || parent != wantParent {
+			t.Errorf("%s: Parent(%d) = %d, %v; want %d", tt.name, tt.id, parent, err, wantParent)
+		}
+		if ancestors, err := tt.enc.Ancestors(tt.id); err != nil || !reflect.DeepEqual(ancestors, tt.ancestors) {
+			t.Errorf("%s: Ancestors(%d) = %v, %v; want %v", tt.name, tt.id, ancestors, err, tt.ancestors)
+		}
+	}
+	if _, err := Default.Parent(0); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Parent(0): error = %v", err)
+	}
+}
+
+func TestChildren(t *testing.T) {
+	tests := []struct {
+		name   string
+		enc    Encoding
+		id     int
+		first  int
+		last   int
+		length int
+		err    error
+	}{
+		{"roots", Default, 0, 1000, 9000, 9, nil},
+		{"descending", Default, 1000, 900, 100, 9, nil},
+		{"descending level 2", Default, 900, 890, 810, 9, nil},
+		{"ascending", ascending, 1000, 1100, 1900, 9, nil},
+		{"ascending roots", ascending, 0, 1000, 9000, 9, nil},
+		{"wide leaves", wideLeaves, 100, 99, 1, 99, nil},
+		{"wide roots", wideRoots, 0, 10, 990, 99, nil},
+		{"wide roots children", wideRoots, 20, 21, 29, 9, nil},
+		{"leaf", Default, 889, 0, 0, 0, ErrLeaf},
+		{"wide leaves leaf", wideLeaves, 57, 0, 0, 0, ErrLeaf},
+		{"invalid", Default, 10000, 0, 0, 0, ErrInvalidID},
+	}
+	for _, tt := range tests {
+		children, err := tt.enc.Children(tt.id)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: Children(%d): error = %v, want %v", tt.name, tt.id, err, tt.err)
+			continue
+		}
+		if tt.err != nil {
+			continue
+		}
+		if len(children) != tt.length || children[0] != tt.first || children[len(children)-1] != tt.last {
+			t.Errorf("%s: Children(%d) = %v; want %d ~ %d, %d slots", tt.name, tt.id, children, tt.first, tt.last, tt.length)
+		}
+	}
+}
+
+func TestSlots(t *testing.T) {
+	tests := []struct {
+		name  string
+		enc   Encoding
+		id    int
+		index int
+	}{
+		{"first", Default, 900, 1},
+		{"third", Default, 700, 3},
+		{"last", Default, 100, 9},
+		{"ascending", ascending, 1300, 3},
+		{"root", Default, 3000, 3},
+		{"wide leaves", wideLeaves, 57, 43},
+	}
+	for _, tt := range tests {
+		index, err := tt.enc.SlotIndex(tt.id)
+		if err != nil || index != tt.index {
+			t.Errorf("%s: SlotIndex(%d) = %d, %v; want %d", tt.name, tt.id, index, err, tt.index)
+		}
+		parent, _ := tt.enc.Parent(tt.id)
+		if id, err := tt.enc.ChildAt(parent, tt.index); err != nil || id != tt.id {
+			t.Errorf("%s: ChildAt(%d, %d) = %d, %v; want %d", tt.name, parent, tt.index, id, err, tt.id)
+		}
+	}
+	for _, index := range []int{0, 10} {
+		if _, err := Default.ChildAt(1000, index); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("ChildAt(1000, %d): error = %v", index, err)
+		}
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  Encoding
+		id   int
+		want Range
+	}{
+		{"root", Default, 1000, Range{1, 1000}},
+		{"second root", Default, 2000, Range{1001, 2000}},
+		{"level 1", Default, 900, Range{801, 900}},
+		{"leaf", Default, 889, Range{889, 889}},
+		{"ascending root", ascending, 1000, Range{1000, 1999}},
+		{"ascending level 1", ascending, 1100, Range{1100, 1199}},
+		{"wide leaves", wideLeaves, 200, Range{101, 200}},
+		{"wide roots", wideRoots, 20, Range{20, 29}},
+	}
+	for _, tt := range tests {
+		r, err := tt.enc.Descendants(tt.id)
+		if err != nil || r != tt.want {
+			t.Errorf("%s: Descendants(%d) = %+v, %v; want %+v", tt.name, tt.id, r, err, tt.want)
+			continue
+		}
+		// Both bounds are inclusive
+		if !r.Contains(r.Min) || !r.Contains(r.Max) || r.Contains(r.Min-1) || r.Contains(r.Max+1) {
+			t.Errorf("%s: %+v does not contain exactly its bounds", tt.name, r)
+		}
+		if !tt.enc.IsDescendant(tt.id, tt.id) || !tt.enc.IsDescendant(tt.id, r.Min) || tt.enc.IsDescendant(tt.id, r.Max+1) {
+			t.Errorf("%s: IsDescendant disagrees with %+v", tt.name, r)
+		}
+	}
+	if _, err := Default.Descendants(0); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Descendants(0): error = %v", err)
+	}
+	if Default.IsDescendant(0, 900) {
+		t.Error("IsDescendant(0, 900) with an invalid ancestor")
+	}
+}
+
+func TestNextChild(t *testing.T) {
+	full := []int{900, 800, 700, 600, 500, 400, 300, 200, 100}
+	tests := []struct {
+		name   string
+		enc    Encoding
+		parent int
+		used   []int
+		want   int
+		err    error
+	}{
+		{"empty", Default, 1000, nil, 900, nil},
+		{"first gap", Default, 1000, []int{900, 700}, 800, nil},
+		{"last slot", Default, 1000, full[:8], 100, nil},
+		{"full", Default, 1000, full, 0, ErrNoFreeSlot},
+		{"leaf", Default, 889, nil, 0, ErrLeaf},
+		{"ascending", ascending, 1000, []int{1100}, 1200, nil},
+		{"root", Default, 0, []int{1000, 3000}, 2000, nil},
+		{"wide leaves", wideLeaves, 100, []int{99, 98}, 97, nil},
+	}
+	for _, tt := range tests {
+		id, err := tt.enc.NextChild(tt.parent, tt.used)
+		if !errors.Is(err, tt.err) || id != tt.want {
+			t.Errorf("%s: NextChild(%d, %v) = %d, %v; want %d, %v", tt.name, tt.parent, tt.used, id, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNextRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		enc   Encoding
+		maxID int
+		want  int
+		err   error
+	}{
+		{"empty", Default, 0, 1000, nil},
+		{"after a root", Default, 1000, 2000, nil},
+		{"root not stored", Default, 999, 1000, nil},
+		{"after a descendant", Default, 2345, 3000, nil},
+		{"last root", Default, 8999, 9000, nil},
+		{"full", Default, 9000, 0, ErrNoFreeSlot},
+		{"ascending descendant", ascending, 1999, 2000, nil},
+		{"ascending full", ascending, 9000, 0, ErrNoFreeSlot},
+		{"wide roots", wideRoots, 25, 30, nil},
+	}
+	for _, tt := range tests {
+		id, err := tt.enc.NextRoot(tt.maxID)
+		if !errors.Is(err, tt.err) || id != tt.want {
+			t.Errorf("%s: NextRoot(%d) = %d, %v; want %d, %v", tt.name, tt.maxID, id, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSlotUsage(t *testing.T) {
+	present := map[int]bool{1000: true, 900: true, 700: true, 890: true, 2000: true}
+	tests := []struct {
+		name   string
+		enc    Encoding
+		parent int
+		want   Usage
+	}{
+		{"children", Default, 1000, Usage{ID: 1000, Level: 1, Capacity: 9, Used: 2, Free: 7, Next: 800}},
+		{"roots", Default, 0, Usage{ID: 0, Level: 0, Capacity: 9, Used: 2, Free: 7, Next: 3000}},
+		{"grandchildren", Default, 900, Usage{ID: 900, Level: 2, Capacity: 9, Used: 1, Free: 8, Next: 880}},
+	}
+	for _, tt := range tests {
+		u, err := tt.enc.SlotUsage(tt.parent, present)
+		if err != nil || u != tt.want {
+			t.Errorf("%s: SlotUsage(%d) = %+v, %v; want %+v", tt.name, tt.parent, u, err, tt.want)
+		}
+	}
+
+	full := map[int]bool{}
+	for id := 881; id <= 889; id++ {
+		full[id] = true
+	}
+	if u, err := Default.SlotUsage(890, full); err != nil || u.Free != 0 || u.Next != 0 || u.Ratio() != 1 {
+		t.Errorf("full SlotUsage = %+v, %v", u, err)
+	}
+	if u, _ := Default.SlotUsage(1000, nil); u.Ratio() != 0 {
+		t.Errorf("empty Ratio = %v", u.Ratio())
+	}
+	if _, err := Default.SlotUsage(889, present); !errors.Is(err, ErrLeaf) {
+		t.Errorf("SlotUsage of a leaf: error = %v", err)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		name     string
+		enc      Encoding
+		ids      []int
+		from, to int
+		want     []Mapping
+		err      error
+	}{
+		{"sibling", Default, []int{900, 890, 889}, 900, 700,
+			[]Mapping{{900, 700}, {890, 690}, {889, 689}}, nil},
+		{"other root", Default, []int{890, 881}, 890, 1990,
+			[]Mapping{{890, 1990}, {881, 1981}}, nil},
+		{"ascending", ascending, []int{1100, 1110}, 1100, 2300,
+			[]Mapping{{1100, 2300}, {1110, 2310}}, nil},
+		{"deeper", Default, []int{900, 890, 889}, 900, 790, nil, ErrDoesNotFit},
+		{"outside", Default, []int{900, 800}, 900, 700, nil, ErrInvalidID},
+	}
+	for _, tt := range tests {
+		mappings, err := tt.enc.Rebase(tt.ids, tt.from, tt.to)
+		if !errors.Is(err, tt.err) || (tt.err == nil && !reflect.DeepEqual(mappings, tt.want)) {
+			t.Errorf("%s: Rebase(%v, %d, %d) = %v, %v; want %v, %v", tt.name, tt.ids, tt.from, tt.to, mappings, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  Encoding
+		ids  []int
+		root int
+		want []Mapping
+		err  error
+	}{
+		{"children", Default, []int{1000, 700, 500, 690}, 1000,
+			[]Mapping{{1000, 1000}, {700, 900}, {500, 800}, {690, 890}}, nil},
+		{"packed", Default, []int{1000, 900, 800}, 1000,
+			[]Mapping{{1000, 1000}, {900, 900}, {800, 800}}, nil},
+		{"roots", Default, []int{3000, 1000, 2900}, 0,
+			[]Mapping{{3000, 2000}, {1000, 1000}, {2900, 1900}}, nil},
+		{"ascending", ascending, []int{1000, 1300, 1310}, 1000,
+			[]Mapping{{1000, 1000}, {1300, 1100}, {1310, 1110}}, nil},
+		{"wide leaves", wideLeaves, []int{100, 50, 7}, 100,
+			[]Mapping{{100, 100}, {50, 99}, {7, 98}}, nil},
+		{"missing parent", Default, []int{1000, 690}, 1000, nil, ErrInvalidID},
+		{"outside", Default, []int{1000, 1900}, 1000, nil, ErrInvalidID},
+	}
+	for _, tt := range tests {
+		mappings, err := tt.enc.Compact(tt.ids, tt.root)
+		if !errors.Is(err, tt.err) || (tt.err == nil && !reflect.DeepEqual(mappings, tt.want)) {
+			t.Errorf("%s: Compact(%v, %d) = %v, %v; want %v, %v", tt.name, tt.ids, tt.root, mappings, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCompactAround(t *testing.T) {
+	tests := []struct {
+		name   string
+		ids    []int
+		root   int
+		pinned []int
+		want   []Mapping
+		err    error
+	}{
+		{"pinned slot is skipped", []int{1000, 800, 600, 500}, 1000, []int{800},
+			[]Mapping{{1000, 1000}, {800, 800}, {600, 900}, {500, 700}}, nil},
+		{"ancestors stay", []int{1000, 700, 690, 680, 670}, 1000, []int{670},
+			[]Mapping{{1000, 1000}, {700, 700}, {690, 690}, {680, 680}, {670, 670}}, nil},
+		{"siblings of an ancestor pack", []int{1000, 700, 670, 500}, 1000, []int{670},
+			[]Mapping{{1000, 1000}, {700, 700}, {670, 670}, {500, 900}}, nil},
+		{"roots", []int{3000, 1000, 2900}, 0, []int{2900},
+			[]Mapping{{3000, 3000}, {1000, 1000}, {2900, 2900}}, nil},
+		{"none", []int{1000, 700}, 1000, nil, []Mapping{{1000, 1000}, {700, 900}}, nil},
+		{"not in ids", []int{1000, 700}, 1000, []int{800}, nil, ErrInvalidID},
+		{"root", []int{1000, 700}, 1000, []int{1000}, nil, ErrInvalidID},
+	}
+	for _, tt := range tests {
+		mappings, err := Default.CompactAround(tt.ids, tt.root, tt.pinned)
+		if !errors.Is(err, tt.err) || (tt.err == nil && !reflect.DeepEqual(mappings, tt.want)) {
+			t.Errorf("%s: CompactAround(%v, %d, %v) = %v, %v; want %v, %v", tt.name, tt.ids, tt.root, tt.pinned, mappings, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Longest external key department_external_keys can hold
+const maxExternalKeyLength = 100
+
+var errImportInvalid = errors.New("invalid import")
+
+// ImportRow is one department of an adjacency-list import.
+// An empty parent_external_key makes the department a root.
+type ImportRow struct {
+	ExternalKey       string `json:"external_key"`
+	ParentExternalKey string `json:"parent_external_key"`
+	Name              string `json:"name"`
+}
+
+// ImportedDepartment records the ID assigned to an external key
+type ImportedDepartment struct {
+	ExternalKey string `json:"external_key"`
+	ID          int    `json:"id"`
+}
+
+// Import departments from JSON or CSV rows of (external_key, parent_external_key, name).
+// The format follows the Content-Type, or ?format=csv|json.
+func importDepartments(c *gin.Context) {
+	// Imported rows can land anywhere in the tree, roots included
+	if !authorize(c, auth.RoleAdmin, 0) {
+		return
+	}
+	format := c.Query("format")
+	if format == "" {
+		format = "json"
+		if strings.Contains(c.ContentType(), "csv") {
+			format = "csv"
+		}
+	}
+	rows, err := parseImportRows(format, c.Request.Body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	imported, err := importDepartmentRows(c.Request.Context(), rows)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error importing departments", "err", err)
+		switch {
+		case errors.Is(err, errImportInvalid), errors.Is(err, errParentNotFound):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, idgen.ErrNoFreeSlot), errors.Is(err, idgen.ErrLeaf):
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Tree does not fit the ID scheme: %v", err)})
+		case errors.Is(err, store.ErrLockTimeout):
+			c.JSON(503, gin.H{"error": "Department allocation is busy, try again"})
+		default:
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import departments: %v", err)})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Departments imported successfully",
+		"mapping": imported,
+	})
+}
+
+// parseImportRows reads a JSON array or a CSV file with a header row
+func parseImportRows(format string, r io.Reader) ([]ImportRow, error) {
+	var rows []ImportRow
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if len(records) == 0 {
+			return nil, errors.New("CSV has no header row")
+		}
+		columns := make(map[string]int)
+		for i, name := range records[0] {
+			columns[strings.TrimSpace(name)] = i
+		}
+		for _, name := range []string{"external_key", "parent_external_key", "name"} {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("CSV header is missing column %q", name)
+			}
+		}
+		for _, record := range records[1:] {
+			rows = append(rows, ImportRow{
+				ExternalKey:       record[columns["external_key"]],
+				ParentExternalKey: record[columns["parent_external_key"]],
+				Name:              record[columns["name"]],
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected json or csv", format)
+	}
+	for i := range rows {
+		rows[i].ExternalKey = strings.TrimSpace(rows[i].ExternalKey)
+		rows[i].ParentExternalKey = strings.TrimSpace(rows[i].ParentExternalKey)
+		rows[i].Name = strings.TrimSpace(rows[i].Name)
+	}
+	return rows, nil
+}
+
+// importDepartmentRows allocates IDs for rows parents first and records
+// their external keys, all in one transaction. A parent key may name a row
+// of the same import or a department imported earlier.
+func importDepartmentRows(ctx context.Context, rows []ImportRow) ([]ImportedDepartment, error) {
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: no rows", errImportInvalid)
+	}
+	byKey := make(map[string]ImportRow, len(rows))
+	children := make(map[string][]string)
+	for i, row := range rows {
+		switch {
+		case row.ExternalKey == "":
+			return nil, fmt.Errorf("%w: row %d has no external_key", errImportInvalid, i+1)
+		case len(row.ExternalKey) > maxExternalKeyLength:
+			return nil, fmt.Errorf("%w: external_key %q is longer than %d characters", errImportInvalid, row.ExternalKey, maxExternalKeyLength)
+		case row.Name == "":
+			return nil, fmt.Errorf("%w: %q has no name", errImportInvalid, row.ExternalKey)
+		case row.ParentExternalKey == row.ExternalKey:
+			return nil, fmt.Errorf("%w: %q is its own parent", errImportInvalid, row.ExternalKey)
+		}
+		if _, ok := byKey[row.ExternalKey]; ok {
+			return nil, fmt.Errorf("%w: external_key %q appears twice", errImportInvalid, row.ExternalKey)
+		}
+		byKey[row.ExternalKey] = row
+		children[row.ParentExternalKey] = append(children[row.ParentExternalKey], row.ExternalKey)
+	}
+
+	var imported []ImportedDepartment
+	err := repo.Allocate(ctx, 0, func(tx store.Tx) error {
+		// Roots of the import hang off no parent or off an already imported department
+		ids := map[string]int{"": 0}
+		for parentKey := range children {
+			if _, inBatch := byKey[parentKey]; inBatch || parentKey == "" {
+				continue
+			}
+			id, err := tx.ExternalKey(parentKey)
+			if errors.Is(err, store.ErrExternalKeyNotFound) {
+				return fmt.Errorf("%w: parent_external_key %q does not exist", errImportInvalid, parentKey)
+			}
+			if err != nil {
+				return err
+			}
+			ids[parentKey] = id
+		}
+
+		// Allocate breadth first, in input order among siblings
+		var queue []string
+		for _, row := range rows {
+			if _, inBatch := byKey[row.ParentExternalKey]; !inBatch {
+				queue = append(queue, row.ExternalKey)
+			}
+		}
+		for len(queue) > 0 {
+			key := queue[0]
+			queue = queue[1:]
+			row := byKey[key]
+			parentID := ids[row.ParentExternalKey]
+
+			newID, err := nextSlot(ctx, tx, parentID)
+			if err != nil {
+				return fmt.Errorf("allocating %q: %w", key, err)
+			}
+			d := store.Department{ID: newID, Name: row.Name, ParentID: parentID}
+			if err := tx.InsertDepartment(d); err != nil {
+				return err
+			}
+			if err := tx.RecordEvent(store.AuditEvent{
+				Action:       store.AuditDepartmentCreate,
+				DepartmentID: newID,
+				After:        store.Snapshot(map[string]interface{}{"id": newID, "name": row.Name, "parent_id": parentID, "external_key": key}),
+			}); err != nil {
+				return err
+			}
+			if err := tx.InsertExternalKey(key, newID); err != nil {
+				if errors.Is(err, store.ErrDuplicate) {
+					return fmt.Errorf("%w: external_key %q was already imported", errImportInvalid, key)
+				}
+				return err
+			}
+			ids[key] = newID
+			imported = append(imported, ImportedDepartment{ExternalKey: key, ID: newID})
+			queue = append(queue, children[key]...)
+		}
+
+		// Rows never reached hang off each other in a loop
+		if len(imported) != len(rows) {
+			var stuck []string
+			for _, row := range rows {
+				if _, ok := ids[row.ExternalKey]; !ok {
+					stuck = append(stuck, row.ExternalKey)
+				}
+			}
+			return fmt.Errorf("%w: parent_external_key forms a cycle through %s", errImportInvalid, strings.Join(stuck, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
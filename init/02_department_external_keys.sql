@@ -0,0 +1,6 @@
+-- External keys of imported departments (POST /api/departments/import)
+CREATE TABLE IF NOT EXISTS department_external_keys (
+    external_key VARCHAR(100) PRIMARY KEY,
+    department_id INT NOT NULL,
+    FOREIGN KEY (department_id) REFERENCES departments(id) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+-- Audit log of every change (GET /api/audit). No foreign keys: events
+-- outlive the rows they describe.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    occurred_at DATETIME(6) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    action VARCHAR(50) NOT NULL,
+    department_id INT NOT NULL,
+    employee_id INT,
+    before_json LONGTEXT,
+    after_json LONGTEXT,
+    INDEX audit_events_department_id (department_id),
+    INDEX audit_events_occurred_at (occurred_at)
+);
@@ -0,0 +1,4 @@
+-- Deleted departments and employees keep their row until the ID quarantine
+-- (ids.tombstone_quarantine) is over; reads skip rows where deleted_at is set.
+ALTER TABLE departments ADD COLUMN deleted_at DATETIME(6);
+ALTER TABLE employees ADD COLUMN deleted_at DATETIME(6);
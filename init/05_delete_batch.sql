@@ -0,0 +1,4 @@
+-- Rows deleted together by one department delete share a delete_batch, so a
+-- restore brings back exactly those rows and not ones deleted on their own.
+ALTER TABLE departments ADD COLUMN delete_batch VARCHAR(32);
+ALTER TABLE employees ADD COLUMN delete_batch VARCHAR(32);
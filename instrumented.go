@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// instrumentedRepository records the duration of every call of the wrapped
+// repository in db_query_duration_seconds, named after the method.
+// Calls made through the Tx of Allocate are recorded as "tx_*".
+type instrumentedRepository struct {
+	next store.Repository
+}
+
+var _ store.Repository = instrumentedRepository{}
+
+func instrumentRepository(r store.Repository) store.Repository {
+	return instrumentedRepository{next: r}
+}
+
+// observe records a call that started at start and returned err, and logs it
+// at debug level under the request of ctx
+func observe(ctx context.Context, query string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, store.ErrDepartmentNotFound), errors.Is(err, store.ErrEmployeeNotFound), errors.Is(err, store.ErrExternalKeyNotFound):
+		result = "not_found"
+	default:
+		result = "error"
+	}
+	elapsed := time.Since(start)
+	queryDuration.WithLabelValues(query, result).Observe(elapsed.Seconds())
+	if err != nil {
+		slog.DebugContext(ctx, "Query", "query", query, "duration", elapsed, "result", result, "err", err)
+	} else {
+		slog.DebugContext(ctx, "Query", "query", query, "duration", elapsed, "result", result)
+	}
+}
+
+func (r instrumentedRepository) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { observe(ctx, "ping", start, err) }(time.Now())
+	return r.next.Ping(ctx)
+}
+
+func (r instrumentedRepository) Close() error {
+	return r.next.Close()
+}
+
+func (r instrumentedRepository) ListDepartments(ctx context.Context) (departments []store.Department, err error) {
+	defer func(start time.Time) { observe(ctx, "list_departments", start, err) }(time.Now())
+	return r.next.ListDepartments(ctx)
+}
+
+func (r instrumentedRepository) GetDepartment(ctx context.Context, id int) (d store.Department, err error) {
+	defer func(start time.Time) { observe(ctx, "get_department", start, err) }(time.Now())
+	return r.next.GetDepartment(ctx, id)
+}
+
+func (r instrumentedRepository) GetDepartments(ctx context.Context, ids []int) (departments []store.Department, err error) {
+	defer func(start time.Time) { observe(ctx, "get_departments", start, err) }(time.Now())
+	return r.next.GetDepartments(ctx, ids)
+}
+
+func (r instrumentedRepository) DepartmentRange(ctx context.Context, rng idgen.Range) (departments []store.Department, err error) {
+	defer func(start time.Time) { observe(ctx, "department_range", start, err) }(time.Now())
+	return r.next.DepartmentRange(ctx, rng)
+}
+
+func (r instrumentedRepository) DeletedDepartmentIDs(ctx context.Context, rng idgen.Range, deletedSince time.Time) (ids []int, err error) {
+	defer func(start time.Time) { observe(ctx, "deleted_department_ids", start, err) }(time.Now())
+	return r.next.DeletedDepartmentIDs(ctx, rng, deletedSince)
+}
+
+func (r instrumentedRepository) RootDepartmentIDs(ctx context.Context) (ids []int, err error) {
+	defer func(start time.Time) { observe(ctx, "root_department_ids", start, err) }(time.Now())
+	return r.next.RootDepartmentIDs(ctx)
+}
+
+func (r instrumentedRepository) DepartmentParents(ctx context.Context) (parents map[int]int, err error) {
+	defer func(start time.Time) { observe(ctx, "department_parents", start, err) }(time.Now())
+	return r.next.DepartmentParents(ctx)
+}
+
+func (r instrumentedRepository) LoadTree(ctx context.Context, root int, strategy store.TreeStrategy, payload int) (nodes []store.TreeNode, err error) {
+	query := "load_tree_by_parent_id"
+	if strategy == store.ByIDRange {
+		query = "load_tree_by_id_range"
+	}
+	defer func(start time.Time) { observe(ctx, query, start, err) }(time.Now())
+	return r.next.LoadTree(ctx, root, strategy, payload)
+}
+
+func (r instrumentedRepository) RenameDepartment(ctx context.Context, id int, name string) (err error) {
+	defer func(start time.Time) { observe(ctx, "rename_department", start, err) }(time.Now())
+	return r.next.RenameDepartment(ctx, id, name)
+}
+
+func (r instrumentedRepository) DeleteDepartment(ctx context.Context, id int) (deleted store.DeletedSubtree, err error) {
+	defer func(start time.Time) { observe(ctx, "delete_department", start, err) }(time.Now())
+	return r.next.DeleteDepartment(ctx, id)
+}
+
+func (r instrumentedRepository) RestoreDepartment(ctx context.Context, id int) (restored store.DeletedSubtree, err error) {
+	defer func(start time.Time) { observe(ctx, "restore_department", start, err) }(time.Now())
+	return r.next.RestoreDepartment(ctx, id)
+}
+
+// Allocate is recorded as a whole, lock wait and commit included
+func (r instrumentedRepository) Allocate(ctx context.Context, parentID int, fn func(tx store.Tx) error) (err error) {
+	defer func(start time.Time) { observe(ctx, "allocate", start, err) }(time.Now())
+	return r.next.Allocate(ctx, parentID, func(tx store.Tx) error {
+		return fn(instrumentedTx{ctx: ctx, next: tx})
+	})
+}
+
+func (r instrumentedRepository) ListEmployees(ctx context.Context, q store.EmployeeQuery) (employees []store.Employee, total int, err error) {
+	defer func(start time.Time) { observe(ctx, "list_employees", start, err) }(time.Now())
+	return r.next.ListEmployees(ctx, q)
+}
+
+func (r instrumentedRepository) GetEmployee(ctx context.Context, id int) (emp store.Employee, err error) {
+	defer func(start time.Time) { observe(ctx, "get_employee", start, err) }(time.Now())
+	return r.next.GetEmployee(ctx, id)
+}
+
+func (r instrumentedRepository) CreateEmployee(ctx context.Context, emp store.Employee) (created store.Employee, err error) {
+	defer func(start time.Time) { observe(ctx, "create_employee", start, err) }(time.Now())
+	return r.next.CreateEmployee(ctx, emp)
+}
+
+func (r instrumentedRepository) UpdateEmployee(ctx context.Context, emp store.Employee) (updated store.Employee, err error) {
+	defer func(start time.Time) { observe(ctx, "update_employee", start, err) }(time.Now())
+	return r.next.UpdateEmployee(ctx, emp)
+}
+
+func (r instrumentedRepository) DeleteEmployee(ctx context.Context, id int) (err error) {
+	defer func(start time.Time) { observe(ctx, "delete_employee", start, err) }(time.Now())
+	return r.next.DeleteEmployee(ctx, id)
+}
+
+func (r instrumentedRepository) SubtreeEmployees(ctx context.Context, departmentID int) (employees []store.Employee, err error) {
+	defer func(start time.Time) { observe(ctx, "subtree_employees", start, err) }(time.Now())
+	return r.next.SubtreeEmployees(ctx, departmentID)
+}
+
+func (r instrumentedRepository) EmployeesByDepartments(ctx context.Context, departmentIDs []int) (employees []store.Employee, err error) {
+	defer func(start time.Time) { observe(ctx, "employees_by_departments", start, err) }(time.Now())
+	return r.next.EmployeesByDepartments(ctx, departmentIDs)
+}
+
+func (r instrumentedRepository) ListAuditEvents(ctx context.Context, q store.AuditQuery) (events []store.AuditEvent, err error) {
+	defer func(start time.Time) { observe(ctx, "list_audit_events", start, err) }(time.Now())
+	return r.next.ListAuditEvents(ctx, q)
+}
+
+// instrumentedTx records the statements run inside an allocation.
+// ctx is the context of the Allocate call, for logging.
+type instrumentedTx struct {
+	ctx  context.Context
+	next store.Tx
+}
+
+func (t instrumentedTx) LockDepartment(id int) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_lock_department", start, err) }(time.Now())
+	return t.next.LockDepartment(id)
+}
+
+func (t instrumentedTx) LockRange(r idgen.Range) (ids []int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_lock_range", start, err) }(time.Now())
+	return t.next.LockRange(r)
+}
+
+func (t instrumentedTx) LockParents() (parents map[int]int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_lock_parents", start, err) }(time.Now())
+	return t.next.LockParents()
+}
+
+func (t instrumentedTx) ExistingIDs(ids []int) (existing []int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_existing_ids", start, err) }(time.Now())
+	return t.next.ExistingIDs(ids)
+}
+
+func (t instrumentedTx) MaxID() (maxID int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_max_id", start, err) }(time.Now())
+	return t.next.MaxID()
+}
+
+func (t instrumentedTx) InsertDepartment(d store.Department) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_insert_department", start, err) }(time.Now())
+	return t.next.InsertDepartment(d)
+}
+
+func (t instrumentedTx) RenameDepartment(id int, name string) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_rename_department", start, err) }(time.Now())
+	return t.next.RenameDepartment(id, name)
+}
+
+func (t instrumentedTx) SetParent(id, parentID int) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_set_parent", start, err) }(time.Now())
+	return t.next.SetParent(id, parentID)
+}
+
+func (t instrumentedTx) Renumber(mappings []idgen.Mapping) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_renumber", start, err) }(time.Now())
+	return t.next.Renumber(mappings)
+}
+
+func (t instrumentedTx) ExternalKey(key string) (id int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_external_key", start, err) }(time.Now())
+	return t.next.ExternalKey(key)
+}
+
+func (t instrumentedTx) InsertExternalKey(key string, departmentID int) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_insert_external_key", start, err) }(time.Now())
+	return t.next.InsertExternalKey(key, departmentID)
+}
+
+func (t instrumentedTx) DeletedIDs(r idgen.Range) (ids []int, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_deleted_ids", start, err) }(time.Now())
+	return t.next.DeletedIDs(r)
+}
+
+func (t instrumentedTx) PurgeTombstones(r idgen.Range, deletedBefore time.Time) (purged []store.Department, err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_purge_tombstones", start, err) }(time.Now())
+	return t.next.PurgeTombstones(r, deletedBefore)
+}
+
+func (t instrumentedTx) RecordEvent(e store.AuditEvent) (err error) {
+	defer func(start time.Time) { observe(t.ctx, "tx_record_event", start, err) }(time.Now())
+	return t.next.RecordEvent(e)
+}
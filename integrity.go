@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Kinds of integrity issues
+const (
+	issueInvalidID     = "invalid_id"     // the ID cannot be decoded at all
+	issueOrphan        = "orphan"         // parent_id points at a missing department
+	issueOutOfRange    = "out_of_range"   // the ID is not in its parent's range
+	issueDepthOverflow = "depth_overflow" // the department is deeper than the encoding allows
+	issueCycle         = "cycle"          // following parent_id loops back
+)
+
+// IntegrityIssue describes one department whose ID disagrees with parent_id
+type IntegrityIssue struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parent_id"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail"`
+}
+
+// IntegrityReport is the result of a check, and of the repair when one was requested
+type IntegrityReport struct {
+	Checked    int              `json:"checked"`
+	Issues     []IntegrityIssue `json:"issues"`
+	Fixed      bool             `json:"fixed"`
+	Mapping    []idgen.Mapping  `json:"mapping,omitempty"`    // renumbered departments
+	Reparented []idgen.Mapping  `json:"reparented,omitempty"` // orphans attached to their encoded parent: id -> new parent_id
+	Unfixable  []int            `json:"unfixable,omitempty"`
+}
+
+// Report departments whose ID is inconsistent with parent_id
+func getIntegrity(c *gin.Context) {
+	if !authorize(c, auth.RoleAdmin, 0) {
+		return
+	}
+	report, err := checkIntegrity(c.Request.Context(), false)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error checking integrity", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to check integrity: %v", err)})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// Check and repair what can be repaired by renumbering
+func fixIntegrity(c *gin.Context) {
+	if !authorize(c, auth.RoleAdmin, 0) {
+		return
+	}
+	report, err := checkIntegrity(c.Request.Context(), true)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error fixing integrity", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to fix integrity: %v", err)})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// checkIntegrity loads every department and reports the issues found. With
+// fix, parent_id is taken as the truth: departments are renumbered into a
+// free slot of their parent, and orphans whose encoded parent exists are
+// attached to it. Cycles, subtrees that do not fit and deleted departments
+// are left alone.
+//
+// Only the repair takes the allocation lock of the roots; a plain check
+// reads the parents without blocking concurrent writes.
+func checkIntegrity(ctx context.Context, fix bool) (IntegrityReport, error) {
+	if !fix {
+		parents, err := repo.DepartmentParents(ctx)
+		if err != nil {
+			return IntegrityReport{}, err
+		}
+		return IntegrityReport{Checked: len(parents), Issues: findIntegrityIssues(parents)}, nil
+	}
+
+	var report IntegrityReport
+	fixed := false
+	err := repo.Allocate(ctx, 0, func(tx store.Tx) error {
+		parents, err := tx.LockParents()
+		if err != nil {
+			return err
+		}
+		report = IntegrityReport{Checked: len(parents), Issues: findIntegrityIssues(parents)}
+		if len(report.Issues) == 0 {
+			return nil
+		}
+
+		deleted, err := tx.DeletedIDs(idgen.Range{Min: 1, Max: math.MaxInt32})
+		if err != nil {
+			return err
+		}
+		report.Reparented, report.Mapping, report.Unfixable = planIntegrityRepair(parents, deleted)
+		for _, m := range report.Reparented {
+			if err := tx.SetParent(m.OldID, m.NewID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Renumber(report.Mapping); err != nil {
+			return err
+		}
+		if err := tx.RecordEvent(store.AuditEvent{
+			Action: store.AuditIntegrityFix,
+			Before: store.Snapshot(map[string]interface{}{"issues": report.Issues}),
+			After:  store.Snapshot(map[string]interface{}{"reparented": report.Reparented, "mapping": report.Mapping, "unfixable": report.Unfixable}),
+		}); err != nil {
+			return err
+		}
+		fixed = true
+		return nil
+	})
+	report.Fixed = fixed && err == nil
+	return report, err
+}
+
+// findIntegrityIssues returns at most one issue per department, ordered by ID
+func findIntegrityIssues(parents map[int]int) []IntegrityIssue {
+	issues := []IntegrityIssue{}
+	cyclic := findCycles(parents)
+	for _, id := range sortedKeys(parents) {
+		parent := parents[id]
+		issue := IntegrityIssue{ID: id, ParentID: parent}
+		_, parentExists := parents[parent]
+		level, levelErr := encoding.Level(id)
+		encodedParent, _ := encoding.Parent(id)
+		switch {
+		case cyclic[id]:
+			issue.Kind, issue.Detail = issueCycle, "parent_id chain loops back to this department"
+		case parent != 0 && !parentExists:
+			issue.Kind, issue.Detail = issueOrphan, fmt.Sprintf("parent %d does not exist", parent)
+		case id >= encoding.Limit():
+			issue.Kind, issue.Detail = issueDepthOverflow, fmt.Sprintf("id is beyond the %d digit encoding", encoding.Width())
+		case levelErr != nil:
+			issue.Kind, issue.Detail = issueInvalidID, levelErr.Error()
+		case parent != 0 && isLeafLevel(parent):
+			issue.Kind, issue.Detail = issueDepthOverflow, fmt.Sprintf("parent %d is on the last of %d levels", parent, encoding.Depth())
+		case encodedParent != parent:
+			issue.Kind, issue.Detail = issueOutOfRange, fmt.Sprintf("level %d id belongs under %d", level, encodedParent)
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// planIntegrityRepair decides how to make parents consistent with the
+// encoding. It returns the orphans to attach to their encoded parent, the
+// departments to renumber (parents before children) and the IDs it could
+// not repair. Deleted departments keep their IDs through the quarantine, as
+// they do when compacting: one that would have to change is unfixable, and
+// so are the departments above it that would be renumbered.
+func planIntegrityRepair(parents map[int]int, deleted []int) (reparented, mappings []idgen.Mapping, unfixable []int) {
+	pinned := make(map[int]bool, len(deleted))
+	for _, id := range deleted {
+		pinned[id] = true
+	}
+	effective := make(map[int]int, len(parents))
+	for _, id := range sortedKeys(parents) {
+		parent := parents[id]
+		effective[id] = parent
+		if _, ok := parents[parent]; parent == 0 || ok {
+			continue
+		}
+		if pinned[id] {
+			unfixable = append(unfixable, id)
+			continue
+		}
+		if encodedParent, err := encoding.Parent(id); err == nil && encodedParent != 0 {
+			if _, ok := parents[encodedParent]; ok {
+				effective[id] = encodedParent
+				reparented = append(reparented, idgen.Mapping{OldID: id, NewID: encodedParent})
+				continue
+			}
+		}
+		unfixable = append(unfixable, id)
+	}
+
+	// Children keep their relative slot order where their IDs can be decoded
+	children := make(map[int][]int)
+	for _, id := range sortedKeys(effective) {
+		children[effective[id]] = append(children[effective[id]], id)
+	}
+	for _, kids := range children {
+		sort.SliceStable(kids, func(i, j int) bool {
+			a, errA := encoding.SlotIndex(kids[i])
+			b, errB := encoding.SlotIndex(kids[j])
+			return errA == nil && (errB != nil || a < b)
+		})
+	}
+
+	// Every existing ID stays reserved so a new slot never lands on another row
+	taken := make(map[int]bool, len(parents))
+	for id := range parents {
+		taken[id] = true
+	}
+
+	// Walk down from the roots; cycles are never reached
+	newIDs := map[int]int{0: 0}
+	reached := map[int]bool{0: true}
+	queue := []int{0}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, id := range children[parent] {
+			reached[id] = true
+			newParent := newIDs[parent]
+			if encodedParent, err := encoding.Parent(id); err == nil && encodedParent == newParent && newParent == parent && !isLeafLevel(newParent) {
+				newIDs[id] = id
+				queue = append(queue, id)
+				continue
+			}
+			newID, ok := freeSubtreeSlot(newParent, taken)
+			if !ok || pinned[id] {
+				markSubtree(id, children, func(id int) { unfixable = append(unfixable, id) })
+				continue
+			}
+			taken[newID] = true
+			newIDs[id] = newID
+			mappings = append(mappings, idgen.Mapping{OldID: id, NewID: newID})
+			queue = append(queue, id)
+		}
+	}
+	for _, id := range sortedKeys(parents) {
+		if !reached[id] && !contains(unfixable, id) {
+			unfixable = append(unfixable, id)
+		}
+	}
+
+	// Renumbering deletes the old row, and with it every child that was not
+	// moved along. A department that has an unfixable descendant therefore
+	// keeps its ID, and its whole subtree is left in place.
+	mapped := make(map[int]bool, len(mappings))
+	for _, m := range mappings {
+		mapped[m.OldID] = true
+	}
+	stuck := make(map[int]bool)
+	for _, id := range unfixable {
+		for node := effective[id]; mapped[node] && !stuck[node]; node = effective[node] {
+			stuck[node] = true
+		}
+	}
+	if len(stuck) > 0 {
+		seen := make(map[int]bool, len(unfixable))
+		for _, id := range unfixable {
+			seen[id] = true
+		}
+		for _, id := range sortedKeys(parents) {
+			if stuck[id] {
+				markSubtree(id, children, func(id int) {
+					if !seen[id] {
+						seen[id] = true
+						unfixable = append(unfixable, id)
+					}
+				})
+			}
+		}
+		kept := mappings[:0]
+		for _, m := range mappings {
+			if !seen[m.OldID] {
+				kept = append(kept, m)
+			}
+		}
+		mappings = kept
+		attached := reparented[:0]
+		for _, m := range reparented {
+			if !seen[m.OldID] {
+				attached = append(attached, m)
+			}
+		}
+		reparented = attached
+	}
+	sort.Ints(unfixable)
+	return reparented, mappings, unfixable
+}
+
+// freeSubtreeSlot returns the first child slot of parent whose whole range is unused
+func freeSubtreeSlot(parent int, taken map[int]bool) (int, bool) {
+	if parent != 0 && isLeafLevel(parent) {
+		return 0, false
+	}
+	slots, err := encoding.Children(parent)
+	if err != nil {
+		return 0, false
+	}
+	for _, slot := range slots {
+		r, err := encoding.Descendants(slot)
+		if err != nil {
+			continue
+		}
+		free := true
+		for id := range taken {
+			if r.Contains(id) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// findCycles returns the departments whose parent_id chain never reaches a root
+// because it loops, including the departments hanging below such a loop.
+func findCycles(parents map[int]int) map[int]bool {
+	cyclic := make(map[int]bool)
+	for id := range parents {
+		seen := map[int]bool{}
+		for node := id; node != 0; node = parents[node] {
+			if seen[node] {
+				cyclic[id] = true
+				break
+			}
+			seen[node] = true
+			if _, ok := parents[node]; !ok {
+				break
+			}
+		}
+	}
+	return cyclic
+}
+
+func isLeafLevel(id int) bool {
+	level, err := encoding.Level(id)
+	return err == nil && level == encoding.Depth()-1
+}
+
+func markSubtree(id int, children map[int][]int, mark func(int)) {
+	mark(id)
+	for _, child := range children[id] {
+		markSubtree(child, children, mark)
+	}
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func contains(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
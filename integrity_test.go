@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+func TestFindIntegrityIssues(t *testing.T) {
+	encoding = idgen.Default
+	parents := map[int]int{
+		1000: 0,
+		900:  1000,
+		890:  900,
+		889:  890,
+		880:  1000, // belongs under 900
+		500:  4242, // parent does not exist
+		7:    889,  // below a leaf
+		2000: 3000, // 2000 and 3000 point at each other
+		3000: 2000,
+	}
+
+	want := map[int]string{
+		880:  issueOutOfRange,
+		500:  issueOrphan,
+		7:    issueDepthOverflow,
+		2000: issueCycle,
+		3000: issueCycle,
+	}
+	issues := findIntegrityIssues(parents)
+	if len(issues) != len(want) {
+		t.Fatalf("got %d issues %+v, want %d", len(issues), issues, len(want))
+	}
+	for _, issue := range issues {
+		if want[issue.ID] != issue.Kind {
+			t.Errorf("issue for %d is %q, want %q", issue.ID, issue.Kind, want[issue.ID])
+		}
+	}
+}
+
+func TestPlanIntegrityRepair(t *testing.T) {
+	encoding = idgen.Default
+	parents := map[int]int{
+		1000: 0,
+		900:  1000,
+		880:  1000, // belongs under 900, moves to the next free slot of 1000
+		879:  880,
+		590:  4242, // orphan whose encoded parent 600 is missing
+		2000: 3000,
+		3000: 2000,
+	}
+
+	reparented, mappings, unfixable := planIntegrityRepair(parents, nil)
+	if len(reparented) != 0 {
+		t.Errorf("reparented = %v, want none", reparented)
+	}
+	wantMappings := []idgen.Mapping{{OldID: 880, NewID: 800}, {OldID: 879, NewID: 790}}
+	if len(mappings) != len(wantMappings) {
+		t.Fatalf("mappings = %v, want %v", mappings, wantMappings)
+	}
+	for i := range wantMappings {
+		if mappings[i] != wantMappings[i] {
+			t.Errorf("mappings[%d] = %v, want %v", i, mappings[i], wantMappings[i])
+		}
+	}
+	if !sameIDs(unfixable, []int{590, 2000, 3000}) {
+		t.Errorf("unfixable = %v, want [590 2000 3000]", unfixable)
+	}
+
+	// Once the planned IDs are applied the tree is consistent
+	fixed := map[int]int{1000: 0, 900: 1000, 800: 1000, 790: 800}
+	if issues := findIntegrityIssues(fixed); len(issues) != 0 {
+		t.Errorf("issues after repair: %+v", issues)
+	}
+}
+
+// A department is not renumbered while a child of it cannot be placed:
+// deleting its old row would take the child and its employees with it
+func TestFixIntegrityKeepsUnplaceableSubtree(t *testing.T) {
+	encoding = idgen.Default
+	repo = newSQLiteRepo(t,
+		store.Department{ID: 1000, Name: "Head Office"},
+		store.Department{ID: 900, Name: "Sales", ParentID: 1000},
+		store.Department{ID: 890, Name: "Domestic", ParentID: 900},
+		store.Department{ID: 500, Name: "Seoul", ParentID: 890},   // belongs under 890, fits in 889
+		store.Department{ID: 490, Name: "Gangnam", ParentID: 500}, // would be below a leaf
+	)
+	ctx := context.Background()
+	emp, err := repo.CreateEmployee(ctx, store.Employee{Name: "Kim", DepartmentID: 490, Position: "Manager", HireDate: "2021-03-01", EmployeeNumber: "E1"})
+	if err != nil {
+		t.Fatalf("create employee: %v", err)
+	}
+
+	report, err := checkIntegrity(ctx, true)
+	if err != nil {
+		t.Fatalf("fix: %v", err)
+	}
+	if len(report.Mapping) != 0 || !reflect.DeepEqual(report.Unfixable, []int{490, 500}) {
+		t.Errorf("mapping = %v, unfixable = %v, want no mapping and [490 500]", report.Mapping, report.Unfixable)
+	}
+
+	parents, err := repo.DepartmentParents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{1000: 0, 900: 1000, 890: 900, 500: 890, 490: 500}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("departments after fix = %v, want %v", parents, want)
+	}
+	if got, err := repo.GetEmployee(ctx, emp.ID); err != nil || got.DepartmentID != 490 {
+		t.Errorf("employee after fix = %+v, %v, want in 490", got, err)
+	}
+}
+
+// A deleted department keeps its ID through the quarantine, so a subtree
+// that could only be repaired by renumbering it is left in place
+func TestFixIntegrityKeepsDeletedDepartments(t *testing.T) {
+	encoding = idgen.Default
+	repo = newSQLiteRepo(t,
+		store.Department{ID: 1000, Name: "Head Office"},
+		store.Department{ID: 900, Name: "Sales", ParentID: 1000},
+		store.Department{ID: 880, Name: "Legal", ParentID: 1000}, // belongs under 900, would move to 800
+		store.Department{ID: 879, Name: "Contracts", ParentID: 880},
+	)
+	ctx := context.Background()
+	if _, err := repo.DeleteDepartment(ctx, 879); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := checkIntegrity(ctx, true)
+	if err != nil {
+		t.Fatalf("fix: %v", err)
+	}
+	if len(report.Mapping) != 0 || !reflect.DeepEqual(report.Unfixable, []int{879, 880}) {
+		t.Errorf("mapping = %v, unfixable = %v, want no mapping and [879 880]", report.Mapping, report.Unfixable)
+	}
+
+	parents, err := repo.DepartmentParents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{1000: 0, 900: 1000, 880: 1000, 879: 880}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("departments after fix = %v, want %v", parents, want)
+	}
+	if ids, err := repo.DeletedDepartmentIDs(ctx, idgen.Range{Min: 1, Max: 9999}, time.Time{}); err != nil || !reflect.DeepEqual(ids, []int{879}) {
+		t.Errorf("deleted departments after fix = %v, %v, want [879]", ids, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+)
+
+// requestIDHeader carries the request ID in and out. A caller-supplied ID
+// is kept so a request can be followed across services.
+const requestIDHeader = "X-Request-ID"
+
+// Longest caller-supplied request ID that is kept as is
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID of ctx, or "" outside a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID and caller of the context to every
+// record, so any code logging with a request context (the store included)
+// is attributed to the request without being handed a logger.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if principal := auth.FromContext(ctx); principal != nil {
+		r.AddAttrs(slog.String("subject", principal.Subject))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newLogger builds the logger described by c, writing to w
+func newLogger(w io.Writer, c config.Log) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if c.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// initLogger makes the configured logger the default, which the standard
+// log package then writes through as well
+func initLogger(c config.Log) {
+	slog.SetDefault(newLogger(os.Stderr, c))
+}
+
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// validRequestID reports whether a caller-supplied ID is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDMiddleware assigns the request ID, returns it in the response and
+// stores it in the request context for the handlers and the repository
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Writer.Header().Set(requestIDHeader, id)
+	c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+	c.Next()
+}
+
+// accessLogMiddleware logs every request once it has been served.
+// Health checks and scrapes are only logged at debug level.
+func accessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	level := slog.LevelInfo
+	switch path := c.FullPath(); {
+	case path == "/health" || path == "/metrics":
+		level = slog.LevelDebug
+	case c.Writer.Status() >= 500:
+		level = slog.LevelError
+	}
+	slog.LogAttrs(c.Request.Context(), level, "request",
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.String("route", c.FullPath()),
+		slog.Int("status", c.Writer.Status()),
+		slog.Int("size", c.Writer.Size()),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("client_ip", c.ClientIP()),
+	)
+}
+
+// recoverMiddleware turns a panicking handler into a 500 and logs the panic
+// with its stack, in place of gin's plain-text recovery output
+var recoverMiddleware = gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+	slog.ErrorContext(c.Request.Context(), "Handler panicked", "err", err, "stack", string(debug.Stack()))
+	c.AbortWithStatusJSON(500, gin.H{"error": "Internal server error"})
+})
@@ -1,38 +1,39 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
 )
 
-var db *sql.DB
-
-// Employee struct definition
-type Employee struct {
-	ID             int    `json:"id"`
-	Name           string `json:"name"`
-	DepartmentID   int    `json:"department_id"`
-	Position       string `json:"position"`
-	HireDate       string `json:"hire_date"`
-	EmployeeNumber string `json:"employee_number"`
-	LargeText      string `json:"large_text"`
-}
+// repo is where departments and employees are read from and written to
+var repo store.Repository
 
-// Department struct definition
-type Department struct {
-	ID       int            `json:"id"`
-	Name     string         `json:"name"`
-	ParentID sql.NullInt64  `json:"parent_id"`
-}
+// encoding is the ID scheme departments are allocated and queried with
+var encoding = idgen.Default
+
+// cfg holds the settings loaded at startup
+var cfg = config.Default()
+
+// Employee is the JSON body of the employee endpoints
+type Employee = store.Employee
 
 type DepartmentRequest struct {
 	ID       int     `json:"id"`
@@ -40,116 +41,180 @@ type DepartmentRequest struct {
 	ParentID *int    `json:"parent_id"`  // Using pointer to handle null possibility
 }
 
-func initDB() {
-	var err error
-	// Get database connection information from environment variables
-	dbHost := getEnv("DB_HOST", "localhost")
-	dbPort := getEnv("DB_PORT", "3306")
-	dbUser := getEnv("DB_USER", "root")
-	dbPassword := getEnv("DB_PASSWORD", "rootpassword")
-	dbName := getEnv("DB_NAME", "mydatabase")
-	
-	// Convert string to number
-	retryIntervalStr := getEnv("DB_RETRY_INTERVAL", "10")
-	maxRetriesStr := getEnv("DB_MAX_RETRIES", "30")
-	
-	retryInterval, err := strconv.Atoi(retryIntervalStr)
+// Load the configuration file and environment.
+// Invalid settings are fatal rather than replaced with defaults: a wrong ID
+// scheme in particular would corrupt allocated IDs.
+func initConfig() {
+	loaded, err := config.Load()
 	if err != nil {
-		log.Printf("Invalid DB_RETRY_INTERVAL, using default value: %v", err)
-		retryInterval = 10
+		fatal("Invalid configuration", "err", err)
 	}
-	
-	maxRetries, err := strconv.Atoi(maxRetriesStr)
+	enc, err := loaded.IDs.Encoding()
 	if err != nil {
-		log.Printf("Invalid DB_MAX_RETRIES, using default value: %v", err)
-		maxRetries = 30
+		fatal("Invalid ID scheme", "err", err)
 	}
+	cfg = loaded
+	encoding = enc
+	initLogger(cfg.Log)
+	slog.Info("ID scheme", "radix", enc.Radix, "digits", enc.Digits, "layout", enc.Layout.String(), "limit", enc.Limit())
+}
+
+func initDB() {
+	dbConfig := cfg.Database
+	s, err := store.Open(dbConfig.Driver, dbConfig.DSN(), encoding)
+	if err != nil {
+		fatal("Invalid database configuration", "err", err)
+	}
+	s.SetPool(dbConfig.MaxOpenConns, dbConfig.MaxIdleConns, time.Duration(dbConfig.ConnMaxLifetime))
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(s.DB(), dbConfig.Name))
 
-	// Create database connection string
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", dbUser, dbPassword, dbHost, dbPort, dbName)
-	
 	// Retry logic
-	for i := 0; i < maxRetries; i++ {
-		db, err = sql.Open("mysql", dsn)
+	for i := 0; i < dbConfig.MaxRetries; i++ {
+		err = s.Ping(context.Background())
 		if err != nil {
-			log.Printf("Failed to connect to database (attempt %d/%d): %v", i+1, maxRetries, err)
-			time.Sleep(time.Duration(retryInterval) * time.Second)
+			slog.Warn("Failed to ping database", "attempt", i+1, "max_retries", dbConfig.MaxRetries, "err", err)
+			time.Sleep(time.Duration(dbConfig.RetryInterval))
 			continue
 		}
 
-		err = db.Ping()
-		if err != nil {
-			log.Printf("Failed to ping database (attempt %d/%d): %v", i+1, maxRetries, err)
-			time.Sleep(time.Duration(retryInterval) * time.Second)
-			continue
+		// The MySQL container creates its tables from init/; the other databases start empty
+		if dbConfig.Driver != "mysql" {
+			if err := s.CreateSchema(context.Background()); err != nil {
+				fatal("Failed to create tables", "err", err)
+			}
 		}
-
-		fmt.Println("Successfully connected to database!")
+		repo = instrumentRepository(s)
+		slog.Info("Connected to database", "driver", dbConfig.Driver)
 		return
 	}
 
-	log.Fatal("Failed to connect to database after maximum retries")
+	fatal("Failed to connect to database after maximum retries", "driver", dbConfig.Driver)
 }
 
-// Get environment variable (with default value)
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
-	return value
-}
 
-func main() {
+	initConfig()
+	// gin's route listing is plain text; only show it when debugging
+	if os.Getenv(gin.EnvGinMode) == "" && !strings.EqualFold(cfg.Log.Level, "debug") {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	initAuth()
 	initDB()
-	defer db.Close()
 
-	r := gin.Default()
+	r := newRouter()
+	warnUnknownRouteTimeouts(r)
+	srv := &http.Server{Handler: r, ReadHeaderTimeout: readHeaderTimeout}
+	ln, err := net.Listen("tcp", cfg.Server.Listen)
+	if err != nil {
+		fatal("Failed to listen", "addr", cfg.Server.Listen, "err", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = runServer(ctx, srv, ln, time.Duration(cfg.Server.ShutdownTimeout))
+	stop()
+	repo.Close()
+	if err != nil {
+		fatal("Server failed", "err", err)
+	}
+}
+
+// newRouter sets up the middleware and routes of the API server
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(requestIDMiddleware, accessLogMiddleware, recoverMiddleware)
 
 	// Add CORS middleware
 	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		if origin, ok := allowedOrigin(c.GetHeader("Origin")); ok {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		c.Writer.Header().Add("Vary", "Origin")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+auth.APIKeyHeader+", "+requestIDHeader)
+		c.Writer.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
 		}
 		c.Next()
 	})
+	r.Use(metricsMiddleware, queryTimeoutMiddleware)
+
+	// The slot gauges describe the whole tree, so scraping needs credentials
+	r.GET("/metrics", authMiddleware, requireScope(auth.ScopeRead), metricsHandler())
 
 	// Add health check endpoint
 	r.GET("/health", func(c *gin.Context) {
-		if err := db.Ping(); err != nil {
+		if err := repo.Ping(c.Request.Context()); err != nil {
 			c.JSON(500, gin.H{"status": "error", "message": "Database connection failed"})
 			return
 		}
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
-	// Set up API routes
-	api := r.Group("/api")
+	// Set up API routes; reads need the read scope and changes the write scope
+	api := r.Group("/api", authMiddleware, actorMiddleware)
+	api.GET("/me", getCaller)
+	read := api.Group("", requireScope(auth.ScopeRead))
+	write := api.Group("", requireScope(auth.ScopeWrite))
 	{
 		// Department related APIs
-		api.GET("/departments", getDepartments)
-		api.GET("/departments/:id", getDepartment)
-		api.GET("/departments/:id/employees", getDepartmentEmployees)
-		api.POST("/departments", createDepartment)
-		api.DELETE("/departments/:id", deleteDepartment)
+		read.GET("/departments", getDepartments)
+		read.GET("/departments/:id", getDepartment)
+		read.GET("/departments/:id/employees", getDepartmentEmployees)
+		write.POST("/departments", createDepartment)
+		write.DELETE("/departments/:id", deleteDepartment)
+		write.POST("/departments/:id/restore", restoreDepartment)
+		write.PUT("/departments/:id", updateDepartment)
+		write.POST("/departments/:id/move", moveDepartment)
+		write.POST("/departments/:id/compact", compactDepartment)
+		read.GET("/departments/:id/capacity", getDepartmentCapacity)
+		read.GET("/departments/:id/ancestors", getDepartmentAncestors)
+		read.GET("/departments/capacity", getTreeCapacity)
+		write.POST("/departments/import", importDepartments)
+		read.GET("/departments/export", exportDepartments)
 
 		// Employee related APIs
-		api.GET("/employees", getEmployees)
-		api.GET("/employees/:id", getEmployee)
+		read.GET("/employees", getEmployees)
+		read.GET("/employees/:id", getEmployee)
+		write.POST("/employees", createEmployee)
+		write.PUT("/employees/:id", updateEmployee)
+		write.DELETE("/employees/:id", deleteEmployee)
 
-		// Add new endpoint
-		api.POST("/employees/by-departments", GetEmployeesByDepartmentIDs)
+		// Add new endpoint; a POST only to carry the ID list, so it is a read
+		read.POST("/employees/by-departments", GetEmployeesByDepartmentIDs)
 
 		// Department tree query API
-		api.GET("/departments/tree-recursive", getDepartmentTree)
-		api.GET("/departments/tree-comparison", getDepartmentTreeByComparison)
+		read.GET("/departments/tree-recursive", getDepartmentTree)
+		read.GET("/departments/tree-comparison", getDepartmentTreeByComparison)
+
+		// Strategy benchmark API
+		read.GET("/bench/tree", benchTree)
+
+		// Admin APIs
+		read.GET("/admin/integrity", getIntegrity)
+		read.GET("/audit", getAuditEvents)
+		write.POST("/admin/integrity/fix", fixIntegrity)
 	}
 
-	r.Run(":8080")
+	return r
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, and false when the origin is not in the allowlist
+func allowedOrigin(origin string) (string, bool) {
+	for _, allowed := range cfg.Server.CORSOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if origin != "" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return origin, true
+		}
+	}
+	return "", false
 }
 
 func getDepartmentTreeByComparison(c *gin.Context) {
@@ -163,49 +228,29 @@ func getDepartmentTreeByComparison(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid ID "+ id + " " + err.Error()})
 		return
 	}
-	if idInt < 10 {
-		c.JSON(400, gin.H{"error": "ID must be greater than 10"})
+	// The level and the subtree range are both decoded from the ID
+	if _, err := encoding.Descendants(idInt); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-
-	increment := 10
-	for i := len(id)- 1; i > 0 && id[i-1] == '0'; i-- {
-		increment *= 10
+	if !authorize(c, auth.RoleViewer, idInt) {
+		return
 	}
-	
 
-	query :=`
-	SELECT id, name, parent_id,
-	REPEAT(CONCAT(id, name, parent_id), 200000) as virtual_column
-	FROM departments
-	WHERE id <= ? and id > ?
-	ORDER BY id, parent_id;
-	`
-	log.Printf("Executing query: %s with parameters: id=%s, idInt-increment=%d", query, id, idInt-increment)
-	rows, err := db.Query(query, id, idInt-increment)
+	nodes, err := repo.LoadTree(c.Request.Context(), idInt, store.ByIDRange, 0)
 	if err != nil {
-		log.Printf("Error querying department tree: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error querying department tree", "err", err)
 		c.JSON(500, gin.H{"error": "Failed to fetch department tree"})
 		return
 	}
-	defer rows.Close()
 
-	var departments []gin.H
-	for rows.Next() {
-		var id int
-		var name string
-		var parentID sql.NullInt64
-		var virtualColumn sql.NullString
-		if err := rows.Scan(&id, &name, &parentID, &virtualColumn); err != nil {
-			log.Printf("Error scanning department row: %v", err)
-			c.JSON(500, gin.H{"error": "Failed to scan department row"})
-			return
-		}
+	departments := []gin.H{}
+	for _, node := range nodes {
 		departments = append(departments, gin.H{
-			"id":        id,
-			"name":      name,
-			"parent_id": parentID.Int64,
-			"virtual_column": virtualColumn.String,
+			"id":        node.ID,
+			"name":      node.Name,
+			"parent_id": node.ParentID,
+			"level":     node.Level,
 		})
 	}
 
@@ -218,232 +263,118 @@ func getDepartmentTree(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Parent ID is required"})
 		return
 	}
-
-	query := `
-		WITH RECURSIVE department_tree AS (
-			-- Base case: selected parent department
-			SELECT id, name, parent_id, 0 as level, CAST(id AS CHAR(100)) as path,
-			REPEAT(CONCAT(id, name, parent_id), 200000) as virtual_column
-			FROM departments
-			WHERE id = ?
-			
-			UNION ALL
-			
-			-- Recursive case: child departments
-			SELECT d.id, d.name, d.parent_id, dt.level + 1, CONCAT(dt.path, ',', d.id),
-			REPEAT(CONCAT(d.id, d.name, d.parent_id), 200000) as virtual_column
-			FROM departments d
-			INNER JOIN department_tree dt ON d.parent_id = dt.id
-		)
-		SELECT DISTINCT d1.id, d1.name, d1.parent_id, d1.level, d1.virtual_column
-		FROM department_tree d1
-		LEFT JOIN department_tree d2 ON d1.id = d2.id AND d1.path > d2.path
-		WHERE d2.id IS NULL
-		ORDER BY d1.id, d1.parent_id;
-	`
-
-	rows, err := db.Query(query, parentId)
+	parentIdInt, err := strconv.Atoi(parentId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid parent ID "+ parentId})
+		return
+	}
+	if !authorize(c, auth.RoleViewer, parentIdInt) {
+		return
+	}
+	nodes, err := repo.LoadTree(c.Request.Context(), parentIdInt, store.ByParentID, 0)
 	if err != nil {
-		log.Printf("Error querying department tree: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error querying department tree", "err", err)
 		c.JSON(500, gin.H{"error": "Failed to fetch department tree"})
 		return
 	}
-	defer rows.Close()
 
+	// parent_id may lead out of the encoded range the grant covers
 	var departments []gin.H
-	for rows.Next() {
-		var id int
-		var name string
-		var parentID sql.NullInt64
-		var level int
-		var virtualColumn sql.NullString
-		if err := rows.Scan(&id, &name, &parentID, &level, &virtualColumn); err != nil {
-			log.Printf("Error scanning department row: %v", err)
-			c.JSON(500, gin.H{"error": "Failed to scan department row"})
-			return
+	for _, node := range nodes {
+		if !can(c.Request.Context(), auth.RoleViewer, node.ID) {
+			continue
 		}
 		departments = append(departments, gin.H{
-			"id":        id,
-			"name":      name,
-			"parent_id": parentID.Int64,
-			"level":     level,
-			"virtual_column": virtualColumn.String,
+			"id":        node.ID,
+			"name":      node.Name,
+			"parent_id": node.ParentID,
+			"level":     node.Level,
 		})
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating department rows: %v", err)
-		c.JSON(500, gin.H{"error": "Failed to iterate department rows"})
-		return
-	}
-
 	c.JSON(200, departments)
 }
 
 // Get department list
 func getDepartments(c *gin.Context) {
-	rows, err := db.Query("SELECT id, parent_id, name FROM departments")
+	rows, err := repo.ListDepartments(c.Request.Context())
 	if err != nil {
-		log.Printf("Error querying departments: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error querying departments", "err", err)
 		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query departments: %v", err)})
 		return
 	}
-	defer rows.Close()
 
 	var departments []gin.H
-	for rows.Next() {
-		var id int
-		var parentID sql.NullInt64
-		var name string
-		if err := rows.Scan(&id, &parentID, &name); err != nil {
-			log.Printf("Error scanning department row: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to scan department row: %v", err)})
-			return
+	for _, d := range rows {
+		if !can(c.Request.Context(), auth.RoleViewer, d.ID) {
+			continue
 		}
 		departments = append(departments, gin.H{
-			"id":        id,
-			"parent_id": parentID.Int64,
-			"name":      name,
+			"id":        d.ID,
+			"parent_id": d.ParentID,
+			"name":      d.Name,
 		})
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating department rows: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to iterate department rows: %v", err)})
-		return
-	}
-
 	c.JSON(200, departments)
 }
 
 // Get specific department
 func getDepartment(c *gin.Context) {
-	id := c.Param("id")
-	var deptID int
-	var parentID sql.NullInt64
-	var name string
-	err := db.QueryRow("SELECT id, parent_id, name FROM departments WHERE id = ?", id).
-		Scan(&deptID, &parentID, &name)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	if !authorize(c, auth.RoleViewer, id) {
+		return
+	}
+	d, err := repo.GetDepartment(c.Request.Context(), id)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, store.ErrDepartmentNotFound) {
 			c.JSON(404, gin.H{"error": "Department not found"})
 		} else {
-			log.Printf("Error querying department: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Error querying department", "err", err)
 			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query department: %v", err)})
 		}
 		return
 	}
 	department := gin.H{
-		"id":        deptID,
-		"parent_id": parentID.Int64,
-		"name":      name,
+		"id":        d.ID,
+		"parent_id": d.ParentID,
+		"name":      d.Name,
 	}
 	c.JSON(200, department)
 }
 
-// Get employee list for specific department
+// Get employee list for specific department, following parent_id down the subtree
 func getDepartmentEmployees(c *gin.Context) {
-	deptID := c.Param("id")
-	
-	// Query for execution plan check
-	explainQuery := `
-		EXPLAIN FORMAT=JSON
-		WITH RECURSIVE subdepartments AS (
-			-- Base department
-			SELECT id, parent_id
-			FROM departments
-			WHERE id = ?
-			
-			UNION ALL
-			
-			-- Child departments
-			SELECT d.id, d.parent_id
-			FROM departments d
-			INNER JOIN subdepartments sd ON d.parent_id = sd.id
-		)
-		SELECT e.id, e.name, e.department_id, e.position, e.hire_date, e.employee_number, e.large_text
-		FROM employees e
-		INNER JOIN subdepartments sd ON e.department_id = sd.id
-		ORDER BY e.department_id, e.name
-	`
-	
-	// Print execution plan
-	rows, err := db.Query(explainQuery, deptID)
+	deptID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Printf("Error explaining query: %v", err)
-	} else {
-		defer rows.Close()
-		var explainResult string
-		for rows.Next() {
-			if err := rows.Scan(&explainResult); err != nil {
-				log.Printf("Error scanning explain result: %v", err)
-			} 
-		}
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	if !authorize(c, auth.RoleViewer, deptID) {
+		return
 	}
-	
-	// Execute actual query
-	query := `
-		WITH RECURSIVE subdepartments AS (
-			-- Base department
-			SELECT id, parent_id
-			FROM departments
-			WHERE id = ?
-			
-			UNION ALL
-			
-			-- Child departments
-			SELECT d.id, d.parent_id
-			FROM departments d
-			INNER JOIN subdepartments sd ON d.parent_id = sd.id
-		)
-		SELECT e.id, e.name, e.department_id, e.position, e.hire_date, e.employee_number, e.large_text
-		FROM employees e
-		INNER JOIN subdepartments sd ON e.department_id = sd.id
-		ORDER BY e.department_id, e.name
-	`
-	
-	rows, err = db.Query(query, deptID)
+
+	employees, err := repo.SubtreeEmployees(c.Request.Context(), deptID)
 	if err != nil {
-		log.Printf("Error querying department employees: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error querying department employees", "err", err)
 		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query department employees: %v", err)})
 		return
 	}
-	defer rows.Close()
 
-	var employees []gin.H
-	for rows.Next() {
-		var id, deptID int
-		var name, position, employeeNumber string
-		var hireDate string
-		var largeText sql.NullString
-		if err := rows.Scan(&id, &name, &deptID, &position, &hireDate, &employeeNumber, &largeText); err != nil {
-			log.Printf("Error scanning employee row: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to scan employee row: %v", err)})
-			return
+	// parent_id may lead out of the encoded range the grant covers
+	visible := []Employee{}
+	for _, emp := range employees {
+		if can(c.Request.Context(), auth.RoleViewer, emp.DepartmentID) {
+			visible = append(visible, emp)
 		}
-		employees = append(employees, gin.H{
-			"id":             id,
-			"name":           name,
-			"department_id":  deptID,
-			"position":       position,
-			"hire_date":      hireDate,
-			"employee_number": employeeNumber,
-			"large_text":     largeText.String,
-		})
-	}
-
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating employee rows: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to iterate employee rows: %v", err)})
-		return
 	}
-
-	c.JSON(200, employees)
+	c.JSON(200, visible)
 }
 
-const max_id_length int = 9
-const max_id_num int = 10000
-
 func createDepartment(c *gin.Context) {
 	var req DepartmentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -451,270 +382,301 @@ func createDepartment(c *gin.Context) {
 		return
 	}
 
-	dept := Department{
-		ID:   req.ID,
-		Name: req.Name,
-	}
-
+	parentID := 0
 	if req.ParentID != nil {
-		dept.ParentID = sql.NullInt64{
-			Int64: int64(*req.ParentID),
-			Valid: true,
-		}
-	} else {
-		dept.ParentID = sql.NullInt64{
-			Valid: false,
-		}
+		parentID = *req.ParentID
+	}
+	if !authorize(c, auth.RoleEditor, parentID) {
+		return
 	}
 
-	log.Printf("dept: %v", dept)
-
-	// Handle parent ID array
-	var parentIDs []interface{}
-	var newID int
-	if dept.ParentID.Valid && dept.ParentID.Int64 != 0 {
-		// Determine increment based on parent ID digits
-		increment := int64(1)
-		tempID := int(dept.ParentID.Int64)
-		strID := strconv.Itoa(tempID)  
-		log.Printf("strID: %v", strID)
-		
-		if strID[len(strID)-1] != '0' {
+	newID, err := allocateDepartment(c.Request.Context(), req.Name, parentID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error creating department", "err", err)
+		switch {
+		case errors.Is(err, idgen.ErrInvalidID), errors.Is(err, idgen.ErrLeaf):
 			c.JSON(400, gin.H{"error": "Failed to create department"})
-			return
+		case errors.Is(err, idgen.ErrNoFreeSlot):
+			c.JSON(400, gin.H{"error": "can't create department: every slot under the parent is taken"})
+		case errors.Is(err, errParentNotFound):
+			c.JSON(400, gin.H{"error": "Parent department not found"})
+		case errors.Is(err, store.ErrLockTimeout):
+			c.JSON(503, gin.H{"error": "Department allocation is busy, try again"})
+		default:
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create department: %v", err)})
 		}
+		return
+	}
 
-		for i := len(strID)- 1; i > 0 && strID[i-1] == '0'; i-- {
-			increment *= 10
-		}
-		
-		log.Printf("increment: %v", increment)
-
-		for i := 1; i < max_id_length; i++ {
-			calcId := dept.ParentID.Int64 + (int64(i) * increment)
-			parentIDs = append(parentIDs, calcId)
-		}
+	c.JSON(200, gin.H{
+		"message": "Department created successfully",
+		"id": newID,
+	})
+}
 
-		// Create placeholders for IN clause
-		placeholders := make([]string, len(parentIDs))
-		for i := range parentIDs {
-			placeholders[i] = "?"
-		}
+// Update department name, moving it when parent_id changes.
+// An omitted or null parent_id keeps the current parent; 0 moves the department to the root level.
+func updateDepartment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	var req DepartmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(400, gin.H{"error": "Name is required"})
+		return
+	}
+	if !authorize(c, auth.RoleEditor, id) {
+		return
+	}
 
-		// Execute query
-		query := fmt.Sprintf("SELECT id FROM departments WHERE id IN (%s) ORDER BY id", strings.Join(placeholders, ","))
-		rows, err := db.Query(query, parentIDs...)
-		if err != nil {
-			log.Printf("Error querying departments: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query departments: %v", err)})
-			return
+	ctx := c.Request.Context()
+	current, err := repo.GetDepartment(ctx, id)
+	if err != nil {
+		if errors.Is(err, store.ErrDepartmentNotFound) {
+			c.JSON(404, gin.H{"error": "Department not found"})
+		} else {
+			slog.ErrorContext(c.Request.Context(), "Error querying department", "err", err)
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query department: %v", err)})
 		}
-		defer rows.Close()
-
-		for i := 1; i < max_id_length; i++ {
-			var calcId int = int(dept.ParentID.Int64 + (int64(i) * increment))
-			var id int	
-			if !rows.Next() {
-				// If no more IDs to compare, use the last calculated ID
-				newID = calcId
-				break
-			}
-			err := rows.Scan(&id)
-			if err != nil {
-				log.Printf("Error scanning count: %v", err)
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to scan count: %v", err)})
-				return
-			}
+		return
+	}
 
-			// If calculated ID and queried ID are different, it means there's a gap in IDs
-			// Example: calculated ID 1100, queried ID 1100 OK
-			// Example: calculated ID 1300, queried ID 1400 means 1300 is available
-			log.Printf("calcId: %v, id: %v", calcId, id)
-			if calcId != id {
-				newID = calcId
-				break
-			}
-		}
-	}else{
-		// If parent ID is 0, query maximum ID
-		query := fmt.Sprintf("SELECT max(id) FROM departments")
-		rows, err := db.Query(query)
-		if err != nil {
-			log.Printf("Error querying departments: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query departments: %v", err)})
-			return
-		}
-		defer rows.Close()
-		var maxID int
-		if rows.Next() {
-			err := rows.Scan(&maxID)
-			if err != nil {
-				log.Printf("Error scanning max ID: %v", err)
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to scan max ID: %v", err)})
-				return
-			}
-		}
-		log.Printf("maxID: %v", maxID)
-		// if maxID = 2345 -> "2345"
-		stringID := strconv.Itoa(maxID)
-		// if maxID = 2345 -> "1000" -> 1000
-		increment, err := strconv.Atoi("1" + strings.Repeat("0", len(stringID)-1))
-		// if maxID = 2345 -> "2000" -> 2000
-		highestDigit, err := strconv.Atoi(string(stringID[0]) + strings.Repeat("0", len(stringID)-1))
-		// if maxID = 2345 -> 2000(highestDigit) + 1000(increment) = 3000
-		newID = increment + highestDigit
-		if err != nil {
-			log.Printf("Error converting max ID: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to convert max ID: %v", err)})
+	parentID := current.ParentID
+	if req.ParentID == nil || *req.ParentID == parentID {
+		if err := repo.RenameDepartment(ctx, id, req.Name); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Error updating department", "err", err)
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to update department: %v", err)})
 			return
 		}
-	}
-	log.Printf("newID: %v", newID)
-	if newID >= max_id_num || newID == 0 {
-		c.JSON(400, gin.H{"error": "can't create department"})
+		c.JSON(200, gin.H{
+			"id":        id,
+			"parent_id": parentID,
+			"name":      req.Name,
+		})
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO departments (id, name, parent_id) VALUES (?, ?, ?)", newID, dept.Name, dept.ParentID)
-	if err != nil {
-		log.Printf("Error creating department: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create department: %v", err)})
+	// Moving takes the admin role on both ends, as for the move endpoint
+	if !authorize(c, auth.RoleAdmin, id) || !authorize(c, auth.RoleAdmin, *req.ParentID) {
 		return
 	}
 
-	id, err := result.LastInsertId()
+	// The ID encodes the parent, so a new parent means a new ID for the whole subtree
+	mappings, err := moveDepartmentSubtree(ctx, id, *req.ParentID, func(tx store.Tx) error {
+		if err := tx.RenameDepartment(id, req.Name); err != nil {
+			return err
+		}
+		renamed := current
+		renamed.Name = req.Name
+		return tx.RecordEvent(store.AuditEvent{
+			Action: store.AuditDepartmentRename, DepartmentID: id, Before: store.Snapshot(current), After: store.Snapshot(renamed),
+		})
+	})
 	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get last insert ID: %v", err)})
+		slog.ErrorContext(c.Request.Context(), "Error moving department", "id", id, "parent_id", *req.ParentID, "err", err)
+		respondMoveError(c, err, *req.ParentID)
 		return
 	}
-
 	c.JSON(200, gin.H{
-		"message": "Department created successfully",
-		"id": id,
+		"id":        mappings[0].NewID,
+		"parent_id": *req.ParentID,
+		"name":      req.Name,
+		"mapping":   mappings,
 	})
 }
 
+// Page size used when pageSize is omitted, and the largest one accepted
+const defaultEmployeePageSize = 100
+const maxEmployeePageSize = 1000
+
 // Get employee list
+//
+// Query parameters:
+//   - page, pageSize: offset pagination (page starts at 1)
+//   - cursor: keyset pagination, returns rows after this id; only valid when sorting by id
+//   - department_id, position, hire_date_from, hire_date_to: filters
+//   - sort: column name, prefixed with "-" for descending (default "id")
+//   - include_large_text: set to true to return large_text
 func getEmployees(c *gin.Context) {
-	rows, err := db.Query("SELECT id, name, department_id, large_text FROM employees")
-	if err != nil {
-		log.Printf("Error querying employees: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query employees: %v", err)})
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(defaultEmployeePageSize)))
+	if err != nil || pageSize < 1 {
+		c.JSON(400, gin.H{"error": "pageSize must be a positive integer"})
+		return
+	}
+	if pageSize > maxEmployeePageSize {
+		pageSize = maxEmployeePageSize
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(400, gin.H{"error": "page must be a positive integer"})
+		return
+	}
+
+	sortParam := c.DefaultQuery("sort", "id")
+	query := store.EmployeeQuery{
+		Sort:             strings.TrimPrefix(sortParam, "-"),
+		Descending:       strings.HasPrefix(sortParam, "-"),
+		Limit:            pageSize,
+		Offset:           (page - 1) * pageSize,
+		Position:         c.Query("position"),
+		IncludeLargeText: c.Query("include_large_text") == "true",
+	}
+	if !store.EmployeeSortFields[query.Sort] {
+		c.JSON(400, gin.H{"error": "Invalid sort column " + sortParam})
 		return
 	}
-	defer rows.Close()
 
-	var employees []gin.H
-	for rows.Next() {
-		var id, deptID int
-		var name string
-		var largeText sql.NullString
-		if err := rows.Scan(&id, &name, &deptID, &largeText); err != nil {
-			log.Printf("Error scanning employee row: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to scan employee row: %v", err)})
+	if deptID := c.Query("department_id"); deptID != "" {
+		if query.DepartmentID, err = strconv.Atoi(deptID); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid department_id " + deptID})
 			return
 		}
-		employees = append(employees, gin.H{
-			"id":            id,
-			"name":          name,
-			"department_id": deptID,
-			"large_text":    largeText.String,
-		})
 	}
-
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating employee rows: %v", err)
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to iterate employee rows: %v", err)})
-		return
+	for _, bound := range []struct {
+		param string
+		value *string
+	}{{"hire_date_from", &query.HireDateFrom}, {"hire_date_to", &query.HireDateTo}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("%s must be a date like 2006-01-02", bound.param)})
+			return
+		}
+		*bound.value = value
 	}
 
-	c.JSON(200, employees)
-}
+	// Keyset mode continues after the cursor id instead of skipping rows
+	if cursor := c.Query("cursor"); cursor != "" {
+		cursorID, err := strconv.Atoi(cursor)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid cursor " + cursor})
+			return
+		}
+		if query.Sort != "id" {
+			c.JSON(400, gin.H{"error": "cursor can only be used when sorting by id"})
+			return
+		}
+		query.After = &cursorID
+	}
 
-func deleteDepartment(c *gin.Context) {
-	id := c.Param("id")
-	log.Printf("Deleting department with id: %v", id)
+	// Employees outside the caller's grants are left out, total included
+	query.Within = visibleRanges(c.Request.Context())
 
-	// 트랜잭션 시작
-	tx, err := db.Begin()
+	employees, total, err := repo.ListEmployees(c.Request.Context(), query)
 	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		c.JSON(500, gin.H{"error": "Failed to start transaction"})
+		slog.ErrorContext(c.Request.Context(), "Error querying employees", "err", err)
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query employees: %v", err)})
 		return
 	}
-	defer tx.Rollback() // 에러 발생시 롤백
 
-	// 부서가 존재하는지 확인
-	var exists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM departments WHERE id = ?)", id).Scan(&exists)
+	// The cursor is the last id of a full page, usable while sorting by id
+	var nextCursor *int
+	if query.Sort == "id" && len(employees) == pageSize {
+		nextCursor = &employees[len(employees)-1].ID
+	}
+
+	c.JSON(200, gin.H{
+		"employees":   employees,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"next_cursor": nextCursor,
+	})
+}
+
+func deleteDepartment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Printf("Error checking department existence: %v", err)
-		c.JSON(500, gin.H{"error": "Failed to check department existence"})
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
 		return
 	}
-
-	if !exists {
-		c.JSON(404, gin.H{"error": "Department not found"})
+	if !authorize(c, auth.RoleAdmin, id) {
 		return
 	}
+	slog.InfoContext(c.Request.Context(), "Deleting department", "id", id)
 
-	// 부서 삭제
-	result, err := tx.Exec("DELETE FROM departments WHERE id = ?", id)
+	// Child departments and employees are deleted with it, and can be restored with it
+	deleted, err := repo.DeleteDepartment(c.Request.Context(), id)
 	if err != nil {
-		log.Printf("Error deleting department: %v", err)
+		if errors.Is(err, store.ErrDepartmentNotFound) {
+			c.JSON(404, gin.H{"error": "Department not found"})
+			return
+		}
+		slog.ErrorContext(c.Request.Context(), "Error deleting department", "err", err)
 		c.JSON(500, gin.H{"error": "Failed to delete department"})
 		return
 	}
 
-	// 삭제된 행 수 확인
-	rowsAffected, err := result.RowsAffected()
+	// rows_affected counts the departments deleted, the department itself included
+	c.JSON(200, gin.H{
+		"message":       "Department and its employees deleted successfully",
+		"rows_affected": len(deleted.Departments),
+		"departments":   deleted.Departments,
+		"employees":     len(deleted.Employees),
+	})
+}
+
+// Restore a deleted department with the departments and employees deleted
+// along with it. Its ID is kept until ids.tombstone_quarantine is over.
+func restoreDepartment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-		c.JSON(500, gin.H{"error": "Failed to verify deletion"})
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
 		return
 	}
-
-	if rowsAffected == 0 {
-		c.JSON(404, gin.H{"error": "Department not found"})
+	if !authorize(c, auth.RoleAdmin, id) {
 		return
 	}
+	slog.InfoContext(c.Request.Context(), "Restoring department", "id", id)
 
-	// 트랜잭션 커밋
-	if err = tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		c.JSON(500, gin.H{"error": "Failed to commit transaction"})
+	restored, err := repo.RestoreDepartment(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, store.ErrDepartmentNotFound):
+		c.JSON(404, gin.H{"error": "Department not found"})
+		return
+	case errors.Is(err, store.ErrNotDeleted):
+		c.JSON(409, gin.H{"error": "Department is not deleted"})
+		return
+	case errors.Is(err, store.ErrParentDeleted):
+		c.JSON(409, gin.H{"error": "Parent department is deleted; restore it first"})
+		return
+	case err != nil:
+		slog.ErrorContext(c.Request.Context(), "Error restoring department", "err", err)
+		c.JSON(500, gin.H{"error": "Failed to restore department"})
 		return
 	}
 
 	c.JSON(200, gin.H{
-		"message": "Department and its employees deleted successfully",
-		"rows_affected": rowsAffected,
+		"message":     "Department restored successfully",
+		"departments": restored.Departments,
+		"employees":   len(restored.Employees),
 	})
 }
 
 // Get specific employee
 func getEmployee(c *gin.Context) {
-	id := c.Param("id")
-	var empID, deptID int
-	var name string
-	var largeText sql.NullString
-	err := db.QueryRow("SELECT id, name, department_id, large_text FROM employees WHERE id = ?", id).
-		Scan(&empID, &name, &deptID, &largeText)
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, gin.H{"error": "Employee not found"})
-		} else {
-			log.Printf("Error querying employee: %v", err)
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to query employee: %v", err)})
-		}
+		c.JSON(400, gin.H{"error": "Invalid employee ID"})
+		return
+	}
+	emp, ok := findVisibleEmployee(c, id)
+	if !ok {
 		return
 	}
 	employee := gin.H{
-		"id":            empID,
-		"name":          name,
-		"department_id": deptID,
-		"large_text":    largeText.String,
+		"id":            emp.ID,
+		"name":          emp.Name,
+		"department_id": emp.DepartmentID,
+		"large_text":    emp.LargeText,
 	}
 	c.JSON(200, employee)
 }
@@ -727,37 +689,14 @@ func GetEmployeesByDepartmentIDs(c *gin.Context) {
 		return
 	}
 
-	// Create placeholders for IN clause
-	placeholders := make([]string, len(departmentIDs))
-	args := make([]interface{}, len(departmentIDs))
-	for i, id := range departmentIDs {
-		placeholders[i] = "?"
-		args[i] = id
-	}
-
-	query := fmt.Sprintf(`
-		SELECT e.id, e.name, e.department_id, e.position, e.hire_date, e.employee_number, e.large_text
-		FROM employees e
-		WHERE e.department_id IN (%s)
-		ORDER BY e.department_id, e.id
-	`, strings.Join(placeholders, ","))
+	// Departments the caller cannot see are dropped rather than refused
+	departmentIDs = visibleIDs(c.Request.Context(), departmentIDs)
 
-	rows, err := db.Query(query, args...)
+	employees, err := repo.EmployeesByDepartments(c.Request.Context(), departmentIDs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var employees []Employee
-	for rows.Next() {
-		var emp Employee
-		if err := rows.Scan(&emp.ID, &emp.Name, &emp.DepartmentID, &emp.Position, &emp.HireDate, &emp.EmployeeNumber, &emp.LargeText); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		employees = append(employees, emp)
-	}
 
 	c.JSON(http.StatusOK, employees)
-} 
\ No newline at end of file
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// 1000 -> 900 -> 890 -> 889, 1000 -> 800, and a second root 2000
+var testTree = []store.Department{
+	{ID: 1000, Name: "Head Office"},
+	{ID: 900, Name: "Sales", ParentID: 1000},
+	{ID: 890, Name: "Domestic", ParentID: 900},
+	{ID: 889, Name: "Seoul", ParentID: 890},
+	{ID: 800, Name: "Legal", ParentID: 1000},
+	{ID: 2000, Name: "Factory"},
+}
+
+// newTestServer points repo at an in-memory store holding departments and
+// returns the API router
+func newTestServer(t *testing.T, departments ...store.Department) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	cfg = config.Default()
+	encoding = idgen.Default
+	repo = instrumentRepository(newMemoryRepo(t, departments...))
+	authenticator = nil
+	return newRouter()
+}
+
+// serve sends a request with an optional JSON body and returns the recorded response
+func serve(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// expect checks the status of a response and decodes its JSON body into v, unless v is nil
+func expect(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("decode %s: %v", w.Body, err)
+		}
+	}
+}
+
+func departmentIDs(t *testing.T) []int {
+	t.Helper()
+	departments, err := repo.ListDepartments(context.Background())
+	if err != nil {
+		t.Fatalf("list departments: %v", err)
+	}
+	ids := []int{}
+	for _, d := range departments {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+func TestHealth(t *testing.T) {
+	r := newTestServer(t)
+	var body map[string]string
+	expect(t, serve(r, http.MethodGet, "/health", ""), 200, &body)
+	if body["status"] != "ok" {
+		t.Errorf("status = %q", body["status"])
+	}
+
+	w := serve(r, http.MethodOptions, "/api/departments", "")
+	if w.Code != 204 || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("preflight: status %d, headers %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSAllowlist(t *testing.T) {
+	r := newTestServer(t)
+	cfg.Server.CORSOrigins = []string{"https://app.example.com", "http://localhost:3000/"}
+
+	for origin, want := range map[string]string{
+		"https://app.example.com": "https://app.example.com",
+		"http://localhost:3000":   "http://localhost:3000",
+		"https://evil.example":    "",
+		"":                        "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %q: Access-Control-Allow-Origin = %q, want %q", origin, got, want)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("origin %q: Vary = %q", origin, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestGetDepartments(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var list []store.Department
+	expect(t, serve(r, http.MethodGet, "/api/departments", ""), 200, &list)
+	if len(list) != len(testTree) || list[0].ID != 800 || list[5].ID != 2000 {
+		t.Errorf("departments = %+v", list)
+	}
+
+	var d store.Department
+	expect(t, serve(r, http.MethodGet, "/api/departments/900", ""), 200, &d)
+	if d != (store.Department{ID: 900, Name: "Sales", ParentID: 1000}) {
+		t.Errorf("department 900 = %+v", d)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/700", ""), 404, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/abc", ""), 400, nil)
+}
+
+func TestDepartmentTrees(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	type node struct {
+		ID    int `json:"id"`
+		Level int `json:"level"`
+	}
+	want := []node{{889, 2}, {890, 1}, {900, 0}}
+	for _, path := range []string{"/api/departments/tree-recursive?parentId=900", "/api/departments/tree-comparison?id=900"} {
+		var nodes []node
+		expect(t, serve(r, http.MethodGet, path, ""), 200, &nodes)
+		if !reflect.DeepEqual(nodes, want) {
+			t.Errorf("%s = %+v, want %+v", path, nodes, want)
+		}
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/tree-recursive", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/tree-comparison?id=x", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/tree-comparison?id=-5", ""), 400, nil)
+
+	var ancestors struct {
+		Path    []node `json:"path"`
+		Missing []int  `json:"missing"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/889/ancestors?verify=true", ""), 200, &ancestors)
+	if len(ancestors.Path) != 4 || ancestors.Path[0].ID != 1000 || ancestors.Path[3].Level != 3 || len(ancestors.Missing) != 0 {
+		t.Errorf("ancestors of 889 = %+v", ancestors)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/888/ancestors", ""), 404, nil)
+
+	var bench struct {
+		Roots      []int         `json:"roots"`
+		Results    []BenchResult `json:"results"`
+		Mismatched []int         `json:"mismatched_roots"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/bench/tree?iterations=2&payload=3", ""), 200, &bench)
+	if !reflect.DeepEqual(bench.Roots, []int{1000, 2000}) || len(bench.Results) != len(treeStrategies) || len(bench.Mismatched) != 0 {
+		t.Errorf("bench = %+v", bench)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/bench/tree?iterations=0", ""), 400, nil)
+}
+
+func TestDepartmentCapacity(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var capacity struct {
+		Level  int          `json:"level"`
+		Slots  idgen.Usage  `json:"slots"`
+		Levels []LevelUsage `json:"levels"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/1000/capacity", ""), 200, &capacity)
+	if capacity.Level != 0 || capacity.Slots.Used != 2 || len(capacity.Levels) != 3 {
+		t.Errorf("capacity of 1000 = %+v", capacity)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/700/capacity", ""), 404, nil)
+
+	var tree struct {
+		NearExhaustion []idgen.Usage `json:"near_exhaustion"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/capacity?threshold=0.2", ""), 200, &tree)
+	if len(tree.NearExhaustion) != 2 || tree.NearExhaustion[1].ID != 1000 {
+		t.Errorf("near exhaustion at 0.2 = %+v", tree.NearExhaustion)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/capacity?threshold=2", ""), 400, nil)
+}
+
+func TestCreateDepartment(t *testing.T) {
+	create := func(t *testing.T, r *gin.Engine, body string, status int) int {
+		t.Helper()
+		var resp struct {
+			ID    int    `json:"id"`
+			Error string `json:"error"`
+		}
+		expect(t, serve(r, http.MethodPost, "/api/departments", body), status, &resp)
+		return resp.ID
+	}
+
+	t.Run("first free child slot", func(t *testing.T) {
+		r := newTestServer(t, testTree...)
+		if id := create(t, r, `{"name":"Marketing","parent_id":1000}`, 200); id != 700 {
+			t.Errorf("id = %d, want 700", id)
+		}
+		if id := create(t, r, `{"name":"Busan","parent_id":890}`, 200); id != 888 {
+			t.Errorf("id = %d, want 888", id)
+		}
+	})
+
+	t.Run("full parent", func(t *testing.T) {
+		r := newTestServer(t, testTree...)
+		for i := 0; i < encoding.Slots(2)-1; i++ {
+			create(t, r, fmt.Sprintf(`{"name":"Branch %d","parent_id":890}`, i), 200)
+		}
+		create(t, r, `{"name":"One too many","parent_id":890}`, 400)
+		if got := departmentIDs(t); len(got) != len(testTree)+encoding.Slots(2)-1 {
+			t.Errorf("departments after a rejected insert = %v", got)
+		}
+	})
+
+	t.Run("root after max id", func(t *testing.T) {
+		// Roots are not packed: a gap below the largest root stays empty
+		r := newTestServer(t, store.Department{ID: 1000, Name: "A"}, store.Department{ID: 5000, Name: "B"})
+		if id := create(t, r, `{"name":"Next"}`, 200); id != 6000 {
+			t.Errorf("id = %d, want 6000", id)
+		}
+		if id := create(t, r, `{"name":"Explicit null","parent_id":null}`, 200); id != 7000 {
+			t.Errorf("id = %d, want 7000", id)
+		}
+	})
+
+	t.Run("no root after the last slot", func(t *testing.T) {
+		r := newTestServer(t, store.Department{ID: 9000, Name: "Last"})
+		create(t, r, `{"name":"Beyond"}`, 400)
+	})
+
+	t.Run("empty table", func(t *testing.T) {
+		r := newTestServer(t)
+		if id := create(t, r, `{"name":"First"}`, 200); id != 1000 {
+			t.Errorf("id = %d, want 1000", id)
+		}
+	})
+
+	t.Run("parent not ending in 0", func(t *testing.T) {
+		// 889 is on the last level, so it has no child slots
+		r := newTestServer(t, testTree...)
+		create(t, r, `{"name":"Below a leaf","parent_id":889}`, 400)
+		create(t, r, `{"name":"Below a leaf","parent_id":1234}`, 400)
+		if got := departmentIDs(t); len(got) != len(testTree) {
+			t.Errorf("departments = %v", got)
+		}
+	})
+
+	t.Run("missing parent", func(t *testing.T) {
+		r := newTestServer(t, testTree...)
+		create(t, r, `{"name":"Orphan","parent_id":700}`, 400)
+		create(t, r, `{"name":`, 400)
+	})
+}
+
+func TestUpdateDepartment(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var renamed store.Department
+	expect(t, serve(r, http.MethodPut, "/api/departments/900", `{"name":"Sales & Marketing"}`), 200, &renamed)
+	if renamed != (store.Department{ID: 900, Name: "Sales & Marketing", ParentID: 1000}) {
+		t.Errorf("renamed = %+v", renamed)
+	}
+
+	var moved struct {
+		ID      int             `json:"id"`
+		Mapping []idgen.Mapping `json:"mapping"`
+	}
+	expect(t, serve(r, http.MethodPut, "/api/departments/890", `{"name":"Overseas","parent_id":2000}`), 200, &moved)
+	if moved.ID != 1900 || len(moved.Mapping) != 2 {
+		t.Errorf("moved = %+v", moved)
+	}
+	if d, err := repo.GetDepartment(context.Background(), 1900); err != nil || d.Name != "Overseas" || d.ParentID != 2000 {
+		t.Errorf("department 1900 = %+v, %v", d, err)
+	}
+
+	expect(t, serve(r, http.MethodPut, "/api/departments/700", `{"name":"Nobody"}`), 404, nil)
+	expect(t, serve(r, http.MethodPut, "/api/departments/900", `{"name":" "}`), 400, nil)
+}
+
+func TestMoveDepartment(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	emp, err := repo.CreateEmployee(context.Background(), Employee{Name: "Kim", DepartmentID: 889, Position: "Staff", HireDate: "2020-01-01", EmployeeNumber: "E1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var moved struct {
+		ID      int             `json:"id"`
+		Mapping []idgen.Mapping `json:"mapping"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/900/move", `{"new_parent_id":2000}`), 200, &moved)
+	want := []idgen.Mapping{{OldID: 900, NewID: 1900}, {OldID: 890, NewID: 1890}, {OldID: 889, NewID: 1889}}
+	if moved.ID != 1900 || !reflect.DeepEqual(moved.Mapping, want) {
+		t.Errorf("moved = %+v", moved)
+	}
+	if got, _ := repo.GetEmployee(context.Background(), emp.ID); got.DepartmentID != 1889 {
+		t.Errorf("employee is in %d, want 1889", got.DepartmentID)
+	}
+
+	expect(t, serve(r, http.MethodPost, "/api/departments/1900/move", `{"new_parent_id":1890}`), 400, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/1900/move", `{"new_parent_id":2000}`), 400, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/700/move", `{"new_parent_id":2000}`), 404, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/800/move", `{}`), 400, nil)
+}
+
+func TestCompactDepartment(t *testing.T) {
+	r := newTestServer(t,
+		store.Department{ID: 1000, Name: "Head Office"},
+		store.Department{ID: 800, Name: "Legal", ParentID: 1000},
+		store.Department{ID: 600, Name: "Planning", ParentID: 1000},
+	)
+
+	var resp struct {
+		DryRun  bool            `json:"dry_run"`
+		Mapping []idgen.Mapping `json:"mapping"`
+	}
+	want := []idgen.Mapping{{OldID: 800, NewID: 900}, {OldID: 600, NewID: 800}}
+	expect(t, serve(r, http.MethodPost, "/api/departments/1000/compact?dry_run=true", ""), 200, &resp)
+	if !resp.DryRun || !reflect.DeepEqual(resp.Mapping, want) {
+		t.Errorf("dry run = %+v", resp)
+	}
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{600, 800, 1000}) {
+		t.Errorf("departments after a dry run = %v", got)
+	}
+
+	expect(t, serve(r, http.MethodPost, "/api/departments/1000/compact", ""), 200, &resp)
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{800, 900, 1000}) {
+		t.Errorf("departments after compacting = %v", got)
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/2000/compact", ""), 404, nil)
+}
+
+func TestDeleteDepartment(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	emp, err := repo.CreateEmployee(context.Background(), Employee{Name: "Kim", DepartmentID: 889, Position: "Staff", HireDate: "2020-01-01", EmployeeNumber: "E1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted struct {
+		RowsAffected *int               `json:"rows_affected"`
+		Departments  []store.Department `json:"departments"`
+		Employees    int                `json:"employees"`
+	}
+	expect(t, serve(r, http.MethodDelete, "/api/departments/900", ""), 200, &deleted)
+	// 900, 890 and 889 with the employee of 889
+	if deleted.RowsAffected == nil || *deleted.RowsAffected != 3 || len(deleted.Departments) != 3 || deleted.Employees != 1 {
+		t.Errorf("delete = %+v", deleted)
+	}
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{800, 1000, 2000}) {
+		t.Errorf("departments after delete = %v", got)
+	}
+	expect(t, serve(r, http.MethodGet, fmt.Sprintf("/api/employees/%d", emp.ID), ""), 404, nil)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/900", ""), 404, nil)
+}
+
+func TestImportExportDepartments(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var imported struct {
+		Mapping []ImportedDepartment `json:"mapping"`
+	}
+	body := `[
+		{"external_key":"ops","name":"Operations"},
+		{"external_key":"ops-it","parent_external_key":"ops","name":"IT"}
+	]`
+	expect(t, serve(r, http.MethodPost, "/api/departments/import", body), 200, &imported)
+	want := []ImportedDepartment{{ExternalKey: "ops", ID: 3000}, {ExternalKey: "ops-it", ID: 2900}}
+	if !reflect.DeepEqual(imported.Mapping, want) {
+		t.Errorf("mapping = %+v, want %+v", imported.Mapping, want)
+	}
+	// The external keys are taken now
+	expect(t, serve(r, http.MethodPost, "/api/departments/import", body), 400, nil)
+
+	csvBody := "external_key,parent_external_key,name\nqa,ops,Quality\n"
+	req := httptest.NewRequest(http.MethodPost, "/api/departments/import", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	expect(t, w, 200, &imported)
+	if len(imported.Mapping) != 1 || imported.Mapping[0].ID != 2800 {
+		t.Errorf("csv mapping = %+v", imported.Mapping)
+	}
+
+	var forest []*ExportNode
+	expect(t, serve(r, http.MethodGet, "/api/departments/export?root=3000", ""), 200, &forest)
+	if len(forest) != 1 || forest[0].ID != 3000 || len(forest[0].Children) != 2 {
+		t.Errorf("export of 3000 = %+v", forest)
+	}
+	w = serve(r, http.MethodGet, "/api/departments/export?format=mermaid", "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "d3000 --> d2900") {
+		t.Errorf("mermaid export: status %d\n%s", w.Code, w.Body)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/export?format=xml", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/export?root=700", ""), 404, nil)
+
+	// The key of a deleted department is kept, but nothing can be imported under it
+	expect(t, serve(r, http.MethodDelete, "/api/departments/2900", ""), 200, nil)
+	w = serve(r, http.MethodPost, "/api/departments/import", `[{"external_key":"ops-it-help","parent_external_key":"ops-it","name":"Helpdesk"}]`)
+	expect(t, w, 400, nil)
+	if !strings.Contains(w.Body.String(), "parent department not found") {
+		t.Errorf("import under a deleted department: %s", w.Body)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	// 880 belongs under 900 but points at 1000
+	r := newTestServer(t, append(testTree[:len(testTree):len(testTree)], store.Department{ID: 880, Name: "Misplaced", ParentID: 1000})...)
+
+	var report IntegrityReport
+	expect(t, serve(r, http.MethodGet, "/api/admin/integrity", ""), 200, &report)
+	if report.Checked != len(testTree)+1 || len(report.Issues) != 1 || report.Issues[0].ID != 880 || report.Fixed {
+		t.Errorf("report = %+v", report)
+	}
+
+	expect(t, serve(r, http.MethodPost, "/api/admin/integrity/fix", ""), 200, &report)
+	if !report.Fixed || !reflect.DeepEqual(report.Mapping, []idgen.Mapping{{OldID: 880, NewID: 700}}) {
+		t.Errorf("fix = %+v", report)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/admin/integrity", ""), 200, &report)
+	if len(report.Issues) != 0 {
+		t.Errorf("issues after fix = %+v", report.Issues)
+	}
+}
+
+func TestEmployeeRoutes(t *testing.T) {
+	r := newTestServer(t, testTree...)
+
+	var created Employee
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Kim","department_id":889,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1","large_text":"notes"}`), 200, &created)
+	if created.ID == 0 || created.HireDate != "2021-03-01T00:00:00Z" {
+		t.Errorf("created = %+v", created)
+	}
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Lee","department_id":900,"position":"Staff","hire_date":"2022-07-15T00:00:00Z","employee_number":"E2"}`), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Park","department_id":900,"position":"Staff","hire_date":"2022-07-15","employee_number":"E1"}`), 409, nil)
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Park","department_id":700,"position":"Staff","hire_date":"2022-07-15","employee_number":"E3"}`), 400, nil)
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Park","department_id":900,"position":"Staff","hire_date":"yesterday","employee_number":"E3"}`), 400, nil)
+
+	path := fmt.Sprintf("/api/employees/%d", created.ID)
+	var got map[string]interface{}
+	expect(t, serve(r, http.MethodGet, path, ""), 200, &got)
+	if got["name"] != "Kim" || got["large_text"] != "notes" {
+		t.Errorf("employee = %v", got)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/employees/999", ""), 404, nil)
+
+	var updated Employee
+	expect(t, serve(r, http.MethodPut, path,
+		`{"name":"Kim","department_id":890,"position":"Director","hire_date":"2021-03-01T00:00:00Z","employee_number":"E1"}`), 200, &updated)
+	if updated.DepartmentID != 890 || updated.Position != "Director" || updated.LargeText != "notes" {
+		t.Errorf("updated = %+v", updated)
+	}
+	expect(t, serve(r, http.MethodPut, "/api/employees/999",
+		`{"name":"X","department_id":890,"position":"X","hire_date":"2021-03-01","employee_number":"E9"}`), 404, nil)
+
+	var page struct {
+		Employees  []Employee `json:"employees"`
+		Total      int        `json:"total"`
+		NextCursor *int       `json:"next_cursor"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/employees?pageSize=1", ""), 200, &page)
+	if page.Total != 2 || len(page.Employees) != 1 || page.NextCursor == nil || page.Employees[0].LargeText != "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	expect(t, serve(r, http.MethodGet, fmt.Sprintf("/api/employees?pageSize=1&cursor=%d", *page.NextCursor), ""), 200, &page)
+	if len(page.Employees) != 1 || page.Employees[0].Name != "Lee" {
+		t.Errorf("second page = %+v", page)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/employees?position=Director&sort=-hire_date", ""), 200, &page)
+	if page.Total != 1 || page.Employees[0].ID != created.ID {
+		t.Errorf("directors = %+v", page)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/employees?sort=large_text", ""), 400, nil)
+	expect(t, serve(r, http.MethodGet, "/api/employees?sort=name&cursor=1", ""), 400, nil)
+
+	var employees []Employee
+	expect(t, serve(r, http.MethodGet, "/api/departments/900/employees", ""), 200, &employees)
+	if len(employees) != 2 || employees[0].Name != "Kim" {
+		t.Errorf("employees under 900 = %+v", employees)
+	}
+	expect(t, serve(r, http.MethodPost, "/api/employees/by-departments", `[900]`), 200, &employees)
+	if len(employees) != 1 || employees[0].Name != "Lee" {
+		t.Errorf("employees of 900 = %+v", employees)
+	}
+	expect(t, serve(r, http.MethodPost, "/api/employees/by-departments", `{}`), 400, nil)
+
+	var deleted struct {
+		ID int `json:"id"`
+	}
+	expect(t, serve(r, http.MethodDelete, path, ""), 200, &deleted)
+	if deleted.ID != created.ID {
+		t.Errorf("deleted id = %d, want %d", deleted.ID, created.ID)
+	}
+	expect(t, serve(r, http.MethodDelete, path, ""), 404, nil)
+}
+
+// conflictingRepository makes the first department insert fail as if another writer took the ID
+type conflictingRepository struct {
+	store.Repository
+	conflicts int
+}
+
+func (r *conflictingRepository) Allocate(ctx context.Context, parentID int, fn func(tx store.Tx) error) error {
+	return r.Repository.Allocate(ctx, parentID, func(tx store.Tx) error {
+		return fn(conflictingTx{Tx: tx, repo: r})
+	})
+}
+
+type conflictingTx struct {
+	store.Tx
+	repo *conflictingRepository
+}
+
+func (t conflictingTx) InsertDepartment(d store.Department) error {
+	if t.repo.conflicts > 0 {
+		t.repo.conflicts--
+		return fmt.Errorf("%w: department %d", store.ErrDuplicate, d.ID)
+	}
+	return t.Tx.InsertDepartment(d)
+}
+
+func TestMetrics(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	repo = &conflictingRepository{Repository: repo, conflicts: 1}
+
+	attempts := testutil.ToFloat64(allocationAttempts)
+	conflicts := testutil.ToFloat64(allocationConflicts)
+	retries := testutil.ToFloat64(allocationRetries)
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Marketing","parent_id":1000}`), 200, nil)
+	if got := testutil.ToFloat64(allocationAttempts) - attempts; got != 2 {
+		t.Errorf("allocation attempts = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(allocationConflicts) - conflicts; got != 1 {
+		t.Errorf("allocation conflicts = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(allocationRetries) - retries; got != 1 {
+		t.Errorf("allocation retries = %v, want 1", got)
+	}
+
+	expect(t, serve(r, http.MethodGet, "/api/departments/900", ""), 200, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/123", ""), 404, nil)
+
+	w := serve(r, http.MethodGet, "/metrics", "")
+	if w.Code != 200 {
+		t.Fatalf("status %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`http_request_duration_seconds_count{method="GET",route="/api/departments/:id",status="200"}`,
+		`http_request_duration_seconds_count{method="GET",route="/api/departments/:id",status="404"}`,
+		`db_query_duration_seconds_count{query="get_department",result="not_found"}`,
+		`db_query_duration_seconds_count{query="allocate",result="error"}`,
+		`db_query_duration_seconds_count{query="allocate",result="ok"}`,
+		`department_slots_used{level="1"} 3`,
+		`department_slots_capacity{level="0"} 9`,
+		`department_slots_utilization_ratio{level="3"} 0.1111111111111111`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics has no %s", want)
+		}
+	}
+}
+
+// captureLogs sends the default logger to a buffer at debug level for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buf, config.Log{Level: "debug", Format: "json"}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logRecords decodes JSON log lines
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestID(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	logs := captureLogs(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/departments", strings.NewReader(`{"name":"Marketing","parent_id":1000}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, "trace-42")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	expect(t, w, 200, nil)
+	if got := w.Header().Get(requestIDHeader); got != "trace-42" {
+		t.Errorf("%s = %q, want the caller's ID", requestIDHeader, got)
+	}
+
+	// Every line logged while serving the request carries its ID
+	seen := map[string]bool{}
+	for _, record := range logRecords(t, logs) {
+		if record["request_id"] != "trace-42" {
+			t.Errorf("record without the request ID: %v", record)
+		}
+		seen[fmt.Sprint(record["msg"])] = true
+		if record["msg"] == "request" && (record["route"] != "/api/departments" || record["status"] != 200.0) {
+			t.Errorf("access log = %v", record)
+		}
+	}
+	for _, msg := range []string{"request", "Query", "Allocating department"} {
+		if !seen[msg] {
+			t.Errorf("no %q record in:\n%s", msg, logs)
+		}
+	}
+
+	// Missing or unsafe IDs are replaced by a generated one
+	for _, id := range []string{"", "bad id\n", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set(requestIDHeader, id)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get(requestIDHeader); len(got) != 32 || got == id {
+			t.Errorf("%s for %q = %q, want a generated ID", requestIDHeader, id, got)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, config.Default().Log)
+	logger.Debug("Allocating department")
+	logger.Info("Deleting department", "id", 900)
+	if strings.Contains(buf.String(), "Allocating") || !strings.Contains(buf.String(), `"id":900`) {
+		t.Errorf("info logger wrote:\n%s", &buf)
+	}
+
+	buf.Reset()
+	logger = newLogger(&buf, config.Log{Level: "warn", Format: "text"})
+	logger.InfoContext(withRequestID(context.Background(), "r1"), "Deleting department")
+	logger.WarnContext(withRequestID(context.Background(), "r2"), "Department ID conflict, retrying")
+	if got := buf.String(); strings.Contains(got, "Deleting") || !strings.Contains(got, "request_id=r2") {
+		t.Errorf("warn logger wrote:\n%s", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"tree-table-idgenerator/auth"
+)
+
+// How long a scrape may spend loading departments for the slot gauges
+const slotMetricsTimeout = 5 * time.Second
+
+// metricsRegistry holds everything served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of API requests by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of repository calls by query name and result (ok, not_found or error).",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 10},
+	}, []string{"query", "result"})
+
+	allocationAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "department_allocation_attempts_total",
+		Help: "Transactions started to allocate a department ID.",
+	})
+	allocationConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "department_allocation_conflicts_total",
+		Help: "Allocations whose insert collided with an ID taken by another writer.",
+	})
+	allocationRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "department_allocation_retries_total",
+		Help: "Allocations retried after a conflict.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestDuration,
+		queryDuration,
+		allocationAttempts,
+		allocationConflicts,
+		allocationRetries,
+		slotCollector{},
+	)
+}
+
+// metricsHandler serves the registry in the Prometheus text format to
+// callers viewing the whole tree, since the gauges cover every department
+func metricsHandler() gin.HandlerFunc {
+	h := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if !authorize(c, auth.RoleViewer, 0) {
+			return
+		}
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// metricsMiddleware records the latency of every request under its route
+// pattern, so /departments/900 and /departments/800 share a series.
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	requestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+var (
+	slotsCapacityDesc = prometheus.NewDesc("department_slots_capacity",
+		"Child slots of the departments one level up, by level of the children.", []string{"level"}, nil)
+	slotsUsedDesc = prometheus.NewDesc("department_slots_used",
+		"Child slots in use, by level of the children.", []string{"level"}, nil)
+	slotsUtilizationDesc = prometheus.NewDesc("department_slots_utilization_ratio",
+		"Share of the child slots in use, by level of the children.", []string{"level"}, nil)
+)
+
+// slotCollector reports slot utilization per level. It reads the tree at
+// scrape time, so the gauges cannot drift from the table.
+type slotCollector struct{}
+
+func (slotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- slotsCapacityDesc
+	ch <- slotsUsedDesc
+	ch <- slotsUtilizationDesc
+}
+
+func (slotCollector) Collect(ch chan<- prometheus.Metric) {
+	if repo == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), slotMetricsTimeout)
+	defer cancel()
+	usages, err := treeSlotUsages(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error collecting slot metrics", "err", err)
+		return
+	}
+	for _, l := range groupByLevel(usages) {
+		level := strconv.Itoa(l.Level)
+		ratio := 0.0
+		if l.Capacity > 0 {
+			ratio = float64(l.Used) / float64(l.Capacity)
+		}
+		ch <- prometheus.MustNewConstMetric(slotsCapacityDesc, prometheus.GaugeValue, float64(l.Capacity), level)
+		ch <- prometheus.MustNewConstMetric(slotsUsedDesc, prometheus.GaugeValue, float64(l.Used), level)
+		ch <- prometheus.MustNewConstMetric(slotsUtilizationDesc, prometheus.GaugeValue, ratio, level)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/auth"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+var errMoveIntoSubtree = errors.New("cannot move a department under itself or its descendants")
+var errMoveSameParent = errors.New("department is already under that parent")
+var errMoveDeletedDescendants = errors.New("departments deleted below it still hold their IDs; restore them or wait until they are purged")
+
+type MoveDepartmentRequest struct {
+	NewParentID *int `json:"new_parent_id" binding:"required"` // 0 moves the department to the root level
+}
+
+// Move a department and its subtree under a new parent
+func moveDepartment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid department ID"})
+		return
+	}
+	var req MoveDepartmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !authorize(c, auth.RoleAdmin, id) || !authorize(c, auth.RoleAdmin, *req.NewParentID) {
+		return
+	}
+
+	mappings, err := moveDepartmentSubtree(c.Request.Context(), id, *req.NewParentID, nil)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error moving department", "id", id, "parent_id", *req.NewParentID, "err", err)
+		respondMoveError(c, err, *req.NewParentID)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Department moved successfully",
+		"id":      mappings[0].NewID,
+		"mapping": mappings,
+	})
+}
+
+// respondMoveError maps an error from moveDepartmentSubtree to a response
+func respondMoveError(c *gin.Context, err error, newParentID int) {
+	switch {
+	case errors.Is(err, store.ErrDepartmentNotFound):
+		c.JSON(404, gin.H{"error": "Department not found"})
+	case errors.Is(err, errParentNotFound):
+		c.JSON(400, gin.H{"error": "Parent department not found"})
+	case errors.Is(err, errMoveIntoSubtree), errors.Is(err, errMoveSameParent):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, errMoveDeletedDescendants):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, idgen.ErrInvalidID), errors.Is(err, idgen.ErrLeaf),
+		errors.Is(err, idgen.ErrNoFreeSlot), errors.Is(err, idgen.ErrDoesNotFit):
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Department does not fit under %d: %v", newParentID, err)})
+	case errors.Is(err, store.ErrLockTimeout):
+		c.JSON(503, gin.H{"error": "Department allocation is busy, try again"})
+	default:
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to move department: %v", err)})
+	}
+}
+
+// moveDepartmentSubtree renumbers id and its descendants into the next free
+// slot under newParentID and returns the old->new mapping, the moved
+// department first. If before is not nil it runs in the same transaction,
+// after the subtree is locked and before it is renumbered. A subtree holding
+// departments deleted within the quarantine cannot move.
+func moveDepartmentSubtree(ctx context.Context, id, newParentID int, before func(tx store.Tx) error) ([]idgen.Mapping, error) {
+	oldParentID, err := encoding.Parent(id)
+	if err != nil {
+		return nil, err
+	}
+	if newParentID == oldParentID {
+		return nil, errMoveSameParent
+	}
+	if encoding.IsDescendant(id, newParentID) {
+		return nil, errMoveIntoSubtree
+	}
+	subtree, err := encoding.Descendants(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []idgen.Mapping
+	err = repo.Allocate(ctx, newParentID, func(tx store.Tx) error {
+		if err := purgeTombstones(ctx, tx, subtree); err != nil {
+			return err
+		}
+		ids, err := lockDepartmentRange(tx, subtree)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 || ids[0] != id {
+			return store.ErrDepartmentNotFound
+		}
+		// A deleted department still holds its slots
+		if err := tx.LockDepartment(id); err != nil {
+			return err
+		}
+		// Renumbering would give tombstones new IDs and free the quarantined
+		// ones, and leaving them behind would orphan them under a free slot
+		deleted, err := tx.DeletedIDs(subtree)
+		if err != nil {
+			return err
+		}
+		if len(deleted) > 0 {
+			return fmt.Errorf("%w: %v", errMoveDeletedDescendants, deleted)
+		}
+		if before != nil {
+			if err := before(tx); err != nil {
+				return err
+			}
+		}
+
+		newID, err := nextSlot(ctx, tx, newParentID)
+		if err != nil {
+			return err
+		}
+		if mappings, err = encoding.Rebase(ids, id, newID); err != nil {
+			return err
+		}
+		if err := tx.Renumber(mappings); err != nil {
+			return err
+		}
+		return tx.RecordEvent(store.AuditEvent{
+			Action:       store.AuditDepartmentMove,
+			DepartmentID: id,
+			Before:       store.Snapshot(map[string]interface{}{"id": id, "parent_id": oldParentID}),
+			After:        store.Snapshot(map[string]interface{}{"id": newID, "parent_id": newParentID, "mapping": mappings}),
+		})
+	})
+	return mappings, err
+}
+
+// lockDepartmentRange locks every department in r and returns their IDs,
+// the subtree root first for the descending layout and ascending otherwise.
+func lockDepartmentRange(tx store.Tx, r idgen.Range) ([]int, error) {
+	ids, err := tx.LockRange(r)
+	if err != nil {
+		return nil, err
+	}
+	if encoding.Layout == idgen.Descending {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	return ids, nil
+}
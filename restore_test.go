@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+func TestRestoreDepartment(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	expect(t, serve(r, http.MethodPost, "/api/employees",
+		`{"name":"Kim","department_id":889,"position":"Manager","hire_date":"2021-03-01","employee_number":"E1"}`), 200, nil)
+
+	expect(t, serve(r, http.MethodDelete, "/api/departments/900", ""), 200, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/889", ""), 404, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/890/move", `{"new_parent_id":2000}`), 404, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/889/restore", ""), 409, nil)
+
+	var restored struct {
+		Departments []store.Department `json:"departments"`
+		Employees   int                `json:"employees"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/900/restore", ""), 200, &restored)
+	if len(restored.Departments) != 3 || restored.Employees != 1 {
+		t.Errorf("restored = %+v", restored)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/889", ""), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/900/restore", ""), 409, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/1234/restore", ""), 404, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/x/restore", ""), 400, nil)
+}
+
+func TestTombstoneQuarantine(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	var created struct {
+		ID int `json:"id"`
+	}
+
+	// Within the quarantine the slot of 800 stays taken
+	expect(t, serve(r, http.MethodDelete, "/api/departments/800", ""), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Compliance","parent_id":1000}`), 200, &created)
+	if created.ID == 800 {
+		t.Fatal("the slot of a deleted department was reused within the quarantine")
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/800/restore", ""), 200, nil)
+
+	cfg.IDs.TombstoneQuarantine = config.Duration(0)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/800", ""), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Legal","parent_id":1000}`), 200, &created)
+	if created.ID != 800 {
+		t.Errorf("new department = %d, want the purged slot 800", created.ID)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/800", ""), 200, nil)
+
+	var page auditPage
+	expect(t, serve(r, http.MethodGet, "/api/audit?pageSize=2", ""), 200, &page)
+	if len(page.Events) != 2 || page.Events[1].Action != store.AuditDepartmentPurge || page.Events[1].DepartmentID != 800 {
+		t.Errorf("events = %+v", page.Events)
+	}
+}
+
+func TestCompactKeepsDeletedDepartments(t *testing.T) {
+	r := newTestServer(t,
+		store.Department{ID: 1000, Name: "Head Office"},
+		store.Department{ID: 800, Name: "Legal", ParentID: 1000},
+		store.Department{ID: 600, Name: "Planning", ParentID: 1000},
+		store.Department{ID: 590, Name: "Budget", ParentID: 600},
+		store.Department{ID: 500, Name: "Sales", ParentID: 1000},
+		store.Department{ID: 490, Name: "Export", ParentID: 500},
+	)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/600", ""), 200, nil)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/490", ""), 200, nil)
+
+	// 600 and 490 keep their slots, so does 500 above 490; only 800 moves up
+	var resp struct {
+		Mapping []idgen.Mapping `json:"mapping"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/1000/compact", ""), 200, &resp)
+	if want := []idgen.Mapping{{OldID: 800, NewID: 900}}; !reflect.DeepEqual(resp.Mapping, want) {
+		t.Errorf("mapping = %+v, want %+v", resp.Mapping, want)
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	for _, want := range []int{800, 700} {
+		expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Compliance","parent_id":1000}`), 200, &created)
+		if created.ID != want {
+			t.Errorf("new department = %d, want %d", created.ID, want)
+		}
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/600/restore", ""), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/490/restore", ""), 200, nil)
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{490, 500, 590, 600, 700, 800, 900, 1000}) {
+		t.Errorf("departments after restore = %v", got)
+	}
+}
+
+func TestMoveKeepsDeletedDepartments(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/889", ""), 200, nil)
+
+	// 889 would be renumbered along with 900 and its slot freed
+	expect(t, serve(r, http.MethodPost, "/api/departments/900/move", `{"new_parent_id":2000}`), 409, nil)
+	expect(t, serve(r, http.MethodPut, "/api/departments/890", `{"name":"Domestic","parent_id":800}`), 409, nil)
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{800, 890, 900, 1000, 2000}) {
+		t.Errorf("departments after a refused move = %v", got)
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Overseas","parent_id":890}`), 200, &created)
+	if created.ID != 888 {
+		t.Fatalf("new department = %d, want 888 next to the quarantined 889", created.ID)
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/889/restore", ""), 200, nil)
+
+	// Once nothing below is deleted the subtree moves as a whole
+	var moved struct {
+		ID int `json:"id"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments/900/move", `{"new_parent_id":2000}`), 200, &moved)
+	if moved.ID != 1900 {
+		t.Errorf("moved to %d, want 1900", moved.ID)
+	}
+	if got := departmentIDs(t); !reflect.DeepEqual(got, []int{800, 1000, 1888, 1889, 1890, 1900, 2000}) {
+		t.Errorf("departments after the move = %v", got)
+	}
+
+	// Past the quarantine the tombstone is purged and no longer holds the move
+	cfg.IDs.TombstoneQuarantine = config.Duration(0)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/1889", ""), 200, nil)
+	expect(t, serve(r, http.MethodPost, "/api/departments/1900/move", `{"new_parent_id":1000}`), 200, &moved)
+	if moved.ID != 900 {
+		t.Errorf("moved back to %d, want 900", moved.ID)
+	}
+}
+
+func TestCapacityCountsDeletedDepartments(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	expect(t, serve(r, http.MethodDelete, "/api/departments/800", ""), 200, nil)
+
+	// The quarantined 800 is in use, so the next slot is the one Allocate picks
+	var capacity struct {
+		Slots idgen.Usage `json:"slots"`
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/1000/capacity", ""), 200, &capacity)
+	if capacity.Slots.Used != 2 || capacity.Slots.Free != 7 || capacity.Slots.Next != 700 {
+		t.Errorf("slots of 1000 = %+v", capacity.Slots)
+	}
+	var created struct {
+		ID int `json:"id"`
+	}
+	expect(t, serve(r, http.MethodPost, "/api/departments", `{"name":"Compliance","parent_id":1000}`), 200, &created)
+	if created.ID != capacity.Slots.Next {
+		t.Errorf("new department = %d, capacity reported %d as next", created.ID, capacity.Slots.Next)
+	}
+	expect(t, serve(r, http.MethodGet, "/api/departments/800/capacity", ""), 404, nil)
+
+	// Past the quarantine the slot is free again
+	cfg.IDs.TombstoneQuarantine = config.Duration(0)
+	expect(t, serve(r, http.MethodGet, "/api/departments/1000/capacity", ""), 200, &capacity)
+	if capacity.Slots.Used != 2 || capacity.Slots.Next != 800 {
+		t.Errorf("slots of 1000 past the quarantine = %+v", capacity.Slots)
+	}
+}
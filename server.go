@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a client may take to send the request headers
+const readHeaderTimeout = 10 * time.Second
+
+// runServer serves srv on ln until ctx is done, then stops accepting
+// connections and gives in-flight requests drainTimeout to finish.
+// It returns nil after a clean shutdown.
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener, drainTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	slog.Info("Listening", "addr", ln.Addr().String())
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining in-flight requests", "timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("draining requests: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// queryTimeoutMiddleware puts the deadline configured for the route on the
+// request context, which the repository passes to every query. A handler
+// failing because the deadline passed answers 504 instead of its own error.
+func queryTimeoutMiddleware(c *gin.Context) {
+	timeout := cfg.Server.RouteTimeout(c.Request.Method, c.FullPath())
+	if timeout <= 0 {
+		c.Next()
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	w := &deadlineWriter{ResponseWriter: c.Writer, ctx: ctx}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	if w.timedOut {
+		slog.WarnContext(ctx, "Query deadline exceeded", "route", c.FullPath(), "timeout", timeout)
+		c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "Query timed out"})
+	}
+}
+
+// deadlineWriter drops a server error response written after the deadline
+// of ctx, so queryTimeoutMiddleware can answer 504 in its place
+type deadlineWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	timedOut bool
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	if code >= 500 && !w.Written() && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+	}
+	if !w.timedOut {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	if w.timedOut {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	if w.timedOut {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	if !w.timedOut {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// warnUnknownRouteTimeouts logs configured route timeouts that match no route
+func warnUnknownRouteTimeouts(r *gin.Engine) {
+	routes := map[string]bool{}
+	for _, route := range r.Routes() {
+		routes[route.Method+" "+route.Path] = true
+	}
+	for route := range cfg.Server.RouteTimeouts {
+		if !routes[route] {
+			slog.Warn("server.route_timeouts names an unknown route", "route", route)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tree-table-idgenerator/config"
+	"tree-table-idgenerator/store"
+)
+
+// slowRepository makes LoadTree wait until its context is done
+type slowRepository struct {
+	store.Repository
+}
+
+func (slowRepository) LoadTree(ctx context.Context, root int, strategy store.TreeStrategy, payload int) ([]store.TreeNode, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	repo = slowRepository{repo}
+	cfg.Server.QueryTimeout = config.Duration(20 * time.Millisecond)
+	cfg.Server.RouteTimeouts = map[string]config.Duration{"GET /api/departments/tree-recursive": config.Duration(10 * time.Millisecond)}
+
+	for _, path := range []string{"/api/departments/tree-comparison?id=1000", "/api/departments/tree-recursive?parentId=1000"} {
+		var body map[string]string
+		expect(t, serve(r, http.MethodGet, path, ""), 504, &body)
+		if body["error"] != "Query timed out" {
+			t.Errorf("%s: body = %v", path, body)
+		}
+	}
+
+	// Requests finishing in time are not affected
+	expect(t, serve(r, http.MethodGet, "/api/departments/900", ""), 200, nil)
+	expect(t, serve(r, http.MethodGet, "/api/departments/123", ""), 404, nil)
+}
+
+func TestQueryTimeoutDisabled(t *testing.T) {
+	r := newTestServer(t, testTree...)
+	cfg.Server.QueryTimeout = 0
+	cfg.Server.RouteTimeouts = nil
+	var deadline bool
+	r.GET("/deadline", func(c *gin.Context) {
+		_, deadline = c.Request.Context().Deadline()
+	})
+	serve(r, http.MethodGet, "/deadline", "")
+	if deadline {
+		t.Error("request has a deadline with the timeouts disabled")
+	}
+}
+
+// startServer runs handler through runServer and returns its address, the
+// function stopping it and the channel its result arrives on
+func startServer(t *testing.T, handler http.Handler, drainTimeout time.Duration) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, &http.Server{Handler: handler}, ln, drainTimeout) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	addr, stop, done := startServer(t, handler, 5*time.Second)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr)
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{string(body), err}
+	}()
+	<-started
+	stop()
+
+	// The server stops accepting while the request is in flight
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr[len("http://"):])
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts connections after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("server stopped with a request in flight: %v", err)
+	default:
+	}
+
+	close(release)
+	if res := <-responses; res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request = %q, %v", res.body, res.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("runServer = %v", err)
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	addr, stop, done := startServer(t, handler, 50*time.Millisecond)
+
+	go http.Get(addr)
+	<-started
+	stop()
+	if err := <-done; err == nil {
+		t.Error("runServer returned nil with a request still running")
+	}
+}
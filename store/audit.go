@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditDepartmentCreate  = "department.create"
+	AuditDepartmentRename  = "department.rename"
+	AuditDepartmentMove    = "department.move"
+	AuditDepartmentDelete  = "department.delete"
+	AuditDepartmentCompact = "department.compact"
+	AuditDepartmentRestore = "department.restore"
+	AuditDepartmentPurge   = "department.purge"
+	AuditIntegrityFix      = "integrity.fix"
+	AuditEmployeeCreate    = "employee.create"
+	AuditEmployeeUpdate    = "employee.update"
+	AuditEmployeeDelete    = "employee.delete"
+)
+
+// AuditEvent is one change, written in the transaction that made it.
+//
+// DepartmentID is the department the change was made to, under the ID it
+// had at the time: the old ID for a move, the employee's department for an
+// employee change, and 0 for changes to the whole tree. Before and After
+// are JSON snapshots; Before is null for a creation and After for a deletion.
+type AuditEvent struct {
+	ID           int64           `json:"id"`
+	Time         time.Time       `json:"time"`
+	Actor        string          `json:"actor"`
+	RequestID    string          `json:"request_id"`
+	Action       string          `json:"action"`
+	DepartmentID int             `json:"department_id"`
+	EmployeeID   int             `json:"employee_id,omitempty"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+}
+
+// AuditQuery filters ListAuditEvents, which returns the newest events first.
+// Zero values disable a filter.
+type AuditQuery struct {
+	// Within, unless nil, keeps only the events of departments whose ID
+	// falls in one of the ranges; an empty list matches nothing
+	Within []idgen.Range
+	Actor  string
+	From   time.Time // inclusive
+	To     time.Time // exclusive
+	// Before continues past this event ID, for paging
+	Before int64
+	Limit  int
+}
+
+// DeletedSubtree is the Before snapshot of a department deletion, and the
+// After snapshot of its restore: every department and employee deleted with it
+type DeletedSubtree struct {
+	Departments []Department `json:"departments"`
+	Employees   []Employee   `json:"employees"`
+}
+
+// Actor is who makes the changes of a context, as recorded in the audit log
+type Actor struct {
+	Subject   string
+	RequestID string
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are recorded as made by a
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom returns the actor of ctx, the zero Actor if none was set
+func ActorFrom(ctx context.Context) Actor {
+	a, _ := ctx.Value(actorKey{}).(Actor)
+	return a
+}
+
+// Snapshot encodes v for AuditEvent.Before or After; nil stays null
+func Snapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// stampEvent fills in who made the change of e and when
+func stampEvent(ctx context.Context, e AuditEvent) AuditEvent {
+	actor := ActorFrom(ctx)
+	e.Actor, e.RequestID = actor.Subject, actor.RequestID
+	e.Time = now()
+	return e
+}
+
+// now is the time recorded for a change. The SQL databases keep microseconds.
+// Tests replace it to make changes happen at the same instant.
+var now = func() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
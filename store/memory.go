@@ -0,0 +1,891 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+)
+
+// Memory is a Repository that keeps everything in maps, for tests and
+// demos that should not need a database. It enforces the same keys and
+// cascades as the SQL schema. Allocations are serialized store wide, and a
+// failed one is undone by restoring a copy taken when it started.
+type Memory struct {
+	enc idgen.Encoding
+
+	mu             sync.Mutex
+	departments    map[int]Department
+	employees      map[int]Employee // HireDate is kept as 2006-01-02
+	externalKeys   map[string]int
+	nextEmployeeID int
+	events         []AuditEvent // oldest first
+	// deleted_at and delete batch of the departments and employees that are deleted
+	deletedDepartments map[int]tombstone
+	deletedEmployees   map[int]tombstone
+}
+
+// tombstone records when a row was deleted and, when it went with a
+// department, the batch of that DeleteDepartment
+type tombstone struct {
+	at    time.Time
+	batch string
+}
+
+var _ Repository = (*Memory)(nil)
+
+// NewMemory returns an empty store for IDs allocated with enc
+func NewMemory(enc idgen.Encoding) *Memory {
+	return &Memory{
+		enc:            enc,
+		departments:    make(map[int]Department),
+		employees:      make(map[int]Employee),
+		externalKeys:   make(map[string]int),
+		nextEmployeeID: 1,
+
+		deletedDepartments: make(map[int]tombstone),
+		deletedEmployees:   make(map[int]tombstone),
+	}
+}
+
+func (m *Memory) Ping(ctx context.Context) error { return nil }
+
+func (m *Memory) Close() error { return nil }
+
+func (m *Memory) ListDepartments(ctx context.Context) ([]Department, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectDepartments(func(Department) bool { return true }), nil
+}
+
+func (m *Memory) GetDepartment(ctx context.Context, id int) (Department, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.departments[id]
+	if !ok || m.isDeleted(id) {
+		return Department{}, ErrDepartmentNotFound
+	}
+	return d, nil
+}
+
+func (m *Memory) GetDepartments(ctx context.Context, ids []int) ([]Department, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectDepartments(func(d Department) bool { return wanted[d.ID] }), nil
+}
+
+func (m *Memory) DepartmentRange(ctx context.Context, r idgen.Range) ([]Department, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectDepartments(func(d Department) bool { return r.Contains(d.ID) }), nil
+}
+
+func (m *Memory) DeletedDepartmentIDs(ctx context.Context, r idgen.Range, deletedSince time.Time) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int
+	for id, t := range m.deletedDepartments {
+		if r.Contains(id) && !t.at.Before(deletedSince) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (m *Memory) RootDepartmentIDs(ctx context.Context) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int
+	for _, d := range m.selectDepartments(func(d Department) bool { return d.ParentID == 0 }) {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+func (m *Memory) DepartmentParents(ctx context.Context) (map[int]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parents := make(map[int]int, len(m.departments))
+	for id, d := range m.departments {
+		parents[id] = d.ParentID
+	}
+	return parents, nil
+}
+
+func (m *Memory) LoadTree(ctx context.Context, root int, strategy TreeStrategy, payload int) ([]TreeNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	levels := make(map[int]int)
+	switch strategy {
+	case ByParentID:
+		if _, ok := m.departments[root]; ok && !m.isDeleted(root) {
+			levels[root] = 0
+			children := m.childrenByParent()
+			queue := []int{root}
+			for len(queue) > 0 {
+				id := queue[0]
+				queue = queue[1:]
+				for _, child := range children[id] {
+					levels[child] = levels[id] + 1
+					queue = append(queue, child)
+				}
+			}
+		}
+	case ByIDRange:
+		subtree, err := m.enc.Descendants(root)
+		if err != nil {
+			return nil, err
+		}
+		rootLevel, err := m.enc.Level(root)
+		if err != nil {
+			return nil, err
+		}
+		for id := range m.departments {
+			if !subtree.Contains(id) {
+				continue
+			}
+			level, err := m.enc.Level(id)
+			if err != nil {
+				return nil, err
+			}
+			levels[id] = level - rootLevel
+		}
+	default:
+		return nil, fmt.Errorf("unknown tree strategy %d", strategy)
+	}
+
+	var nodes []TreeNode
+	for _, d := range m.selectDepartments(func(d Department) bool { _, ok := levels[d.ID]; return ok }) {
+		n := TreeNode{Department: d, Level: levels[d.ID]}
+		if payload > 0 {
+			parent := ""
+			if d.ParentID != 0 {
+				parent = strconv.Itoa(d.ParentID)
+			}
+			n.Payload = strings.Repeat(strconv.Itoa(d.ID)+d.Name+parent, payload)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (m *Memory) RenameDepartment(ctx context.Context, id int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before, ok := m.departments[id]
+	if !ok || m.isDeleted(id) {
+		return ErrDepartmentNotFound
+	}
+	if err := m.renameDepartment(id, name); err != nil {
+		return err
+	}
+	m.recordEvent(ctx, AuditEvent{
+		Action: AuditDepartmentRename, DepartmentID: id, Before: Snapshot(before), After: Snapshot(m.departments[id]),
+	})
+	return nil
+}
+
+func (m *Memory) DeleteDepartment(ctx context.Context, id int) (DeletedSubtree, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.departments[id]; !ok || m.isDeleted(id) {
+		return DeletedSubtree{}, ErrDepartmentNotFound
+	}
+	subtree := m.subtree(id, "")
+	deleted := DeletedSubtree{
+		Departments: m.selectDepartments(func(d Department) bool { return subtree[d.ID] }),
+		Employees:   m.selectEmployees(subtree, "", bySubtreeOrder),
+	}
+	if deleted.Employees == nil {
+		deleted.Employees = []Employee{}
+	}
+	batch, err := newDeleteBatch()
+	if err != nil {
+		return DeletedSubtree{}, err
+	}
+	t := tombstone{at: now(), batch: batch}
+	for departmentID := range subtree {
+		m.deletedDepartments[departmentID] = t
+	}
+	for _, emp := range deleted.Employees {
+		m.deletedEmployees[emp.ID] = t
+	}
+	m.recordEvent(ctx, AuditEvent{Action: AuditDepartmentDelete, DepartmentID: id, Before: Snapshot(deleted)})
+	return deleted, nil
+}
+
+func (m *Memory) RestoreDepartment(ctx context.Context, id int) (DeletedSubtree, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.departments[id]
+	if !ok {
+		return DeletedSubtree{}, ErrDepartmentNotFound
+	}
+	t, deleted := m.deletedDepartments[id]
+	if !deleted {
+		return DeletedSubtree{}, ErrNotDeleted
+	}
+	if m.isDeleted(d.ParentID) {
+		return DeletedSubtree{}, ErrParentDeleted
+	}
+
+	// Rows deleted earlier, on their own, stay deleted
+	subtree := m.subtree(id, t.batch)
+	restored := DeletedSubtree{
+		Employees: m.selectEmployees(subtree, t.batch, bySubtreeOrder),
+	}
+	if restored.Employees == nil {
+		restored.Employees = []Employee{}
+	}
+	for departmentID := range subtree {
+		delete(m.deletedDepartments, departmentID)
+	}
+	for _, emp := range restored.Employees {
+		delete(m.deletedEmployees, emp.ID)
+	}
+	restored.Departments = m.selectDepartments(func(d Department) bool { return subtree[d.ID] })
+	m.recordEvent(ctx, AuditEvent{Action: AuditDepartmentRestore, DepartmentID: id, After: Snapshot(restored)})
+	return restored, nil
+}
+
+func (m *Memory) Allocate(ctx context.Context, parentID int, fn func(tx Tx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	saved := m.snapshot()
+	if err := fn(&memoryTx{ctx: ctx, m: m}); err != nil {
+		m.restore(saved)
+		return err
+	}
+	return nil
+}
+
+func (m *Memory) ListEmployees(ctx context.Context, q EmployeeQuery) ([]Employee, int, error) {
+	if !EmployeeSortFields[q.Sort] {
+		return nil, 0, fmt.Errorf("invalid sort column %q", q.Sort)
+	}
+	if q.After != nil && q.Sort != "id" {
+		return nil, 0, fmt.Errorf("After can only be used when sorting by id")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []Employee
+	for _, emp := range m.employees {
+		if _, deleted := m.deletedEmployees[emp.ID]; deleted {
+			continue
+		}
+		if (q.DepartmentID == 0 || emp.DepartmentID == q.DepartmentID) &&
+			(q.Position == "" || emp.Position == q.Position) &&
+			(q.HireDateFrom == "" || emp.HireDate >= q.HireDateFrom) &&
+			(q.HireDateTo == "" || emp.HireDate <= q.HireDateTo) &&
+			(q.Within == nil || inRanges(q.Within, emp.DepartmentID)) {
+			matches = append(matches, emp)
+		}
+	}
+	total := len(matches)
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		c := compareEmployees(a, b, q.Sort)
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if q.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	if q.After != nil {
+		after := *q.After
+		start := len(matches)
+		for i, emp := range matches {
+			if (!q.Descending && emp.ID > after) || (q.Descending && emp.ID < after) {
+				start = i
+				break
+			}
+		}
+		matches = matches[start:]
+	} else if q.Offset < len(matches) {
+		matches = matches[q.Offset:]
+	} else {
+		matches = nil
+	}
+	if len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	employees := []Employee{}
+	for _, emp := range matches {
+		if !q.IncludeLargeText {
+			emp.LargeText = ""
+		}
+		employees = append(employees, readEmployee(emp))
+	}
+	return employees, total, nil
+}
+
+func (m *Memory) GetEmployee(ctx context.Context, id int) (Employee, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	emp, ok := m.employees[id]
+	if _, deleted := m.deletedEmployees[id]; !ok || deleted {
+		return Employee{}, ErrEmployeeNotFound
+	}
+	return readEmployee(emp), nil
+}
+
+func (m *Memory) CreateEmployee(ctx context.Context, emp Employee) (Employee, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emp.ID = 0
+	if err := m.checkEmployee(emp); err != nil {
+		return Employee{}, err
+	}
+	emp.ID = m.nextEmployeeID
+	m.nextEmployeeID++
+	m.employees[emp.ID] = emp
+	created := readEmployee(emp)
+	m.recordEvent(ctx, AuditEvent{
+		Action: AuditEmployeeCreate, DepartmentID: created.DepartmentID, EmployeeID: created.ID, After: Snapshot(created),
+	})
+	return created, nil
+}
+
+func (m *Memory) UpdateEmployee(ctx context.Context, emp Employee) (Employee, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.employees[emp.ID]
+	if _, deleted := m.deletedEmployees[emp.ID]; !ok || deleted {
+		return Employee{}, ErrEmployeeNotFound
+	}
+	if err := m.checkEmployee(emp); err != nil {
+		return Employee{}, err
+	}
+	if emp.LargeText == "" {
+		emp.LargeText = current.LargeText
+	}
+	m.employees[emp.ID] = emp
+	updated := readEmployee(emp)
+	m.recordEvent(ctx, AuditEvent{
+		Action: AuditEmployeeUpdate, DepartmentID: updated.DepartmentID, EmployeeID: updated.ID,
+		Before: Snapshot(readEmployee(current)), After: Snapshot(updated),
+	})
+	return updated, nil
+}
+
+func (m *Memory) DeleteEmployee(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.employees[id]
+	if _, deleted := m.deletedEmployees[id]; !ok || deleted {
+		return ErrEmployeeNotFound
+	}
+	m.deletedEmployees[id] = tombstone{at: now()}
+	m.recordEvent(ctx, AuditEvent{
+		Action: AuditEmployeeDelete, DepartmentID: current.DepartmentID, EmployeeID: id, Before: Snapshot(readEmployee(current)),
+	})
+	return nil
+}
+
+func (m *Memory) SubtreeEmployees(ctx context.Context, departmentID int) ([]Employee, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectEmployees(m.subtree(departmentID, ""), "", bySubtreeOrder), nil
+}
+
+func (m *Memory) EmployeesByDepartments(ctx context.Context, departmentIDs []int) ([]Employee, error) {
+	if len(departmentIDs) == 0 {
+		return nil, nil
+	}
+	wanted := make(map[int]bool, len(departmentIDs))
+	for _, id := range departmentIDs {
+		wanted[id] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectEmployees(wanted, "", func(a, b Employee) bool {
+		if a.DepartmentID != b.DepartmentID {
+			return a.DepartmentID < b.DepartmentID
+		}
+		return a.ID < b.ID
+	}), nil
+}
+
+func (m *Memory) ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := []AuditEvent{}
+	for i := len(m.events) - 1; i >= 0 && len(events) < q.Limit; i-- {
+		e := m.events[i]
+		if (q.Within == nil || inRanges(q.Within, e.DepartmentID)) &&
+			(q.Actor == "" || e.Actor == q.Actor) &&
+			(q.From.IsZero() || !e.Time.Before(q.From)) &&
+			(q.To.IsZero() || e.Time.Before(q.To)) &&
+			(q.Before == 0 || e.ID < q.Before) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// The helpers below expect m.mu to be held
+
+// recordEvent appends e to the audit log. Events recorded by a failed
+// allocation are dropped with the rest of its changes.
+func (m *Memory) recordEvent(ctx context.Context, e AuditEvent) {
+	e = stampEvent(ctx, e)
+	e.ID = int64(len(m.events) + 1)
+	m.events = append(m.events, e)
+}
+
+// isDeleted reports whether department id is deleted; 0 never is
+func (m *Memory) isDeleted(id int) bool {
+	_, deleted := m.deletedDepartments[id]
+	return deleted
+}
+
+// batchMatches reports whether a row with tombstone t, and deleted set if
+// it has one, is selected by batch: the empty batch selects the rows that
+// are not deleted
+func batchMatches(t tombstone, deleted bool, batch string) bool {
+	if batch == "" {
+		return !deleted
+	}
+	return deleted && t.batch == batch
+}
+
+// subtree returns departmentID and every department below it through
+// parent_id that was deleted in batch (empty for the ones not deleted), or
+// nothing if departmentID does not match
+func (m *Memory) subtree(departmentID int, batch string) map[int]bool {
+	subtree := make(map[int]bool)
+	matches := func(id int) bool {
+		t, deleted := m.deletedDepartments[id]
+		return batchMatches(t, deleted, batch)
+	}
+	if _, ok := m.departments[departmentID]; ok && matches(departmentID) {
+		children := m.childrenByParent()
+		queue := []int{departmentID}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			subtree[id] = true
+			for _, child := range children[id] {
+				if matches(child) {
+					queue = append(queue, child)
+				}
+			}
+		}
+	}
+	return subtree
+}
+
+// bySubtreeOrder orders employees by department and name, as SubtreeEmployees returns them
+func bySubtreeOrder(a, b Employee) bool {
+	if a.DepartmentID != b.DepartmentID {
+		return a.DepartmentID < b.DepartmentID
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+// selectDepartments returns the departments not deleted that match keep, ordered by ID
+func (m *Memory) selectDepartments(keep func(Department) bool) []Department {
+	var departments []Department
+	for _, d := range m.departments {
+		if !m.isDeleted(d.ID) && keep(d) {
+			departments = append(departments, d)
+		}
+	}
+	sort.Slice(departments, func(i, j int) bool { return departments[i].ID < departments[j].ID })
+	return departments
+}
+
+// selectEmployees returns the employees of the given departments deleted
+// in batch (empty for the ones not deleted), sorted by less
+func (m *Memory) selectEmployees(departments map[int]bool, batch string, less func(a, b Employee) bool) []Employee {
+	var employees []Employee
+	for _, emp := range m.employees {
+		t, deleted := m.deletedEmployees[emp.ID]
+		if departments[emp.DepartmentID] && batchMatches(t, deleted, batch) {
+			employees = append(employees, emp)
+		}
+	}
+	sort.Slice(employees, func(i, j int) bool { return less(employees[i], employees[j]) })
+	for i := range employees {
+		employees[i] = readEmployee(employees[i])
+	}
+	return employees
+}
+
+func (m *Memory) childrenByParent() map[int][]int {
+	children := make(map[int][]int)
+	for _, d := range m.departments {
+		if d.ParentID != 0 {
+			children[d.ParentID] = append(children[d.ParentID], d.ID)
+		}
+	}
+	return children
+}
+
+func (m *Memory) renameDepartment(id int, name string) error {
+	d, ok := m.departments[id]
+	if !ok {
+		return ErrDepartmentNotFound
+	}
+	d.Name = name
+	m.departments[id] = d
+	return nil
+}
+
+// deleteDepartments removes ids with everything that references them, as ON DELETE CASCADE does
+func (m *Memory) deleteDepartments(ids []int) {
+	deleted := make(map[int]bool)
+	children := m.childrenByParent()
+	queue := append([]int(nil), ids...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if deleted[id] {
+			continue
+		}
+		deleted[id] = true
+		delete(m.departments, id)
+		delete(m.deletedDepartments, id)
+		queue = append(queue, children[id]...)
+	}
+	for id, emp := range m.employees {
+		if deleted[emp.DepartmentID] {
+			delete(m.employees, id)
+			delete(m.deletedEmployees, id)
+		}
+	}
+	for key, id := range m.externalKeys {
+		if deleted[id] {
+			delete(m.externalKeys, key)
+		}
+	}
+}
+
+// checkEmployee applies the constraints the SQL schema puts on an employee row
+func (m *Memory) checkEmployee(emp Employee) error {
+	if _, err := time.Parse("2006-01-02", emp.HireDate); err != nil {
+		return fmt.Errorf("invalid hire date %q: %v", emp.HireDate, err)
+	}
+	if _, ok := m.departments[emp.DepartmentID]; !ok || m.isDeleted(emp.DepartmentID) {
+		return ErrDepartmentNotFound
+	}
+	// Deleted employees keep their number
+	for id, other := range m.employees {
+		if id != emp.ID && other.EmployeeNumber == emp.EmployeeNumber {
+			return ErrEmployeeNumberTaken
+		}
+	}
+	return nil
+}
+
+// readEmployee formats a stored employee the way the SQL stores return it
+func readEmployee(emp Employee) Employee {
+	if hireDate, err := time.Parse("2006-01-02", emp.HireDate); err == nil {
+		emp.HireDate = hireDate.Format(time.RFC3339)
+	}
+	return emp
+}
+
+func compareEmployees(a, b Employee, field string) int {
+	switch field {
+	case "id":
+		return a.ID - b.ID
+	case "department_id":
+		return a.DepartmentID - b.DepartmentID
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "position":
+		return strings.Compare(a.Position, b.Position)
+	case "hire_date":
+		return strings.Compare(a.HireDate, b.HireDate)
+	case "employee_number":
+		return strings.Compare(a.EmployeeNumber, b.EmployeeNumber)
+	}
+	return 0
+}
+
+type memorySnapshot struct {
+	departments    map[int]Department
+	employees      map[int]Employee
+	externalKeys   map[string]int
+	nextEmployeeID int
+	events         int
+
+	deletedDepartments map[int]tombstone
+	deletedEmployees   map[int]tombstone
+}
+
+func (m *Memory) snapshot() memorySnapshot {
+	s := memorySnapshot{
+		departments:    make(map[int]Department, len(m.departments)),
+		employees:      make(map[int]Employee, len(m.employees)),
+		externalKeys:   make(map[string]int, len(m.externalKeys)),
+		nextEmployeeID: m.nextEmployeeID,
+		events:         len(m.events),
+
+		deletedDepartments: make(map[int]tombstone, len(m.deletedDepartments)),
+		deletedEmployees:   make(map[int]tombstone, len(m.deletedEmployees)),
+	}
+	for id, d := range m.departments {
+		s.departments[id] = d
+	}
+	for id, emp := range m.employees {
+		s.employees[id] = emp
+	}
+	for key, id := range m.externalKeys {
+		s.externalKeys[key] = id
+	}
+	for id, t := range m.deletedDepartments {
+		s.deletedDepartments[id] = t
+	}
+	for id, t := range m.deletedEmployees {
+		s.deletedEmployees[id] = t
+	}
+	return s
+}
+
+func (m *Memory) restore(s memorySnapshot) {
+	m.departments = s.departments
+	m.employees = s.employees
+	m.externalKeys = s.externalKeys
+	m.nextEmployeeID = s.nextEmployeeID
+	m.deletedDepartments = s.deletedDepartments
+	m.deletedEmployees = s.deletedEmployees
+	// Events are only ever appended
+	m.events = m.events[:s.events]
+}
+
+// memoryTx implements Tx while Allocate holds the store's mutex, so the
+// Lock methods only have to read.
+type memoryTx struct {
+	ctx context.Context
+	m   *Memory
+}
+
+func (t *memoryTx) LockDepartment(id int) error {
+	if _, ok := t.m.departments[id]; !ok || t.m.isDeleted(id) {
+		return ErrDepartmentNotFound
+	}
+	return nil
+}
+
+func (t *memoryTx) LockRange(r idgen.Range) ([]int, error) {
+	var ids []int
+	for id := range t.m.departments {
+		if r.Contains(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (t *memoryTx) LockParents() (map[int]int, error) {
+	parents := make(map[int]int, len(t.m.departments))
+	for id, d := range t.m.departments {
+		parents[id] = d.ParentID
+	}
+	return parents, nil
+}
+
+func (t *memoryTx) ExistingIDs(ids []int) ([]int, error) {
+	var existing []int
+	for _, id := range ids {
+		if _, ok := t.m.departments[id]; ok {
+			existing = append(existing, id)
+		}
+	}
+	sort.Ints(existing)
+	return existing, nil
+}
+
+func (t *memoryTx) MaxID() (int, error) {
+	maxID := 0
+	for id := range t.m.departments {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return maxID, nil
+}
+
+func (t *memoryTx) DeletedIDs(r idgen.Range) ([]int, error) {
+	var ids []int
+	for id := range t.m.deletedDepartments {
+		if r.Contains(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (t *memoryTx) InsertDepartment(d Department) error {
+	if _, ok := t.m.departments[d.ID]; ok {
+		return fmt.Errorf("%w: department %d", ErrDuplicate, d.ID)
+	}
+	if _, ok := t.m.departments[d.ParentID]; d.ParentID != 0 && !ok {
+		return fmt.Errorf("parent %d of department %d does not exist", d.ParentID, d.ID)
+	}
+	t.m.departments[d.ID] = d
+	return nil
+}
+
+func (t *memoryTx) RenameDepartment(id int, name string) error {
+	return t.m.renameDepartment(id, name)
+}
+
+func (t *memoryTx) SetParent(id, parentID int) error {
+	d, ok := t.m.departments[id]
+	if !ok {
+		return ErrDepartmentNotFound
+	}
+	if _, ok := t.m.departments[parentID]; parentID != 0 && !ok {
+		return fmt.Errorf("parent %d of department %d does not exist", parentID, id)
+	}
+	d.ParentID = parentID
+	t.m.departments[id] = d
+	return nil
+}
+
+// Renumber removes every old row first, so old and new IDs may overlap
+// without staging.
+func (t *memoryTx) Renumber(mappings []idgen.Mapping) error {
+	newIDs := make(map[int]int, len(mappings))
+	moved := make([]Department, 0, len(mappings))
+	tombstones := make(map[int]tombstone)
+	for _, mapping := range mappings {
+		d, ok := t.m.departments[mapping.OldID]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrDepartmentNotFound, mapping.OldID)
+		}
+		parent, err := t.m.enc.Parent(mapping.NewID)
+		if err != nil {
+			return err
+		}
+		newIDs[mapping.OldID] = mapping.NewID
+		moved = append(moved, Department{ID: mapping.NewID, Name: d.Name, ParentID: parent})
+		if tomb, deleted := t.m.deletedDepartments[mapping.OldID]; deleted {
+			tombstones[mapping.NewID] = tomb
+		}
+	}
+
+	for _, mapping := range mappings {
+		delete(t.m.departments, mapping.OldID)
+		delete(t.m.deletedDepartments, mapping.OldID)
+	}
+	for id, tomb := range tombstones {
+		t.m.deletedDepartments[id] = tomb
+	}
+	for _, d := range moved {
+		if _, ok := t.m.departments[d.ID]; ok {
+			return fmt.Errorf("%w: department %d", ErrDuplicate, d.ID)
+		}
+		t.m.departments[d.ID] = d
+	}
+	for _, d := range moved {
+		if _, ok := t.m.departments[d.ParentID]; d.ParentID != 0 && !ok {
+			return fmt.Errorf("parent %d of department %d does not exist", d.ParentID, d.ID)
+		}
+	}
+
+	for id, emp := range t.m.employees {
+		if newID, ok := newIDs[emp.DepartmentID]; ok {
+			emp.DepartmentID = newID
+			t.m.employees[id] = emp
+		}
+	}
+	for key, id := range t.m.externalKeys {
+		if newID, ok := newIDs[id]; ok {
+			t.m.externalKeys[key] = newID
+		}
+	}
+
+	// Departments left pointing at a removed ID go with it, as in the SQL stores
+	var orphans []int
+	for id, d := range t.m.departments {
+		if _, ok := t.m.departments[d.ParentID]; d.ParentID != 0 && !ok {
+			orphans = append(orphans, id)
+		}
+	}
+	t.m.deleteDepartments(orphans)
+	return nil
+}
+
+func (t *memoryTx) ExternalKey(key string) (int, error) {
+	id, ok := t.m.externalKeys[key]
+	if !ok {
+		return 0, ErrExternalKeyNotFound
+	}
+	return id, nil
+}
+
+func (t *memoryTx) InsertExternalKey(key string, departmentID int) error {
+	if _, ok := t.m.externalKeys[key]; ok {
+		return fmt.Errorf("%w: external key %q", ErrDuplicate, key)
+	}
+	if _, ok := t.m.departments[departmentID]; !ok {
+		return fmt.Errorf("department %d of external key %q does not exist", departmentID, key)
+	}
+	t.m.externalKeys[key] = departmentID
+	return nil
+}
+
+func (t *memoryTx) PurgeTombstones(r idgen.Range, deletedBefore time.Time) ([]Department, error) {
+	var purged []Department
+	var ids []int
+	for id, tomb := range t.m.deletedDepartments {
+		if r.Contains(id) && tomb.at.Before(deletedBefore) {
+			purged = append(purged, t.m.departments[id])
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(purged, func(i, j int) bool { return purged[i].ID < purged[j].ID })
+	t.m.deleteDepartments(ids)
+	return purged, nil
+}
+
+func (t *memoryTx) RecordEvent(e AuditEvent) error {
+	t.m.recordEvent(t.ctx, e)
+	return nil
+}
+
+func inRanges(ranges []idgen.Range, id int) bool {
+	for _, r := range ranges {
+		if r.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//go:embed schema/mysql.sql
+var mysqlSchema string
+
+// MySQL error number for a duplicate primary or unique key
+const mysqlDuplicateEntry = 1062
+
+// mysqlDialect serializes allocations with a named lock held by the
+// connection the transaction runs on.
+type mysqlDialect struct{}
+
+func (mysqlDialect) driverName() string { return "mysql" }
+
+// dsn makes UPDATE report matched rather than changed rows, so renaming a
+// department to its current name is not mistaken for a missing row.
+func (mysqlDialect) dsn(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ClientFoundRows = true
+	return cfg.FormatDSN(), nil
+}
+
+func (mysqlDialect) schema() string { return mysqlSchema }
+
+func (mysqlDialect) timestamp() string { return "DATETIME(6)" }
+
+func (mysqlDialect) rebind(query string) string { return query }
+
+func (mysqlDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (mysqlDialect) returningID() bool { return false }
+
+func (mysqlDialect) payload(n int) string {
+	return fmt.Sprintf("REPEAT(CONCAT(id, name, IFNULL(parent_id, '')), %d)", n)
+}
+
+func (mysqlDialect) beginAllocation(ctx context.Context, db *sql.DB, parentID int) (*sql.Tx, func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lockName := fmt.Sprintf("departments.allocate.%d", parentID)
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(allocationLockTimeout.Seconds())).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, nil, ErrLockTimeout
+	}
+	release := func() {
+		if _, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", lockName); err != nil {
+			slog.ErrorContext(ctx, "Error releasing allocation lock", "lock", lockName, "err", err)
+		}
+		conn.Close()
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return tx, release, nil
+}
+
+func (mysqlDialect) isDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+// GET_LOCK reports a timeout through its result, which beginAllocation already turns into ErrLockTimeout
+func (mysqlDialect) isLockTimeout(err error) bool { return false }
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//go:embed schema/postgres.sql
+var postgresSchema string
+
+// PostgreSQL error codes
+const (
+	postgresUniqueViolation  = "23505"
+	postgresLockNotAvailable = "55P03"
+)
+
+// postgresDialect serializes allocations with a transaction-level advisory
+// lock keyed on the parent ID.
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string { return "postgres" }
+
+func (postgresDialect) dsn(dsn string) (string, error) { return dsn, nil }
+
+func (postgresDialect) schema() string { return postgresSchema }
+
+func (postgresDialect) timestamp() string { return "TIMESTAMPTZ" }
+
+// rebind numbers the placeholders, $1 for the first ?
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (postgresDialect) returningID() bool { return true }
+
+func (postgresDialect) payload(n int) string {
+	return fmt.Sprintf("repeat(id::text || name || coalesce(parent_id::text, ''), %d)", n)
+}
+
+func (postgresDialect) beginAllocation(ctx context.Context, db *sql.DB, parentID int) (*sql.Tx, func(), error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// lock_timeout also bounds the wait for advisory locks
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", allocationLockTimeout.Milliseconds())); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('departments.allocate'), $1)", parentID); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return tx, func() {}, nil
+}
+
+func (postgresDialect) isDuplicate(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation
+}
+
+func (postgresDialect) isLockTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresLockNotAvailable
+}
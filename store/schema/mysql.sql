@@ -0,0 +1,43 @@
+-- Tables of init/01_create_tables.sql to init/05_delete_batch.sql, without the seed data
+CREATE TABLE IF NOT EXISTS departments (
+    id INT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    parent_id INT,
+    deleted_at DATETIME(6),
+    delete_batch VARCHAR(32),
+    FOREIGN KEY (parent_id) REFERENCES departments(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS employees (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    employee_number VARCHAR(10) NOT NULL UNIQUE DEFAULT '',
+    name VARCHAR(100) NOT NULL,
+    position VARCHAR(50) NOT NULL,
+    department_id INT NOT NULL,
+    hire_date DATE NOT NULL,
+    large_text LONGTEXT,
+    deleted_at DATETIME(6),
+    delete_batch VARCHAR(32),
+    FOREIGN KEY (department_id) REFERENCES departments(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS department_external_keys (
+    external_key VARCHAR(100) PRIMARY KEY,
+    department_id INT NOT NULL,
+    FOREIGN KEY (department_id) REFERENCES departments(id) ON DELETE CASCADE
+);
+
+-- No foreign keys: events outlive the rows they describe
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    occurred_at DATETIME(6) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    action VARCHAR(50) NOT NULL,
+    department_id INT NOT NULL,
+    employee_id INT,
+    before_json LONGTEXT,
+    after_json LONGTEXT,
+    INDEX audit_events_department_id (department_id),
+    INDEX audit_events_occurred_at (occurred_at)
+);
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS departments (
+    id INT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    parent_id INT REFERENCES departments(id) ON DELETE CASCADE,
+    deleted_at TIMESTAMPTZ,
+    delete_batch VARCHAR(32)
+);
+
+CREATE INDEX IF NOT EXISTS departments_parent_id ON departments (parent_id);
+
+CREATE TABLE IF NOT EXISTS employees (
+    id SERIAL PRIMARY KEY,
+    employee_number VARCHAR(10) NOT NULL UNIQUE DEFAULT '',
+    name VARCHAR(100) NOT NULL,
+    position VARCHAR(50) NOT NULL,
+    department_id INT NOT NULL REFERENCES departments(id) ON DELETE CASCADE,
+    hire_date DATE NOT NULL,
+    large_text TEXT,
+    deleted_at TIMESTAMPTZ,
+    delete_batch VARCHAR(32)
+);
+
+CREATE INDEX IF NOT EXISTS employees_department_id ON employees (department_id);
+
+CREATE TABLE IF NOT EXISTS department_external_keys (
+    external_key VARCHAR(100) PRIMARY KEY,
+    department_id INT NOT NULL REFERENCES departments(id) ON DELETE CASCADE
+);
+
+-- No foreign keys: events outlive the rows they describe
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    action VARCHAR(50) NOT NULL,
+    department_id INT NOT NULL,
+    employee_id INT,
+    before_json TEXT,
+    after_json TEXT
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_department_id ON audit_events (department_id);
+CREATE INDEX IF NOT EXISTS audit_events_occurred_at ON audit_events (occurred_at);
@@ -0,0 +1,1147 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+)
+
+// How long Allocate waits for another transaction holding the same lock
+const allocationLockTimeout = 10 * time.Second
+
+// dialect holds what differs between the SQL databases
+type dialect interface {
+	// driverName is the database/sql driver, dsn adds the options the store relies on
+	driverName() string
+	dsn(dsn string) (string, error)
+	schema() string
+	// timestamp is the column type of a point in time
+	timestamp() string
+	// rebind rewrites the ? placeholders of query for the driver
+	rebind(query string) string
+	// forUpdate is appended to locking reads
+	forUpdate() string
+	// returningID reports whether inserts return the generated ID with RETURNING instead of LastInsertId
+	returningID() bool
+	// payload returns the select expression of the synthetic payload column of LoadTree
+	payload(n int) string
+	// beginAllocation starts a transaction holding the allocation lock of parentID.
+	// release is called once the transaction is over.
+	beginAllocation(ctx context.Context, db *sql.DB, parentID int) (tx *sql.Tx, release func(), err error)
+	isDuplicate(err error) bool
+	isLockTimeout(err error) bool
+}
+
+// SQLStore is a Repository backed by MySQL, PostgreSQL or SQLite
+type SQLStore struct {
+	db      *sql.DB
+	enc     idgen.Encoding
+	dialect dialect
+}
+
+var _ Repository = (*SQLStore)(nil)
+
+// Open returns a store for driver "mysql", "postgres" or "sqlite". enc must
+// be the encoding the stored IDs were allocated with. The connection is not
+// checked; use Ping.
+func Open(driver, dsn string, enc idgen.Encoding) (*SQLStore, error) {
+	var d dialect
+	switch driver {
+	case "mysql":
+		d = mysqlDialect{}
+	case "postgres":
+		d = postgresDialect{}
+	case "sqlite":
+		d = sqliteDialect{}
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected mysql, postgres or sqlite", driver)
+	}
+	dsn, err := d.dsn(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(d.driverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db, enc: enc, dialect: d}, nil
+}
+
+// CreateSchema creates the tables that do not exist yet and adds the
+// columns tables created by older versions lack. No rows are inserted.
+func (s *SQLStore) CreateSchema(ctx context.Context) error {
+	for _, statement := range strings.Split(s.dialect.schema(), ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	columns := []struct{ name, definition string }{
+		{"deleted_at", s.dialect.timestamp()},
+		{"delete_batch", "VARCHAR(32)"},
+	}
+	for _, table := range []string{"departments", "employees"} {
+		for _, column := range columns {
+			if _, err := s.db.ExecContext(ctx, "SELECT "+column.name+" FROM "+table+" WHERE 1 = 0"); err == nil {
+				continue
+			}
+			if _, err := s.db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column.name+" "+column.definition); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetPool limits the connection pool; 0 leaves a limit at the database/sql default
+func (s *SQLStore) SetPool(maxOpen, maxIdle int, maxLifetime time.Duration) {
+	if maxOpen > 0 {
+		s.db.SetMaxOpenConns(maxOpen)
+	}
+	if maxIdle > 0 {
+		s.db.SetMaxIdleConns(maxIdle)
+	}
+	if maxLifetime > 0 {
+		s.db.SetConnMaxLifetime(maxLifetime)
+	}
+}
+
+// DB returns the underlying pool, e.g. to export its statistics
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) ListDepartments(ctx context.Context) ([]Department, error) {
+	return s.queryDepartments(ctx, s.db, "SELECT id, name, parent_id FROM departments WHERE deleted_at IS NULL ORDER BY id")
+}
+
+func (s *SQLStore) GetDepartment(ctx context.Context, id int) (Department, error) {
+	var d Department
+	var parentID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind("SELECT id, name, parent_id FROM departments WHERE id = ? AND deleted_at IS NULL"), id).
+		Scan(&d.ID, &d.Name, &parentID)
+	if err == sql.ErrNoRows {
+		return d, ErrDepartmentNotFound
+	}
+	d.ParentID = int(parentID.Int64)
+	return d, err
+}
+
+func (s *SQLStore) GetDepartments(ctx context.Context, ids []int) ([]Department, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	placeholders, args := inClause(ids)
+	return s.queryDepartments(ctx, s.db, "SELECT id, name, parent_id FROM departments WHERE id IN ("+placeholders+") AND deleted_at IS NULL ORDER BY id", args...)
+}
+
+func (s *SQLStore) DepartmentRange(ctx context.Context, r idgen.Range) ([]Department, error) {
+	return s.queryDepartments(ctx, s.db, "SELECT id, name, parent_id FROM departments WHERE id BETWEEN ? AND ? AND deleted_at IS NULL ORDER BY id", r.Min, r.Max)
+}
+
+func (s *SQLStore) DeletedDepartmentIDs(ctx context.Context, r idgen.Range, deletedSince time.Time) ([]int, error) {
+	return queryIDs(ctx, s.db, s.dialect.rebind("SELECT id FROM departments WHERE id BETWEEN ? AND ? AND deleted_at >= ? ORDER BY id"), r.Min, r.Max, deletedSince.UTC())
+}
+
+func (s *SQLStore) RootDepartmentIDs(ctx context.Context) ([]int, error) {
+	return queryIDs(ctx, s.db, s.dialect.rebind("SELECT id FROM departments WHERE parent_id IS NULL AND deleted_at IS NULL ORDER BY id"))
+}
+
+func (s *SQLStore) DepartmentParents(ctx context.Context) (map[int]int, error) {
+	return queryParents(ctx, s.db, "SELECT id, parent_id FROM departments")
+}
+
+func (s *SQLStore) LoadTree(ctx context.Context, root int, strategy TreeStrategy, payload int) ([]TreeNode, error) {
+	payloadColumn := "''"
+	if payload > 0 {
+		payloadColumn = s.dialect.payload(payload)
+	}
+
+	var query string
+	var args []interface{}
+	var rootLevel int
+	switch strategy {
+	case ByParentID:
+		query = fmt.Sprintf(`
+			WITH RECURSIVE department_tree AS (
+				-- Base case: selected parent department
+				SELECT id, name, parent_id, 0 AS level
+				FROM departments
+				WHERE id = ? AND deleted_at IS NULL
+
+				UNION ALL
+
+				-- Recursive case: child departments
+				SELECT d.id, d.name, d.parent_id, dt.level + 1
+				FROM departments d
+				INNER JOIN department_tree dt ON d.parent_id = dt.id
+				WHERE d.deleted_at IS NULL
+			)
+			SELECT id, name, parent_id, level, %s
+			FROM department_tree
+			ORDER BY id`, payloadColumn)
+		args = []interface{}{root}
+	case ByIDRange:
+		subtree, err := s.enc.Descendants(root)
+		if err != nil {
+			return nil, err
+		}
+		if rootLevel, err = s.enc.Level(root); err != nil {
+			return nil, err
+		}
+		// The level is decoded from the ID afterwards
+		query = fmt.Sprintf(`
+			SELECT id, name, parent_id, 0, %s
+			FROM departments
+			WHERE id BETWEEN ? AND ? AND deleted_at IS NULL
+			ORDER BY id`, payloadColumn)
+		args = []interface{}{subtree.Min, subtree.Max}
+	default:
+		return nil, fmt.Errorf("unknown tree strategy %d", strategy)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []TreeNode
+	for rows.Next() {
+		var n TreeNode
+		var parentID sql.NullInt64
+		if err := rows.Scan(&n.ID, &n.Name, &parentID, &n.Level, &n.Payload); err != nil {
+			return nil, err
+		}
+		n.ParentID = int(parentID.Int64)
+		if strategy == ByIDRange {
+			level, err := s.enc.Level(n.ID)
+			if err != nil {
+				return nil, err
+			}
+			n.Level = level - rootLevel
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+func (s *SQLStore) RenameDepartment(ctx context.Context, id int, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := s.lockDepartment(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE departments SET name = ? WHERE id = ?"), name, id); err != nil {
+		return err
+	}
+	after := before
+	after.Name = name
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditDepartmentRename, DepartmentID: id, Before: Snapshot(before), After: Snapshot(after),
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteDepartment sets the same deleted_at and a new delete_batch on the
+// department, the departments below it and their employees. The batch is
+// how RestoreDepartment finds them again, so an employee deleted on its own
+// at the same instant is not brought back. Everything it deletes goes in the
+// Before snapshot of its audit event and is returned.
+func (s *SQLStore) DeleteDepartment(ctx context.Context, id int) (DeletedSubtree, error) {
+	var deleted DeletedSubtree
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return deleted, err
+	}
+	defer tx.Rollback()
+
+	if _, err := s.lockDepartment(ctx, tx, id); err != nil {
+		return deleted, err
+	}
+	if deleted.Departments, err = s.queryDepartments(ctx, tx, subtreeDepartmentsQuery, id); err != nil {
+		return deleted, err
+	}
+	if deleted.Employees, err = s.queryEmployees(ctx, tx, subtreeEmployeesQuery, id); err != nil {
+		return deleted, err
+	}
+	if deleted.Employees == nil {
+		deleted.Employees = []Employee{}
+	}
+	ids := make([]int, len(deleted.Departments))
+	for i, d := range deleted.Departments {
+		ids[i] = d.ID
+	}
+	batch, err := newDeleteBatch()
+	if err != nil {
+		return deleted, err
+	}
+	placeholders, args := inClause(ids)
+	deletedArgs := append([]interface{}{now(), batch}, args...)
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE departments SET deleted_at = ?, delete_batch = ? WHERE id IN ("+placeholders+")"), deletedArgs...); err != nil {
+		return deleted, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE employees SET deleted_at = ?, delete_batch = ? WHERE deleted_at IS NULL AND department_id IN ("+placeholders+")"), deletedArgs...); err != nil {
+		return deleted, err
+	}
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditDepartmentDelete, DepartmentID: id, Before: Snapshot(deleted),
+	}); err != nil {
+		return deleted, err
+	}
+	return deleted, tx.Commit()
+}
+
+func (s *SQLStore) RestoreDepartment(ctx context.Context, id int) (DeletedSubtree, error) {
+	var restored DeletedSubtree
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return restored, err
+	}
+	defer tx.Rollback()
+
+	var parentID sql.NullInt64
+	var deletedAt sql.NullTime
+	var batch sql.NullString
+	err = tx.QueryRowContext(ctx, s.dialect.rebind("SELECT parent_id, deleted_at, delete_batch FROM departments WHERE id = ?"+s.dialect.forUpdate()), id).
+		Scan(&parentID, &deletedAt, &batch)
+	if err == sql.ErrNoRows {
+		return restored, ErrDepartmentNotFound
+	}
+	if err != nil {
+		return restored, err
+	}
+	if !deletedAt.Valid {
+		return restored, ErrNotDeleted
+	}
+	if parentID.Valid {
+		var parentDeletedAt sql.NullTime
+		err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT deleted_at FROM departments WHERE id = ?"), parentID.Int64).Scan(&parentDeletedAt)
+		if err != nil {
+			return restored, err
+		}
+		if parentDeletedAt.Valid {
+			return restored, ErrParentDeleted
+		}
+	}
+
+	// Rows deleted earlier, on their own, stay deleted
+	if restored.Departments, err = s.queryDepartments(ctx, tx, deletedSubtreeQuery, id, batch.String, batch.String); err != nil {
+		return restored, err
+	}
+	ids := make([]int, len(restored.Departments))
+	for i, d := range restored.Departments {
+		ids[i] = d.ID
+	}
+	placeholders, args := inClause(ids)
+	restoredArgs := append([]interface{}{batch.String}, args...)
+	if restored.Employees, err = s.queryEmployees(ctx, tx, `
+		SELECT `+employeeColumns+`
+		FROM employees
+		WHERE delete_batch = ? AND department_id IN (`+placeholders+`)
+		ORDER BY department_id, name`, restoredArgs...); err != nil {
+		return restored, err
+	}
+	if restored.Employees == nil {
+		restored.Employees = []Employee{}
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE departments SET deleted_at = NULL, delete_batch = NULL WHERE id IN ("+placeholders+")"), args...); err != nil {
+		return restored, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE employees SET deleted_at = NULL, delete_batch = NULL WHERE delete_batch = ? AND department_id IN ("+placeholders+")"), restoredArgs...); err != nil {
+		return restored, err
+	}
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditDepartmentRestore, DepartmentID: id, After: Snapshot(restored),
+	}); err != nil {
+		return restored, err
+	}
+	return restored, tx.Commit()
+}
+
+func (s *SQLStore) Allocate(ctx context.Context, parentID int, fn func(tx Tx) error) error {
+	tx, release, err := s.dialect.beginAllocation(ctx, s.db, parentID)
+	if err != nil {
+		if s.dialect.isLockTimeout(err) {
+			return fmt.Errorf("%w: %v", ErrLockTimeout, err)
+		}
+		return err
+	}
+	defer release()
+	defer tx.Rollback()
+
+	if err := fn(&sqlTx{ctx: ctx, tx: tx, store: s}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Columns of an employee, in the order scanEmployee reads them
+const employeeColumns = "id, name, department_id, position, hire_date, employee_number, large_text"
+
+func (s *SQLStore) ListEmployees(ctx context.Context, q EmployeeQuery) ([]Employee, int, error) {
+	if !EmployeeSortFields[q.Sort] {
+		return nil, 0, fmt.Errorf("invalid sort column %q", q.Sort)
+	}
+	if q.After != nil && q.Sort != "id" {
+		return nil, 0, errors.New("After can only be used when sorting by id")
+	}
+	direction := "ASC"
+	if q.Descending {
+		direction = "DESC"
+	}
+
+	// Filters shared by the count and the page query
+	conditions := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if q.DepartmentID != 0 {
+		conditions = append(conditions, "department_id = ?")
+		args = append(args, q.DepartmentID)
+	}
+	if q.Position != "" {
+		conditions = append(conditions, "position = ?")
+		args = append(args, q.Position)
+	}
+	if q.HireDateFrom != "" {
+		conditions = append(conditions, "hire_date >= ?")
+		args = append(args, q.HireDateFrom)
+	}
+	if q.HireDateTo != "" {
+		conditions = append(conditions, "hire_date <= ?")
+		args = append(args, q.HireDateTo)
+	}
+	if q.Within != nil {
+		condition, rangeArgs := departmentWithin(q.Within)
+		conditions = append(conditions, condition)
+		args = append(args, rangeArgs...)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind("SELECT COUNT(*) FROM employees "+where(conditions)), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// Keyset mode continues after the cursor id instead of skipping rows
+	pageConditions := conditions
+	pageArgs := append([]interface{}{}, args...)
+	limit := "LIMIT ? OFFSET ?"
+	if q.After != nil {
+		op := ">"
+		if q.Descending {
+			op = "<"
+		}
+		pageConditions = append(append([]string{}, conditions...), "id "+op+" ?")
+		pageArgs = append(pageArgs, *q.After, q.Limit)
+		limit = "LIMIT ?"
+	} else {
+		pageArgs = append(pageArgs, q.Limit, q.Offset)
+	}
+
+	columns := employeeColumns
+	if !q.IncludeLargeText {
+		columns = strings.Replace(columns, "large_text", "NULL", 1)
+	}
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM employees
+		%s
+		ORDER BY %s %s, id %s
+		%s`, columns, where(pageConditions), q.Sort, direction, direction, limit)
+	employees, err := s.queryEmployees(ctx, s.db, query, pageArgs...)
+	if employees == nil {
+		employees = []Employee{}
+	}
+	return employees, total, err
+}
+
+func (s *SQLStore) GetEmployee(ctx context.Context, id int) (Employee, error) {
+	return s.loadEmployee(ctx, s.db, id)
+}
+
+func (s *SQLStore) CreateEmployee(ctx context.Context, emp Employee) (Employee, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Employee{}, err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkEmployeeReferences(ctx, tx, emp); err != nil {
+		return Employee{}, err
+	}
+
+	largeText := sql.NullString{String: emp.LargeText, Valid: emp.LargeText != ""}
+	query := "INSERT INTO employees (name, department_id, position, hire_date, employee_number, large_text) VALUES (?, ?, ?, ?, ?, ?)"
+	args := []interface{}{emp.Name, emp.DepartmentID, emp.Position, emp.HireDate, emp.EmployeeNumber, largeText}
+	var id int64
+	if s.dialect.returningID() {
+		err = tx.QueryRowContext(ctx, s.dialect.rebind(query+" RETURNING id"), args...).Scan(&id)
+	} else {
+		var result sql.Result
+		if result, err = tx.ExecContext(ctx, s.dialect.rebind(query), args...); err == nil {
+			id, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		return Employee{}, s.employeeError(err)
+	}
+
+	created, err := s.loadEmployee(ctx, tx, int(id))
+	if err != nil {
+		return Employee{}, err
+	}
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditEmployeeCreate, DepartmentID: created.DepartmentID, EmployeeID: created.ID, After: Snapshot(created),
+	}); err != nil {
+		return Employee{}, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *SQLStore) UpdateEmployee(ctx context.Context, emp Employee) (Employee, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Employee{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := s.lockEmployee(ctx, tx, emp.ID)
+	if err != nil {
+		return Employee{}, err
+	}
+	if err := s.checkEmployeeReferences(ctx, tx, emp); err != nil {
+		return Employee{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`
+		UPDATE employees
+		SET name = ?, department_id = ?, position = ?, hire_date = ?, employee_number = ?,
+			large_text = CASE WHEN ? = '' THEN large_text ELSE ? END
+		WHERE id = ?`),
+		emp.Name, emp.DepartmentID, emp.Position, emp.HireDate, emp.EmployeeNumber, emp.LargeText, emp.LargeText, emp.ID)
+	if err != nil {
+		return Employee{}, s.employeeError(err)
+	}
+
+	updated, err := s.loadEmployee(ctx, tx, emp.ID)
+	if err != nil {
+		return Employee{}, err
+	}
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditEmployeeUpdate, DepartmentID: updated.DepartmentID, EmployeeID: updated.ID, Before: Snapshot(before), After: Snapshot(updated),
+	}); err != nil {
+		return Employee{}, err
+	}
+	return updated, tx.Commit()
+}
+
+func (s *SQLStore) DeleteEmployee(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := s.lockEmployee(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE employees SET deleted_at = ? WHERE id = ?"), now(), id); err != nil {
+		return err
+	}
+	if err := s.recordEvent(ctx, tx, AuditEvent{
+		Action: AuditEmployeeDelete, DepartmentID: before.DepartmentID, EmployeeID: id, Before: Snapshot(before),
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// subtreeDepartmentsQuery selects a department and every department below
+// it through parent_id that is not deleted
+const subtreeDepartmentsQuery = `
+	WITH RECURSIVE subdepartments AS (
+		SELECT id, name, parent_id
+		FROM departments
+		WHERE id = ? AND deleted_at IS NULL
+
+		UNION ALL
+
+		SELECT d.id, d.name, d.parent_id
+		FROM departments d
+		INNER JOIN subdepartments sd ON d.parent_id = sd.id
+		WHERE d.deleted_at IS NULL
+	)
+	SELECT id, name, parent_id FROM subdepartments ORDER BY id`
+
+// deletedSubtreeQuery selects a department and every department below it
+// through parent_id that was deleted in the given batch, twice
+const deletedSubtreeQuery = `
+	WITH RECURSIVE subdepartments AS (
+		SELECT id, name, parent_id
+		FROM departments
+		WHERE id = ? AND delete_batch = ?
+
+		UNION ALL
+
+		SELECT d.id, d.name, d.parent_id
+		FROM departments d
+		INNER JOIN subdepartments sd ON d.parent_id = sd.id
+		WHERE d.delete_batch = ?
+	)
+	SELECT id, name, parent_id FROM subdepartments ORDER BY id`
+
+// subtreeEmployeesQuery selects the employees of a department and of every
+// department below it through parent_id
+const subtreeEmployeesQuery = `
+	WITH RECURSIVE subdepartments AS (
+		-- Base department
+		SELECT id, parent_id
+		FROM departments
+		WHERE id = ? AND deleted_at IS NULL
+
+		UNION ALL
+
+		-- Child departments
+		SELECT d.id, d.parent_id
+		FROM departments d
+		INNER JOIN subdepartments sd ON d.parent_id = sd.id
+		WHERE d.deleted_at IS NULL
+	)
+	SELECT e.id, e.name, e.department_id, e.position, e.hire_date, e.employee_number, e.large_text
+	FROM employees e
+	INNER JOIN subdepartments sd ON e.department_id = sd.id
+	WHERE e.deleted_at IS NULL
+	ORDER BY e.department_id, e.name`
+
+func (s *SQLStore) SubtreeEmployees(ctx context.Context, departmentID int) ([]Employee, error) {
+	return s.queryEmployees(ctx, s.db, subtreeEmployeesQuery, departmentID)
+}
+
+func (s *SQLStore) EmployeesByDepartments(ctx context.Context, departmentIDs []int) ([]Employee, error) {
+	if len(departmentIDs) == 0 {
+		return nil, nil
+	}
+	placeholders, args := inClause(departmentIDs)
+	return s.queryEmployees(ctx, s.db, `
+		SELECT `+employeeColumns+`
+		FROM employees
+		WHERE department_id IN (`+placeholders+`) AND deleted_at IS NULL
+		ORDER BY department_id, id`, args...)
+}
+
+func (s *SQLStore) ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if q.Within != nil {
+		condition, rangeArgs := departmentWithin(q.Within)
+		conditions = append(conditions, condition)
+		args = append(args, rangeArgs...)
+	}
+	if q.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if !q.From.IsZero() {
+		conditions = append(conditions, "occurred_at >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "occurred_at < ?")
+		args = append(args, q.To.UTC())
+	}
+	if q.Before != 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, q.Before)
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`
+		SELECT id, occurred_at, actor, request_id, action, department_id, employee_id, before_json, after_json
+		FROM audit_events
+		`+where(conditions)+`
+		ORDER BY id DESC
+		LIMIT ?`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var employeeID sql.NullInt64
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.RequestID, &e.Action, &e.DepartmentID, &employeeID, &before, &after); err != nil {
+			return nil, err
+		}
+		e.Time = e.Time.UTC()
+		e.EmployeeID = int(employeeID.Int64)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// recordEvent writes e to the audit log in tx
+func (s *SQLStore) recordEvent(ctx context.Context, tx *sql.Tx, e AuditEvent) error {
+	e = stampEvent(ctx, e)
+	employeeID := sql.NullInt64{Int64: int64(e.EmployeeID), Valid: e.EmployeeID != 0}
+	before := sql.NullString{String: string(e.Before), Valid: e.Before != nil}
+	after := sql.NullString{String: string(e.After), Valid: e.After != nil}
+	_, err := tx.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO audit_events (occurred_at, actor, request_id, action, department_id, employee_id, before_json, after_json)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.Time, e.Actor, e.RequestID, e.Action, e.DepartmentID, employeeID, before, after)
+	return err
+}
+
+// lockDepartment reads a department and keeps it from changing until the end of tx
+func (s *SQLStore) lockDepartment(ctx context.Context, tx *sql.Tx, id int) (Department, error) {
+	var d Department
+	var parentID sql.NullInt64
+	err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT id, name, parent_id FROM departments WHERE id = ? AND deleted_at IS NULL"+s.dialect.forUpdate()), id).
+		Scan(&d.ID, &d.Name, &parentID)
+	if err == sql.ErrNoRows {
+		return d, ErrDepartmentNotFound
+	}
+	d.ParentID = int(parentID.Int64)
+	return d, err
+}
+
+// lockEmployee reads an employee and keeps it from changing until the end of tx
+func (s *SQLStore) lockEmployee(ctx context.Context, tx *sql.Tx, id int) (Employee, error) {
+	row := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT "+employeeColumns+" FROM employees WHERE id = ? AND deleted_at IS NULL"+s.dialect.forUpdate()), id)
+	emp, err := scanEmployee(row.Scan)
+	if err == sql.ErrNoRows {
+		return emp, ErrEmployeeNotFound
+	}
+	return emp, err
+}
+
+// checkEmployeeReferences verifies the department exists and the employee
+// number is free. Deleted employees keep their number.
+func (s *SQLStore) checkEmployeeReferences(ctx context.Context, tx *sql.Tx, emp Employee) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT EXISTS(SELECT 1 FROM departments WHERE id = ? AND deleted_at IS NULL)"), emp.DepartmentID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrDepartmentNotFound
+	}
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT EXISTS(SELECT 1 FROM employees WHERE employee_number = ? AND id <> ?)"), emp.EmployeeNumber, emp.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrEmployeeNumberTaken
+	}
+	return nil
+}
+
+// employeeError maps a failed employee write; the only unique key is employee_number
+func (s *SQLStore) employeeError(err error) error {
+	if s.dialect.isDuplicate(err) {
+		return ErrEmployeeNumberTaken
+	}
+	return err
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadEmployee reads a single employee with every column
+func (s *SQLStore) loadEmployee(ctx context.Context, q querier, id int) (Employee, error) {
+	row := q.QueryRowContext(ctx, s.dialect.rebind("SELECT "+employeeColumns+" FROM employees WHERE id = ? AND deleted_at IS NULL"), id)
+	emp, err := scanEmployee(row.Scan)
+	if err == sql.ErrNoRows {
+		return emp, ErrEmployeeNotFound
+	}
+	return emp, err
+}
+
+func (s *SQLStore) queryEmployees(ctx context.Context, q querier, query string, args ...interface{}) ([]Employee, error) {
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var employees []Employee
+	for rows.Next() {
+		emp, err := scanEmployee(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, emp)
+	}
+	return employees, rows.Err()
+}
+
+func scanEmployee(scan func(dest ...interface{}) error) (Employee, error) {
+	var emp Employee
+	var hireDate time.Time
+	var largeText sql.NullString
+	if err := scan(&emp.ID, &emp.Name, &emp.DepartmentID, &emp.Position, &hireDate, &emp.EmployeeNumber, &largeText); err != nil {
+		return emp, err
+	}
+	emp.HireDate = hireDate.Format(time.RFC3339)
+	emp.LargeText = largeText.String
+	return emp, nil
+}
+
+func (s *SQLStore) queryDepartments(ctx context.Context, q querier, query string, args ...interface{}) ([]Department, error) {
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var departments []Department
+	for rows.Next() {
+		var d Department
+		var parentID sql.NullInt64
+		if err := rows.Scan(&d.ID, &d.Name, &parentID); err != nil {
+			return nil, err
+		}
+		d.ParentID = int(parentID.Int64)
+		departments = append(departments, d)
+	}
+	return departments, rows.Err()
+}
+
+// sqlTx implements Tx on a transaction started by Allocate
+type sqlTx struct {
+	ctx   context.Context
+	tx    *sql.Tx
+	store *SQLStore
+}
+
+func (t *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.ExecContext(t.ctx, t.store.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) LockDepartment(id int) error {
+	var locked int
+	err := t.tx.QueryRowContext(t.ctx, t.store.dialect.rebind("SELECT id FROM departments WHERE id = ? AND deleted_at IS NULL"+t.store.dialect.forUpdate()), id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return ErrDepartmentNotFound
+	}
+	return err
+}
+
+func (t *sqlTx) LockRange(r idgen.Range) ([]int, error) {
+	return queryIDs(t.ctx, t.tx, t.store.dialect.rebind("SELECT id FROM departments WHERE id BETWEEN ? AND ? ORDER BY id"+t.store.dialect.forUpdate()), r.Min, r.Max)
+}
+
+func (t *sqlTx) DeletedIDs(r idgen.Range) ([]int, error) {
+	return queryIDs(t.ctx, t.tx, t.store.dialect.rebind("SELECT id FROM departments WHERE id BETWEEN ? AND ? AND deleted_at IS NOT NULL ORDER BY id"), r.Min, r.Max)
+}
+
+func (t *sqlTx) LockParents() (map[int]int, error) {
+	return queryParents(t.ctx, t.tx, "SELECT id, parent_id FROM departments"+t.store.dialect.forUpdate())
+}
+
+func (t *sqlTx) ExistingIDs(ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	placeholders, args := inClause(ids)
+	query := "SELECT id FROM departments WHERE id IN (" + placeholders + ") ORDER BY id" + t.store.dialect.forUpdate()
+	return queryIDs(t.ctx, t.tx, t.store.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) MaxID() (int, error) {
+	// Locking the last row also keeps other writers from inserting past it
+	var maxID int
+	err := t.tx.QueryRowContext(t.ctx, "SELECT id FROM departments ORDER BY id DESC LIMIT 1"+t.store.dialect.forUpdate()).Scan(&maxID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return maxID, err
+}
+
+func (t *sqlTx) InsertDepartment(d Department) error {
+	parent := sql.NullInt64{Int64: int64(d.ParentID), Valid: d.ParentID != 0}
+	_, err := t.exec("INSERT INTO departments (id, name, parent_id) VALUES (?, ?, ?)", d.ID, d.Name, parent)
+	if t.store.dialect.isDuplicate(err) {
+		return fmt.Errorf("%w: department %d: %v", ErrDuplicate, d.ID, err)
+	}
+	return err
+}
+
+func (t *sqlTx) RenameDepartment(id int, name string) error {
+	result, err := t.exec("UPDATE departments SET name = ? WHERE id = ?", name, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result, ErrDepartmentNotFound)
+}
+
+func (t *sqlTx) SetParent(id, parentID int) error {
+	parent := sql.NullInt64{Int64: int64(parentID), Valid: parentID != 0}
+	result, err := t.exec("UPDATE departments SET parent_id = ? WHERE id = ?", parent, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result, ErrDepartmentNotFound)
+}
+
+// Renumber rewrites the primary key of every department in mappings.
+//
+// The IDs are referenced by parent_id and employees.department_id, so rows
+// are copied rather than updated in place. The copy goes through negative
+// staging IDs first, which lets the old and new ID sets overlap (e.g.
+// 800 -> 900 while 700 -> 800).
+func (t *sqlTx) Renumber(mappings []idgen.Mapping) error {
+	var changed []idgen.Mapping
+	for _, m := range mappings {
+		if m.OldID != m.NewID {
+			changed = append(changed, m)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	staging := make([]idgen.Mapping, len(changed))
+	final := make([]idgen.Mapping, len(changed))
+	renumbered := make(map[int]bool, len(changed))
+	for i, m := range changed {
+		staging[i] = idgen.Mapping{OldID: m.OldID, NewID: -m.NewID}
+		final[i] = idgen.Mapping{OldID: -m.NewID, NewID: m.NewID}
+		renumbered[m.NewID] = true
+	}
+
+	// While staged, a row points at the staging ID of its parent if the parent is renumbered too
+	if err := t.copyDepartments(staging, func(parent int) int {
+		if renumbered[parent] {
+			return -parent
+		}
+		return parent
+	}); err != nil {
+		return err
+	}
+	return t.copyDepartments(final, func(parent int) int { return parent })
+}
+
+// copyDepartments inserts each department under its new ID, moves its
+// employees and external keys over and then deletes the old rows from the leaves up.
+// parentOf translates the encoded parent of a new ID into the row it should reference.
+func (t *sqlTx) copyDepartments(mappings []idgen.Mapping, parentOf func(parent int) int) error {
+	enc := t.store.enc
+	depthOf := func(id int) int {
+		if id < 0 {
+			id = -id
+		}
+		level, _ := enc.Level(id)
+		return level
+	}
+
+	// Parents are inserted before their children
+	sorted := append([]idgen.Mapping(nil), mappings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depthOf(sorted[i].NewID) < depthOf(sorted[j].NewID)
+	})
+	for _, m := range sorted {
+		newID := m.NewID
+		if newID < 0 {
+			newID = -newID
+		}
+		encodedParent, err := enc.Parent(newID)
+		if err != nil {
+			return err
+		}
+		var name string
+		var deletedAt sql.NullTime
+		var batch sql.NullString
+		if err := t.tx.QueryRowContext(t.ctx, t.store.dialect.rebind("SELECT name, deleted_at, delete_batch FROM departments WHERE id = ?"), m.OldID).Scan(&name, &deletedAt, &batch); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: %d", ErrDepartmentNotFound, m.OldID)
+			}
+			return err
+		}
+		parent := 0
+		if encodedParent != 0 {
+			parent = parentOf(encodedParent)
+		}
+		if err := t.InsertDepartment(Department{ID: m.NewID, Name: name, ParentID: parent}); err != nil {
+			return err
+		}
+		if deletedAt.Valid {
+			if _, err := t.exec("UPDATE departments SET deleted_at = ?, delete_batch = ? WHERE id = ?", deletedAt.Time, batch, m.NewID); err != nil {
+				return err
+			}
+		}
+		if _, err := t.exec("UPDATE employees SET department_id = ? WHERE department_id = ?", m.NewID, m.OldID); err != nil {
+			return err
+		}
+		if _, err := t.exec("UPDATE department_external_keys SET department_id = ? WHERE department_id = ?", m.NewID, m.OldID); err != nil {
+			return err
+		}
+	}
+
+	// Children are deleted before their parents so nothing is lost to ON DELETE CASCADE
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depthOf(sorted[i].OldID) > depthOf(sorted[j].OldID)
+	})
+	for _, m := range sorted {
+		if _, err := t.exec("DELETE FROM departments WHERE id = ?", m.OldID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sqlTx) ExternalKey(key string) (int, error) {
+	var id int
+	err := t.tx.QueryRowContext(t.ctx, t.store.dialect.rebind("SELECT department_id FROM department_external_keys WHERE external_key = ?"), key).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrExternalKeyNotFound
+	}
+	return id, err
+}
+
+func (t *sqlTx) PurgeTombstones(r idgen.Range, deletedBefore time.Time) ([]Department, error) {
+	purged, err := t.store.queryDepartments(t.ctx, t.tx, `
+		SELECT id, name, parent_id
+		FROM departments
+		WHERE id BETWEEN ? AND ? AND deleted_at < ?
+		ORDER BY id`+t.store.dialect.forUpdate(), r.Min, r.Max, deletedBefore.UTC())
+	if err != nil || len(purged) == 0 {
+		return nil, err
+	}
+	ids := make([]int, len(purged))
+	for i, d := range purged {
+		ids[i] = d.ID
+	}
+	// ON DELETE CASCADE takes the rows below them and their employees along
+	placeholders, args := inClause(ids)
+	if _, err := t.exec("DELETE FROM departments WHERE id IN ("+placeholders+")", args...); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+func (t *sqlTx) RecordEvent(e AuditEvent) error {
+	return t.store.recordEvent(t.ctx, t.tx, e)
+}
+
+func (t *sqlTx) InsertExternalKey(key string, departmentID int) error {
+	_, err := t.exec("INSERT INTO department_external_keys (external_key, department_id) VALUES (?, ?)", key, departmentID)
+	if t.store.dialect.isDuplicate(err) {
+		return fmt.Errorf("%w: external key %q: %v", ErrDuplicate, key, err)
+	}
+	return err
+}
+
+// inClause returns the placeholders and arguments of an IN list
+func inClause(ids []int) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ","), args
+}
+
+// departmentWithin returns the condition keeping rows whose department_id
+// falls in one of ranges; an empty list matches nothing
+func departmentWithin(ranges []idgen.Range) (string, []interface{}) {
+	conditions := []string{"1 = 0"}
+	var args []interface{}
+	for _, r := range ranges {
+		conditions = append(conditions, "department_id BETWEEN ? AND ?")
+		args = append(args, r.Min, r.Max)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// queryParents runs a query selecting id and parent_id and returns them as id -> parent_id
+func queryParents(ctx context.Context, q querier, query string) (map[int]int, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := make(map[int]int)
+	for rows.Next() {
+		var id int
+		var parentID sql.NullInt64
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, err
+		}
+		parents[id] = int(parentID.Int64)
+	}
+	return parents, rows.Err()
+}
+
+// queryIDs reads a single integer column; query must already be rebound
+func queryIDs(ctx context.Context, q querier, query string, args ...interface{}) ([]int, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// requireRow returns notFound when an update or delete matched no row
+func requireRow(result sql.Result, notFound error) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
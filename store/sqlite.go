@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+//go:embed schema/sqlite.sql
+var sqliteSchema string
+
+// sqliteDialect relies on SQLite allowing a single writer: every
+// transaction takes the write lock when it begins, so allocations are
+// serialized database wide rather than per parent.
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string { return "sqlite3" }
+
+// dsn enables foreign keys, which SQLite leaves off by default, and makes
+// transactions wait for the write lock instead of failing right away.
+func (sqliteDialect) dsn(dsn string) (string, error) {
+	options := fmt.Sprintf("_foreign_keys=1&_busy_timeout=%d&_txlock=immediate", allocationLockTimeout.Milliseconds())
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + options, nil
+	}
+	return dsn + "?" + options, nil
+}
+
+func (sqliteDialect) schema() string { return sqliteSchema }
+
+func (sqliteDialect) timestamp() string { return "TIMESTAMP" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+// Locks are taken by the transaction as a whole
+func (sqliteDialect) forUpdate() string { return "" }
+
+func (sqliteDialect) returningID() bool { return false }
+
+func (sqliteDialect) payload(n int) string {
+	// SQLite has no REPEAT; each of the n "00" pairs is replaced by the row text
+	return fmt.Sprintf("replace(hex(zeroblob(%d)), '00', id || name || ifnull(parent_id, ''))", n)
+}
+
+func (sqliteDialect) beginAllocation(ctx context.Context, db *sql.DB, parentID int) (*sql.Tx, func(), error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, func() {}, nil
+}
+
+func (sqliteDialect) isDuplicate(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
+
+func (sqliteDialect) isLockTimeout(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy
+}
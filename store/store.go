@@ -0,0 +1,213 @@
+// Package store defines the Repository the API server reads and writes
+// departments and employees through, and its SQL implementations.
+//
+// The hierarchy rules (which slot a department gets, how a subtree is
+// renumbered) stay with the callers and the idgen package. A Repository only
+// persists rows and provides the locking that keeps concurrent allocations
+// from handing out the same ID.
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"tree-table-idgenerator/idgen"
+)
+
+var (
+	// ErrDepartmentNotFound is returned when a department does not exist.
+	ErrDepartmentNotFound = errors.New("department not found")
+	// ErrEmployeeNotFound is returned when an employee does not exist.
+	ErrEmployeeNotFound = errors.New("employee not found")
+	// ErrExternalKeyNotFound is returned when no department was imported under an external key.
+	ErrExternalKeyNotFound = errors.New("external key not found")
+	// ErrEmployeeNumberTaken is returned when another employee has the same employee number.
+	ErrEmployeeNumberTaken = errors.New("employee number is already in use")
+	// ErrDuplicate is returned when an insert collides with an existing primary or unique key.
+	ErrDuplicate = errors.New("duplicate key")
+	// ErrLockTimeout is returned when the allocation lock could not be taken in time.
+	ErrLockTimeout = errors.New("timed out waiting for allocation lock")
+	// ErrNotDeleted is returned when restoring a department that was not deleted.
+	ErrNotDeleted = errors.New("department is not deleted")
+	// ErrParentDeleted is returned when restoring a department whose parent is still deleted.
+	ErrParentDeleted = errors.New("parent department is deleted")
+)
+
+// Department is a row of the departments table. ParentID is 0 for a root.
+type Department struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID int    `json:"parent_id"`
+}
+
+// TreeNode is a department loaded as part of a subtree
+type TreeNode struct {
+	Department
+	Level   int    // depth below the subtree root
+	Payload string // synthetic column requested by LoadTree, empty by default
+}
+
+// Employee is a row of the employees table. HireDate is written as
+// 2006-01-02 and read back as an RFC 3339 timestamp.
+type Employee struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	DepartmentID   int    `json:"department_id"`
+	Position       string `json:"position"`
+	HireDate       string `json:"hire_date"`
+	EmployeeNumber string `json:"employee_number"`
+	LargeText      string `json:"large_text"`
+}
+
+// TreeStrategy selects how LoadTree finds the departments of a subtree
+type TreeStrategy int
+
+const (
+	// ByParentID walks parent_id down from the root with a recursive query.
+	ByParentID TreeStrategy = iota
+	// ByIDRange scans the range of IDs the encoding assigns to the root.
+	ByIDRange
+)
+
+// EmployeeSortFields are the columns ListEmployees can sort by
+var EmployeeSortFields = map[string]bool{
+	"id":              true,
+	"name":            true,
+	"department_id":   true,
+	"position":        true,
+	"hire_date":       true,
+	"employee_number": true,
+}
+
+// EmployeeQuery filters, sorts and pages ListEmployees. Zero values disable a filter.
+type EmployeeQuery struct {
+	DepartmentID int
+	Position     string
+	HireDateFrom string // inclusive, 2006-01-02
+	HireDateTo   string // inclusive, 2006-01-02
+	Sort         string // one of EmployeeSortFields; ties are broken by id
+	Descending   bool
+	// After continues past this id instead of skipping Offset rows; only valid when sorting by id
+	After            *int
+	Limit            int
+	Offset           int
+	IncludeLargeText bool
+	// Within, unless nil, keeps only the employees of departments whose ID
+	// falls in one of the ranges; an empty list matches nothing
+	Within []idgen.Range
+}
+
+// Repository stores departments and employees. RenameDepartment,
+// DeleteDepartment, RestoreDepartment and the employee writes record their
+// audit event in their own transaction; changes made through Allocate record
+// theirs with Tx.RecordEvent.
+//
+// Deleting only sets deleted_at. Deleted departments and employees are left
+// out of every read but DeletedDepartmentIDs and DepartmentParents, yet a
+// deleted department keeps its ID until Tx.PurgeTombstones removes it for
+// good.
+type Repository interface {
+	Ping(ctx context.Context) error
+	Close() error
+
+	// ListDepartments returns every department ordered by ID
+	ListDepartments(ctx context.Context) ([]Department, error)
+	GetDepartment(ctx context.Context, id int) (Department, error)
+	// GetDepartments returns the departments of ids that exist, ordered by ID
+	GetDepartments(ctx context.Context, ids []int) ([]Department, error)
+	// DepartmentRange returns the departments whose ID is in r, ordered by ID
+	DepartmentRange(ctx context.Context, r idgen.Range) ([]Department, error)
+	// DeletedDepartmentIDs returns the IDs in r of the departments deleted at
+	// or after deletedSince, ordered by ID
+	DeletedDepartmentIDs(ctx context.Context, r idgen.Range, deletedSince time.Time) ([]int, error)
+	// RootDepartmentIDs returns the departments without a parent, ordered by ID
+	RootDepartmentIDs(ctx context.Context) ([]int, error)
+	// DepartmentParents returns id -> parent_id of every department,
+	// deleted ones included, 0 for roots. Unlike Tx.LockParents it locks nothing.
+	DepartmentParents(ctx context.Context) (map[int]int, error)
+	// LoadTree returns root and its descendants ordered by ID. A payload
+	// above 0 fills TreeNode.Payload with the row's id, name and parent_id
+	// repeated that many times, to measure wide rows.
+	LoadTree(ctx context.Context, root int, strategy TreeStrategy, payload int) ([]TreeNode, error)
+	RenameDepartment(ctx context.Context, id int, name string) error
+	// DeleteDepartment deletes a department with its subtree and their
+	// employees, and returns them
+	DeleteDepartment(ctx context.Context, id int) (DeletedSubtree, error)
+	// RestoreDepartment brings back a deleted department with the
+	// departments and employees deleted along with it, and returns them.
+	// It returns ErrNotDeleted if id is not deleted and ErrParentDeleted
+	// while its parent is.
+	RestoreDepartment(ctx context.Context, id int) (DeletedSubtree, error)
+	// Allocate runs fn in a transaction while holding the lock that guards
+	// the child slots of parentID (0 for the roots). The transaction is
+	// committed when fn returns nil and rolled back otherwise.
+	Allocate(ctx context.Context, parentID int, fn func(tx Tx) error) error
+
+	// ListEmployees returns one page of employees and the number of employees matching the filters
+	ListEmployees(ctx context.Context, q EmployeeQuery) ([]Employee, int, error)
+	GetEmployee(ctx context.Context, id int) (Employee, error)
+	// CreateEmployee inserts emp and returns it as stored
+	CreateEmployee(ctx context.Context, emp Employee) (Employee, error)
+	// UpdateEmployee replaces emp; an empty LargeText keeps the stored one
+	UpdateEmployee(ctx context.Context, emp Employee) (Employee, error)
+	DeleteEmployee(ctx context.Context, id int) error
+	// SubtreeEmployees returns the employees of a department and of every
+	// department below it through parent_id, ordered by department and name.
+	SubtreeEmployees(ctx context.Context, departmentID int) ([]Employee, error)
+	// EmployeesByDepartments returns the employees of the given departments, ordered by department and ID
+	EmployeesByDepartments(ctx context.Context, departmentIDs []int) ([]Employee, error)
+
+	// ListAuditEvents returns the events matching q, newest first
+	ListAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
+
+// Tx is the transaction handed to the function run by Repository.Allocate.
+// The Lock methods keep the rows they return from changing until the end of
+// the transaction. Deleted departments still hold their ID: only
+// LockDepartment leaves them out.
+type Tx interface {
+	// LockDepartment returns ErrDepartmentNotFound if id does not exist
+	LockDepartment(id int) error
+	// LockRange returns the IDs of the departments in r, in ascending order
+	LockRange(r idgen.Range) ([]int, error)
+	// LockParents returns id -> parent_id of every department, 0 for roots
+	LockParents() (map[int]int, error)
+	// ExistingIDs returns the IDs among ids that exist, in ascending order
+	ExistingIDs(ids []int) ([]int, error)
+	// MaxID returns the largest department ID, 0 when there is none
+	MaxID() (int, error)
+	// DeletedIDs returns the IDs of the deleted departments in r, in
+	// ascending order
+	DeletedIDs(r idgen.Range) ([]int, error)
+	// InsertDepartment returns ErrDuplicate if the ID is taken
+	InsertDepartment(d Department) error
+	RenameDepartment(id int, name string) error
+	SetParent(id, parentID int) error
+	// Renumber moves every department of mappings to its new ID under the
+	// encoded parent of that ID, and repoints its employees and external
+	// keys. Old and new IDs may overlap.
+	Renumber(mappings []idgen.Mapping) error
+	// ExternalKey returns the department imported under key
+	ExternalKey(key string) (int, error)
+	// InsertExternalKey returns ErrDuplicate if key was already imported
+	InsertExternalKey(key string, departmentID int) error
+	// PurgeTombstones removes for good the departments in r deleted before
+	// deletedBefore, with everything below them, and returns them
+	PurgeTombstones(r idgen.Range, deletedBefore time.Time) ([]Department, error)
+	// RecordEvent adds e to the audit log, stamped with the actor of the
+	// Allocate context and the current time
+	RecordEvent(e AuditEvent) error
+}
+
+// newDeleteBatch returns a random ID shared by the rows one DeleteDepartment
+// marks deleted, so RestoreDepartment brings back exactly those rows
+func newDeleteBatch() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tree-table-idgenerator/idgen"
+	"tree-table-idgenerator/store"
+)
+
+// Matches the (id, 'name', parent_id) tuples of the department inserts
+var seedDepartmentRow = regexp.MustCompile(`\((\d+), '((?:[^']|'')*)', (NULL|\d+)\)`)
+
+// loadSeedDepartments parses the departments in init/01_create_tables.sql,
+// in the order they are inserted (parents first)
+func loadSeedDepartments(t testing.TB) []store.Department {
+	t.Helper()
+	sqlText, err := os.ReadFile("init/01_create_tables.sql")
+	if err != nil {
+		t.Fatalf("read seed data: %v", err)
+	}
+	var departments []store.Department
+	for _, match := range seedDepartmentRow.FindAllStringSubmatch(string(sqlText), -1) {
+		d := store.Department{Name: strings.ReplaceAll(match[2], "''", "'")}
+		d.ID, _ = strconv.Atoi(match[1])
+		if match[3] != "NULL" {
+			d.ParentID, _ = strconv.Atoi(match[3])
+		}
+		departments = append(departments, d)
+	}
+	if len(departments) == 0 {
+		t.Fatal("no departments found in seed data")
+	}
+	return departments
+}
+
+// loadSeedTree returns the seeded departments as an id -> parent_id map
+func loadSeedTree(t *testing.T) map[int]int {
+	t.Helper()
+	parents := make(map[int]int)
+	for _, d := range loadSeedDepartments(t) {
+		parents[d.ID] = d.ParentID
+	}
+	return parents
+}
+
+// TestDescendantsMatchSeedTree checks, for every seeded department, that the
+// decoded range holds exactly the departments reachable through parent_id.
+func TestDescendantsMatchSeedTree(t *testing.T) {
+	parents := loadSeedTree(t)
+	enc := idgen.Default
+
+	children := make(map[int][]int)
+	for id, parent := range parents {
+		children[parent] = append(children[parent], id)
+	}
+
+	for id, parent := range parents {
+		if got, err := enc.Parent(id); err != nil || got != parent {
+			t.Errorf("Parent(%d) = %d, %v; seed parent_id is %d", id, got, err, parent)
+		}
+
+		var want []int
+		stack := []int{id}
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			want = append(want, node)
+			stack = append(stack, children[node]...)
+		}
+		sort.Ints(want)
+
+		r, err := enc.Descendants(id)
+		if err != nil {
+			t.Fatalf("Descendants(%d): %v", id, err)
+		}
+		var got []int
+		for other := range parents {
+			if r.Contains(other) {
+				got = append(got, other)
+			}
+		}
+		sort.Ints(got)
+
+		if !sameIDs(got, want) {
+			t.Errorf("Descendants(%d) = %v selects %v, want %v", id, r, got, want)
+		}
+	}
+}
+
+// TestTreeStrategiesAgree runs the parent_id walk and the ID range query for
+// every department in the database and compares the IDs they return.
+func TestTreeStrategiesAgree(t *testing.T) {
+	openTestDB(t)
+
+	ids, _, err := loadHeldIDs(context.Background(), idgen.Range{Min: 1, Max: encoding.Limit() - 1})
+	if err != nil {
+		t.Fatalf("load departments: %v", err)
+	}
+	_, mismatched, err := runTreeBench(context.Background(), ids, 1, 0)
+	if err != nil {
+		t.Fatalf("run strategies: %v", err)
+	}
+	if len(mismatched) > 0 {
+		t.Errorf("strategies disagree for %v", mismatched)
+	}
+}